@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/docker/docker/errdefs"
+
+	"shh/agent/internal/protocol"
+)
+
+// dockerErrorCode maps the errdefs classes used by the Docker client
+func dockerErrorCode(err error) protocol.ErrorCode {
+	var (
+		notFound       errdefs.ErrNotFound
+		invalid        errdefs.ErrInvalidParameter
+		conflict       errdefs.ErrConflict
+		unauthorized   errdefs.ErrUnauthorized
+		forbidden      errdefs.ErrForbidden
+		unavailable    errdefs.ErrUnavailable
+		notImplemented errdefs.ErrNotImplemented
+		deadline       errdefs.ErrDeadline
+		cancelled      errdefs.ErrCancelled
+	)
+
+	switch {
+	case errors.As(err, &notFound):
+		return protocol.CodeNotFound
+	case errors.As(err, &invalid):
+		return protocol.CodeInvalidArgument
+	case errors.As(err, &conflict):
+		return protocol.CodeConflict
+	case errors.As(err, &unauthorized), errors.As(err, &forbidden):
+		return protocol.CodePermissionDenied
+	case errors.As(err, &unavailable):
+		return protocol.CodeUnavailable
+	case errors.As(err, &notImplemented):
+		return protocol.CodeUnsupported
+	case errors.As(err, &deadline):
+		return protocol.CodeTimeout
+	case errors.As(err, &cancelled):
+		return protocol.CodeCancelled
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/websocket"
+)
+
+// isDockerCommand reports whether cmd is handled by the Docker plugin
+func isDockerCommand(cmd protocol.AgentCommand) bool {
+	return strings.HasPrefix(cmd.Command, "docker:")
+}
+
+// hasExecSettings reports whether cmd sets any of the fields that only
+// apply to commands run as a process
+func hasExecSettings(cmd protocol.AgentCommand) bool {
+	return cmd.Cwd != "" || len(cmd.Env) > 0 || cmd.Stdin != "" || cmd.Timeout != "" || cmd.Shell ||
+		cmd.User != "" || cmd.Group != "" || cmd.Limits != nil || cmd.Priority != nil
+}
+
+// handleExecCommand runs cmd as a process and sends its result. A non-zero
+// exit is a result like any other; only failures to run the command at all
+// are returned as errors.
+func handleExecCommand(ctx context.Context, client *websocket.Client, processes *process.Manager, msg protocol.Message, cmd protocol.AgentCommand) error {
+	opts := execOptions(cmd)
+	if cmd.Stream {
+		return streamExecCommand(ctx, client, processes, msg, cmd, opts)
+	}
+
+	result, err := processes.Execute(ctx, cmd.Command, cmd.Args, opts...)
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fmt.Errorf("failed to execute command %s: %w", cmd.Command, err)
+	}
+
+	response := protocol.ResultPayload{
+		CommandID:       msg.ID,
+		ExitCode:        result.ExitCode,
+		Signal:          result.Signal,
+		Stdout:          result.Stdout,
+		Stderr:          result.Stderr,
+		StdoutTruncated: result.StdoutTruncated,
+		StderrTruncated: result.StderrTruncated,
+		WallTime:        result.WallTime,
+	}
+	if result.Usage != nil {
+		usage := protocol.ResourceUsage(*result.Usage)
+		response.Usage = &usage
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+
+	return client.SendMessage(protocol.Message{
+		Type:      protocol.TypeResult,
+		ID:        msg.ID,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// streamExecCommand runs cmd as a process and sends its output as it is
+// produced
+func streamExecCommand(ctx context.Context, client *websocket.Client, processes *process.Manager, msg protocol.Message, cmd protocol.AgentCommand, opts []process.ExecOption) error {
+	// Refuse before the stream is opened, so the server gets a rejection
+	// rather than an empty stream
+	if err := processes.Authorize(cmd.Command, cmd.Args, opts...); err != nil {
+		return err
+	}
+
+	stream := client.NewResultStream(ctx, msg.ID)
+
+	result, execErr := processes.ExecuteStream(ctx, cmd.Command, cmd.Args, stream.Write, opts...)
+	var exitErr *exec.ExitError
+	if errors.As(execErr, &exitErr) {
+		execErr = nil // Reported through the exit code
+	}
+	if err := stream.CloseResult(result, execErr); err != nil {
+		return fmt.Errorf("failed to close result stream: %w", err)
+	}
+
+	return execErr
+}
+
+// execOptions translates the execution settings of cmd
+func execOptions(cmd protocol.AgentCommand) []process.ExecOption {
+	var opts []process.ExecOption
+	if cmd.Cwd != "" {
+		opts = append(opts, process.WithWorkingDir(cmd.Cwd))
+	}
+	if len(cmd.Env) > 0 {
+		opts = append(opts, process.WithEnv(cmd.Env))
+	}
+	if cmd.Stdin != "" {
+		opts = append(opts, process.WithStdin(cmd.Stdin))
+	}
+	if timeout := cmd.TimeoutDuration(); timeout > 0 {
+		opts = append(opts, process.WithTimeout(timeout))
+	}
+	if cmd.Shell {
+		opts = append(opts, process.WithShell())
+	}
+	if cmd.User != "" || cmd.Group != "" {
+		opts = append(opts, process.WithUser(cmd.User, cmd.Group))
+	}
+	if cmd.Limits != nil {
+		opts = append(opts, process.WithLimits(process.Limits(*cmd.Limits)))
+	}
+	if cmd.Priority != nil {
+		opts = append(opts, process.WithPriority(process.Priority(*cmd.Priority)))
+	}
+	return opts
+}
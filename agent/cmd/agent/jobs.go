@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/websocket"
+)
+
+// isJobCommand reports whether cmd is handled by the job manager
+func isJobCommand(cmd protocol.AgentCommand) bool {
+	return strings.HasPrefix(cmd.Command, "job:")
+}
+
+// handleJobCommand runs a job:* command and sends its result
+func handleJobCommand(ctx context.Context, client *websocket.Client, jobs *process.JobManager, msg protocol.Message, cmd protocol.AgentCommand) error {
+	var (
+		result interface{}
+		err    error
+	)
+
+	switch cmd.Command {
+	case "job:start":
+		var params protocol.JobStartParams
+		if params, err = protocol.DecodeParams[protocol.JobStartParams](cmd); err == nil {
+			result, err = jobs.Start(params.Command, params.Args)
+		}
+	case "job:list":
+		result = jobs.List()
+	case "job:status":
+		var params protocol.JobParams
+		if params, err = protocol.DecodeParams[protocol.JobParams](cmd); err == nil {
+			result, err = jobs.Get(params.ID)
+		}
+	case "job:cancel":
+		var params protocol.JobParams
+		if params, err = protocol.DecodeParams[protocol.JobParams](cmd); err == nil {
+			err = jobs.Cancel(params.ID)
+			result = map[string]string{"id": params.ID}
+		}
+	case "job:output":
+		var params protocol.JobOutputParams
+		if params, err = protocol.DecodeParams[protocol.JobOutputParams](cmd); err == nil {
+			result, err = jobs.Output(params.ID, params.Offset, params.Limit)
+		}
+	default:
+		err = fmt.Errorf("%w: %s", errors.ErrUnsupported, cmd.Command)
+	}
+	if err != nil {
+		return err
+	}
+
+	resultJSON, err := json.Marshal(map[string]interface{}{
+		"result": result,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+
+	return client.SendMessage(protocol.Message{
+		Type:      protocol.TypeResult,
+		ID:        msg.ID,
+		Timestamp: time.Now(),
+		Payload:   resultJSON,
+	})
+}
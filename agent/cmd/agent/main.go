@@ -3,20 +3,29 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
 
 	"shh/agent/internal/config"
 	"shh/agent/internal/docker"
+	"shh/agent/internal/enroll"
 	"shh/agent/internal/health"
 	"shh/agent/internal/logger"
 	"shh/agent/internal/metrics"
+	"shh/agent/internal/policy"
 	"shh/agent/internal/process"
 	"shh/agent/internal/protocol"
+	"shh/agent/internal/proxy"
+	"shh/agent/internal/recorder"
+	"shh/agent/internal/session"
+	"shh/agent/internal/signing"
+	"shh/agent/internal/spool"
 	"shh/agent/internal/websocket"
 
 	"go.uber.org/zap"
@@ -46,6 +55,9 @@ func wrapHealthCheck(check func(context.Context) error) health.Check {
 }
 
 func main() {
+	// A re-exec starting a constrained command never returns from here
+	process.RunTrampoline()
+
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -68,7 +80,44 @@ func main() {
 	// Initialize components
 	healthChecker := health.NewChecker(log)
 	metricsCollector := metrics.NewCollector(log)
-	processManager := process.NewManager(log)
+
+	// Load the local policy of commands the server may run
+	var commandPolicy *policy.Engine
+	if cfg.Security.PolicyFile != "" {
+		commandPolicy, err = policy.Load(cfg.Security.PolicyFile, cfg.Agent.Labels, log)
+		if err != nil {
+			log.Fatal("Failed to load command policy", zap.Error(err))
+		}
+	}
+
+	processOpts := []process.ManagerOption{
+		process.WithOutputLimit(cfg.Agent.MaxOutputSize),
+		process.WithAuthorizer(commandPolicy),
+	}
+	jobOpts := []process.JobOption{process.WithJobAuthorizer(commandPolicy)}
+
+	// Confine every command, job and session to a cgroup of its own
+	var cgroups *process.CgroupSlice
+	if cfg.Agent.Cgroup.Enabled {
+		cgroups, err = process.NewCgroupSlice(cfg.Agent.Cgroup.Path, process.CgroupLimits{
+			MemoryMax: cfg.Agent.Cgroup.MemoryMax,
+			CPUMax:    cfg.Agent.Cgroup.CPUMax,
+			PidsMax:   cfg.Agent.Cgroup.PidsMax,
+		})
+		if err != nil {
+			log.Fatal("Failed to create cgroup slice", zap.Error(err))
+		}
+		processOpts = append(processOpts, process.WithCgroups(cgroups))
+		jobOpts = append(jobOpts, process.WithJobCgroups(cgroups))
+	}
+
+	processManager := process.NewManager(log, processOpts...)
+
+	// Initialize background jobs, whose output is kept on disk for paging
+	jobManager, err := process.NewJobManager(filepath.Join(cfg.Agent.DataDir, "jobs"), cfg.Agent.MaxJobs, log, jobOpts...)
+	if err != nil {
+		log.Fatal("Failed to create job manager", zap.Error(err))
+	}
 
 	// Initialize Docker plugin
 	dockerManager, err := docker.NewManager(log)
@@ -100,6 +149,8 @@ func main() {
 		Labels:   cfg.Agent.Labels,
 		Features: []string{
 			"exec",
+			"jobs",
+			"sessions",
 			"metrics",
 			"health",
 			"docker",
@@ -108,14 +159,117 @@ func main() {
 		},
 	}
 
+	// Open the outbound spool so results and events survive disconnects and restarts
+	outbox, err := spool.New(filepath.Join(cfg.Agent.DataDir, "spool"), cfg.Server.SpoolLimit, log)
+	if err != nil {
+		log.Fatal("Failed to open outbound spool", zap.Error(err))
+	}
+
+	dispatchLimits := make(map[protocol.MessageType]int)
+	for messageType, limit := range cfg.Agent.Dispatch.Limits {
+		dispatchLimits[protocol.MessageType(messageType)] = limit
+	}
+
+	clientOpts := []websocket.ClientOption{
+		websocket.WithDispatch(cfg.Agent.Dispatch.Workers, cfg.Agent.Dispatch.QueueSize, dispatchLimits),
+		websocket.WithReconnectDelay(cfg.Server.ReconnectDelay, cfg.Server.MaxReconnectDelay),
+		websocket.WithSpool(outbox),
+		websocket.WithRequestTimeout(cfg.Server.Timeout),
+		websocket.WithKeepalive(cfg.Server.PingInterval, cfg.Server.PongTimeout),
+		websocket.WithCodecs(cfg.Server.Codecs...),
+		websocket.WithCompression(cfg.Server.CompressionLevel),
+		websocket.WithLongPollFallback(cfg.Server.LongPollFallback),
+		websocket.WithErrorClassifier(dockerErrorCode),
+	}
+
+	// Register with the enrolled identity, enrolling first if this is a new agent
+	identity, err := enroll.NewStore(cfg.Agent.DataDir, cfg.Agent.BootstrapToken, log)
+	if err != nil {
+		log.Fatal("Failed to load agent identity", zap.Error(err))
+	}
+	if _, enrolled := identity.Identity(); enrolled || cfg.Agent.BootstrapToken != "" {
+		clientOpts = append(clientOpts, websocket.WithEnrollment(identity))
+	} else {
+		log.Warn("Agent is not enrolled; set agent.bootstrap_token to enroll with the server")
+	}
+
+	// Only accept server messages signed with the configured keys
+	if cfg.Security.RequireSignedCommands {
+		verifier, err := signing.LoadVerifier(cfg.Security)
+		if err != nil {
+			log.Fatal("Failed to load command signing keys", zap.Error(err))
+		}
+		clientOpts = append(clientOpts, websocket.WithVerifier(verifier))
+	} else {
+		log.Warn("Server commands are not authenticated; set security.require_signed_commands to enable signing")
+	}
+
+	// Load TLS certificates; they are reloaded when rotated on disk
+	if cfg.Security.TLSEnabled {
+		tlsLoader, err := websocket.NewTLSLoader(cfg.Security, log)
+		if err != nil {
+			log.Fatal("Failed to load TLS configuration", zap.Error(err))
+		}
+		defer tlsLoader.Close()
+		clientOpts = append(clientOpts, websocket.WithTLS(tlsLoader))
+	}
+
+	// Reach the server through the configured or environment proxy
+	proxyFunc, err := proxy.Func(cfg.Server.Proxy)
+	if err != nil {
+		log.Fatal("Invalid proxy configuration", zap.Error(err))
+	}
+	clientOpts = append(clientOpts, websocket.WithProxy(proxyFunc))
+
+	// Record the session for replaying with cmd/replay
+	if cfg.Recorder.Enabled {
+		rec, err := recorder.New(cfg.Recorder)
+		if err != nil {
+			log.Fatal("Failed to open session recording", zap.Error(err))
+		}
+		defer rec.Close()
+		clientOpts = append(clientOpts, websocket.WithRecorder(rec))
+		log.Warn("Recording all server messages", zap.String("file", cfg.Recorder.File))
+	}
+
+	// Fall back through the remaining servers when the primary is unreachable
+	servers := cfg.Server.Endpoints()
+	if len(servers) > 1 {
+		clientOpts = append(clientOpts, websocket.WithFailover(servers[1:], cfg.Server.FailbackInterval))
+	}
+
 	// Initialize WebSocket client
-	wsClient := websocket.NewClient(cfg.Server.URL, agentInfo, log)
+	wsClient := websocket.NewClient(servers[0], agentInfo, log, clientOpts...)
+
+	// Create handler wrapper for processes, jobs and the Docker plugin.
+	// Processes are checked against the policy by the process manager.
+	commandHandler := protocol.Handle(func(ctx context.Context, msg protocol.Message, cmd protocol.AgentCommand) error {
+		if !isJobCommand(cmd) && !isDockerCommand(cmd) {
+			return handleExecCommand(ctx, wsClient, processManager, msg, cmd)
+		}
 
-	// Create handler wrapper for Docker plugin
-	dockerHandler := func(ctx context.Context, msg protocol.Message) error {
-		var cmd protocol.AgentCommand
-		if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
-			return fmt.Errorf("invalid command payload: %w", err)
+		if hasExecSettings(cmd) {
+			return fmt.Errorf("%s does not run a process; execution settings: %w", cmd.Command, errors.ErrUnsupported)
+		}
+		if err := commandPolicy.AuthorizeCommand(cmd.Command); err != nil {
+			return err
+		}
+
+		if isJobCommand(cmd) {
+			return handleJobCommand(ctx, wsClient, jobManager, msg, cmd)
+		}
+
+		if cmd.Stream {
+			stream := wsClient.NewResultStream(ctx, msg.ID)
+			streamErr := dockerPlugin.HandleStream(ctx, cmd.Command, cmd.Args, stream.Write)
+			exitCode := 0
+			if streamErr != nil {
+				exitCode = 1
+			}
+			if err := stream.Close(exitCode, streamErr); err != nil {
+				return fmt.Errorf("failed to close result stream: %w", err)
+			}
+			return streamErr
 		}
 
 		result, err := dockerPlugin.HandleCommand(ctx, cmd.Command, cmd.Args)
@@ -136,13 +290,49 @@ func main() {
 			Timestamp: time.Now(),
 			Payload:   resultJSON,
 		})
-	}
+	})
 
 	// Register command handlers
-	wsClient.RegisterHandler(protocol.TypeCommand, dockerHandler)
+	wsClient.RegisterCommandHandler(commandHandler)
+
+	// Serve interactive terminal sessions
+	sessionOpts := []session.Option{
+		session.WithMaxSessions(cfg.Agent.Sessions.MaxSessions),
+		session.WithIdleTimeout(cfg.Agent.Sessions.IdleTimeout),
+		session.WithShell(cfg.Agent.Sessions.Shell),
+		session.WithAuthorizer(commandPolicy),
+	}
+	if cgroups != nil {
+		sessionOpts = append(sessionOpts, session.WithCgroups(cgroups))
+	}
+	if cfg.Agent.Sessions.Record {
+		sessionOpts = append(sessionOpts, session.WithRecording(cfg.Agent.Sessions.RecordDir))
+		log.Info("Recording terminal sessions", zap.String("dir", cfg.Agent.Sessions.RecordDir))
+	}
+	sessionManager := session.NewManager(wsClient.SendNow, log, sessionOpts...)
+	sessionManager.Register(wsClient)
+
+	// Apply agent settings the server hands out when it accepts the registration
+	heartbeatInterval := make(chan time.Duration, 1)
+	wsClient.OnRegistered(func(ack protocol.RegisterAck) {
+		value, ok := ack.Settings["heartbeat_interval"].(string)
+		if !ok {
+			return
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Warn("Ignoring invalid heartbeat interval from server", zap.String("value", value))
+			return
+		}
+		select {
+		case <-heartbeatInterval:
+		default:
+		}
+		heartbeatInterval <- interval
+	})
 
 	// Register health checks
-	healthChecker.AddCheck("websocket", wrapHealthCheck(wsClient.HealthCheck))
+	healthChecker.AddCheck("websocket", wsClient.HealthCheck)
 	healthChecker.AddCheck("process_manager", wrapHealthCheck(processManager.HealthCheck))
 	healthChecker.AddCheck("metrics", wrapHealthCheck(metricsCollector.HealthCheck))
 	healthChecker.AddCheck("docker", wrapHealthCheck(dockerManager.HealthCheck))
@@ -156,6 +346,8 @@ func main() {
 		{"health", healthChecker.Start, healthChecker.Shutdown},
 		{"metrics", metricsCollector.Start, metricsCollector.Shutdown},
 		{"process", processManager.Start, processManager.Shutdown},
+		{"jobs", func(context.Context) error { return nil }, jobManager.Shutdown},
+		{"sessions", func(context.Context) error { return nil }, sessionManager.Shutdown},
 		{"docker", dockerPlugin.Start, dockerPlugin.Shutdown},
 		{"websocket", wsClient.Connect, wsClient.Shutdown},
 	}
@@ -201,6 +393,9 @@ func main() {
 			select {
 			case <-ctx.Done():
 				return
+			case interval := <-heartbeatInterval:
+				log.Info("Heartbeat interval set by server", zap.Duration("interval", interval))
+				ticker.Reset(interval)
 			case <-ticker.C:
 				metrics := metricsCollector.GetMetrics()
 				processes, _ := processManager.GetProcesses()
@@ -217,6 +412,13 @@ func main() {
 					},
 				}
 
+				heartbeat.Server = wsClient.Server()
+
+				if latency, lastPong := wsClient.Latency(); !lastPong.IsZero() {
+					heartbeat.LatencyMs = float64(latency) / float64(time.Millisecond)
+					heartbeat.LastPong = &lastPong
+				}
+
 				heartbeatJSON, err := json.Marshal(heartbeat)
 				if err != nil {
 					log.Error("Failed to marshal heartbeat", zap.Error(err))
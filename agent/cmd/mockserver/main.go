@@ -0,0 +1,134 @@
+// Command mockserver is a local stand-in for the dashboard server. Point an
+// agent's server.url at it to exercise the agent without the dashboard:
+//
+//	mockserver -listen 127.0.0.1:4000
+//
+// Agents may connect on any path. Commands are sent with the JSON API (see
+// the mockserver package) or typed on stdin:
+//
+//	agents                              list connected agents
+//	run <agent> <command> [args...]     run a command and print its result
+//	stream <agent> <command> [args...]  the same, streaming output
+//	cancel <command-id>                 cancel a running command
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/mockserver"
+	"shh/agent/internal/protocol"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:4000", "address to listen on")
+	codecs := flag.String("codecs", "cbor,json", "codecs accepted from agents, most preferred first")
+	heartbeat := flag.Duration("heartbeat-interval", 0, "heartbeat interval handed to agents (0 leaves the agent default)")
+	debug := flag.Bool("debug", false, "log every heartbeat")
+	flag.Parse()
+
+	logConfig := zap.NewDevelopmentConfig()
+	if !*debug {
+		logConfig.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	}
+	log, err := logConfig.Build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to setup logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer log.Sync()
+
+	opts := []mockserver.Option{
+		mockserver.WithCodecs(strings.Split(*codecs, ",")...),
+	}
+	if *heartbeat > 0 {
+		opts = append(opts, mockserver.WithSettings(map[string]interface{}{
+			"heartbeat_interval": heartbeat.String(),
+		}))
+	}
+	server := mockserver.New(log, opts...)
+
+	httpServer := &http.Server{Addr: *listen, Handler: server}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Server failed", zap.Error(err))
+		}
+	}()
+	log.Info("Listening for agents", zap.String("listen", *listen))
+
+	go readCommands(server)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpServer.Shutdown(ctx)
+}
+
+// readCommands runs the stdin command loop
+func readCommands(server *mockserver.Server) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "agents":
+			printJSON(server.Agents())
+
+		case (fields[0] == "run" || fields[0] == "stream") && len(fields) >= 3:
+			cmd := protocol.AgentCommand{
+				Command: fields[2],
+				Args:    fields[3:],
+				Stream:  fields[0] == "stream",
+			}
+			id, err := server.Send(fields[1], cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			fmt.Printf("sent %s\n", id)
+			go func() {
+				result, err := server.Wait(context.Background(), id)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return
+				}
+				printJSON(result)
+			}()
+
+		case fields[0] == "cancel" && len(fields) == 2:
+			if err := server.Cancel(fields[1], "cancelled from mockserver"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+
+		default:
+			fmt.Fprintln(os.Stderr, "usage: agents | run <agent> <command> [args...] | stream <agent> <command> [args...] | cancel <command-id>")
+		}
+	}
+}
+
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(data))
+}
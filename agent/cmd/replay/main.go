@@ -0,0 +1,373 @@
+// Command replay feeds a session recorded by the agent back into a live
+// agent. It plays the server's side of the recording over a local websocket:
+// point an agent's server.url at it and the agent's handlers receive the same
+// messages, in the same order and with the same timing, as in the field.
+//
+//	replay -listen 127.0.0.1:4000 /var/lib/shh-agent/recordings/session.jsonl
+//
+// Replies to requests the agent sent are matched to the agent's new request
+// IDs, and the codec is forced to JSON. Recordings of signed commands only
+// replay with security.require_signed_commands off, as their timestamps are
+// stale. When the replay ends, the messages the agent sent are compared with
+// the ones in the recording.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/config"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/recorder"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:4000", "address the fake server listens on")
+	conn := flag.Uint64("conn", 0, "connection to replay from the recording (default the first)")
+	speed := flag.Float64("speed", 1, "timing multiplier; 0 sends messages without delay")
+	timeout := flag.Duration("timeout", 30*time.Second, "how long to wait for the agent's requests")
+	linger := flag.Duration("linger", 5*time.Second, "how long to collect output after the last message")
+	out := flag.String("out", "", "record the replayed session to this file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] recording\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	log, err := zap.NewDevelopment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to setup logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer log.Sync()
+
+	entries, err := recorder.Load(flag.Arg(0))
+	if err != nil {
+		log.Fatal("Failed to load recording", zap.Error(err))
+	}
+
+	conns := recorder.Conns(entries)
+	if len(conns) == 0 {
+		log.Fatal("Recording is empty")
+	}
+	if *conn == 0 {
+		*conn = conns[0]
+	}
+	entries = recorder.Filter(entries, *conn)
+	if len(entries) == 0 {
+		log.Fatal("Connection not in recording",
+			zap.Uint64("conn", *conn),
+			zap.Uint64s("available", conns))
+	}
+
+	r := &replayer{
+		logger:  log,
+		entries: entries,
+		speed:   *speed,
+		timeout: *timeout,
+		linger:  *linger,
+		done:    make(chan struct{}),
+	}
+
+	if *out != "" {
+		rec, err := recorder.New(config.RecorderConfig{File: *out})
+		if err != nil {
+			log.Fatal("Failed to open output recording", zap.Error(err))
+		}
+		defer rec.Close()
+		r.recorder = rec
+	}
+
+	server := &http.Server{Addr: *listen, Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Fake server failed", zap.Error(err))
+		}
+	}()
+
+	log.Info("Waiting for the agent to connect",
+		zap.String("listen", *listen),
+		zap.Uint64("conn", *conn),
+		zap.Int("messages", len(entries)))
+
+	<-r.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+
+	if !r.report(os.Stdout) {
+		os.Exit(1)
+	}
+}
+
+// replayer is the fake server. It serves a single agent connection.
+type replayer struct {
+	logger   *zap.Logger
+	entries  []recorder.Entry
+	speed    float64
+	timeout  time.Duration
+	linger   time.Duration
+	recorder *recorder.Recorder
+
+	once sync.Once
+	done chan struct{}
+
+	mu        sync.Mutex
+	received  []protocol.Message
+	unclaimed map[protocol.MessageType][]string // Live request IDs not yet replied to
+	arrived   chan struct{}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+func (r *replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	started := false
+	r.once.Do(func() { started = true })
+	if !started {
+		http.Error(w, "replay already in progress", http.StatusConflict)
+		return
+	}
+	defer close(r.done)
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		r.logger.Error("Failed to upgrade agent connection", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	r.logger.Info("Agent connected, replaying", zap.String("remote", req.RemoteAddr))
+
+	r.unclaimed = make(map[protocol.MessageType][]string)
+	r.arrived = make(chan struct{}, 1)
+	go r.readLoop(conn)
+
+	if err := r.play(conn); err != nil {
+		r.logger.Error("Replay stopped", zap.Error(err))
+		return
+	}
+
+	r.logger.Info("Replay finished, collecting output", zap.Duration("linger", r.linger))
+	time.Sleep(r.linger)
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay finished"),
+		time.Now().Add(time.Second))
+}
+
+// readLoop collects what the agent sends
+func (r *replayer) readLoop(conn *websocket.Conn) {
+	for {
+		var msg protocol.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		r.logger.Info("Agent sent",
+			zap.String("type", string(msg.Type)),
+			zap.String("id", msg.ID))
+		r.record(recorder.Outbound, msg)
+
+		r.mu.Lock()
+		r.received = append(r.received, msg)
+		r.unclaimed[msg.Type] = append(r.unclaimed[msg.Type], msg.ID)
+		r.mu.Unlock()
+
+		select {
+		case r.arrived <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// play sends the recorded server messages with their original spacing
+func (r *replayer) play(conn *websocket.Conn) error {
+	requests := make(map[string]protocol.MessageType)
+	var last time.Time
+
+	for _, entry := range r.entries {
+		msg := entry.Message
+
+		if entry.Direction == recorder.Outbound {
+			requests[msg.ID] = msg.Type
+			continue
+		}
+
+		if !last.IsZero() && r.speed > 0 {
+			time.Sleep(time.Duration(float64(entry.Time.Sub(last)) * r.speed))
+		}
+		last = entry.Time
+
+		// Replies go to whatever ID the agent used for the same request
+		if msg.CorrelationID != "" {
+			requestType, ok := requests[msg.CorrelationID]
+			if !ok {
+				r.logger.Warn("Reply to a request missing from the recording",
+					zap.String("type", string(msg.Type)),
+					zap.String("correlation_id", msg.CorrelationID))
+			} else {
+				id, err := r.claim(requestType)
+				if err != nil {
+					return err
+				}
+				msg.CorrelationID = id
+			}
+		}
+
+		if msg.Type == protocol.TypeRegistered {
+			msg = forceJSON(msg)
+		}
+
+		if err := conn.WriteJSON(msg); err != nil {
+			return fmt.Errorf("failed to send %s %s: %w", msg.Type, msg.ID, err)
+		}
+		r.record(recorder.Inbound, msg)
+
+		r.logger.Info("Replayed",
+			zap.String("type", string(msg.Type)),
+			zap.String("id", msg.ID))
+	}
+
+	return nil
+}
+
+// claim waits for the agent to send a request of type t and returns its ID
+func (r *replayer) claim(t protocol.MessageType) (string, error) {
+	deadline := time.NewTimer(r.timeout)
+	defer deadline.Stop()
+
+	for {
+		r.mu.Lock()
+		if ids := r.unclaimed[t]; len(ids) > 0 {
+			r.unclaimed[t] = ids[1:]
+			r.mu.Unlock()
+			return ids[0], nil
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-r.arrived:
+		case <-deadline.C:
+			return "", fmt.Errorf("agent did not send a %s request within %s", t, r.timeout)
+		}
+	}
+}
+
+// forceJSON rewrites a registration ack to select JSON, which the fake
+// server speaks regardless of the codec recorded
+func forceJSON(msg protocol.Message) protocol.Message {
+	ack, err := protocol.DecodePayload[protocol.RegisterAck](msg)
+	if err != nil {
+		return msg
+	}
+	ack.Codec = protocol.CodecJSON
+
+	if payload, err := json.Marshal(ack); err == nil {
+		msg.Payload = payload
+	}
+	return msg
+}
+
+func (r *replayer) record(dir recorder.Direction, msg protocol.Message) {
+	if r.recorder == nil {
+		return
+	}
+	if err := r.recorder.Record(recorder.Entry{Conn: 1, Direction: dir, Message: msg}); err != nil {
+		r.logger.Warn("Failed to record message", zap.Error(err))
+	}
+}
+
+// replyTypes are compared between the recording and the replay. Other
+// outbound messages, such as heartbeats, depend on timing and host state.
+var replyTypes = map[protocol.MessageType]bool{
+	protocol.TypeResult:      true,
+	protocol.TypeResultChunk: true,
+	protocol.TypeRejected:    true,
+}
+
+// report prints how the agent's replies compare with the recorded ones and
+// returns false if any are missing or unexpected
+func (r *replayer) report(w io.Writer) bool {
+	type key struct {
+		t  protocol.MessageType
+		id string
+	}
+
+	recorded := make(map[key]protocol.Message)
+	var order []key
+	for _, entry := range r.entries {
+		msg := entry.Message
+		if entry.Direction != recorder.Outbound || !replyTypes[msg.Type] {
+			continue
+		}
+		k := key{msg.Type, msg.ID}
+		if _, ok := recorded[k]; !ok {
+			order = append(order, k)
+		}
+		recorded[k] = msg
+	}
+
+	r.mu.Lock()
+	live := make(map[key]protocol.Message)
+	var extra []key
+	for _, msg := range r.received {
+		if !replyTypes[msg.Type] {
+			continue
+		}
+		k := key{msg.Type, msg.ID}
+		if _, ok := recorded[k]; !ok {
+			extra = append(extra, k)
+		}
+		live[k] = msg
+	}
+	r.mu.Unlock()
+
+	ok := true
+	for _, k := range order {
+		msg, found := live[k]
+		switch {
+		case !found:
+			ok = false
+			fmt.Fprintf(w, "missing    %-14s %s\n", k.t, k.id)
+		case samePayload(msg.Payload, recorded[k].Payload):
+			fmt.Fprintf(w, "same       %-14s %s\n", k.t, k.id)
+		default:
+			fmt.Fprintf(w, "changed    %-14s %s\n", k.t, k.id)
+		}
+	}
+	for _, k := range extra {
+		ok = false
+		fmt.Fprintf(w, "unexpected %-14s %s\n", k.t, k.id)
+	}
+
+	return ok
+}
+
+// samePayload compares two JSON payloads ignoring formatting
+func samePayload(a, b json.RawMessage) bool {
+	var bufA, bufB bytes.Buffer
+	if json.Compact(&bufA, a) != nil || json.Compact(&bufB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
+}
@@ -3,16 +3,21 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"runtime"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	"shh/agent/internal/config"
 	"shh/agent/internal/health"
+	"shh/agent/internal/keyexchange"
 	"shh/agent/internal/metrics"
+	"shh/agent/internal/policy"
 	"shh/agent/internal/process"
 	"shh/agent/internal/protocol"
 	"shh/agent/internal/websocket"
@@ -32,6 +37,7 @@ type Agent struct {
 	stopOnce sync.Once
 	done     chan struct{}
 	plugins  []plugins.Plugin
+	keys     *keyexchange.Exchanger
 }
 
 type Config struct {
@@ -39,6 +45,10 @@ type Config struct {
 	AgentID   string
 	Version   string
 	Labels    map[string]string
+
+	MaxOutputSize int                // Bytes of stdout and of stderr kept per command
+	Policy        *policy.Engine     // Commands the server may run; nil allows everything
+	Proxy         config.ProxyConfig // Also used by the SSH key exchange
 }
 
 func New(config *Config, logger *zap.Logger) (*Agent, error) {
@@ -71,7 +81,14 @@ func New(config *Config, logger *zap.Logger) (*Agent, error) {
 	healthChecker := health.NewChecker(logger)
 	metricsCollector := metrics.NewCollector(logger)
 	wsClient := websocket.NewClient(config.ServerURL, agentInfo, logger)
-	processManager := process.NewManager(logger)
+	keys, err := keyexchange.NewExchanger(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	processManager := process.NewManager(logger,
+		process.WithOutputLimit(config.MaxOutputSize),
+		process.WithAuthorizer(config.Policy))
 
 	// Register performance metrics with Prometheus
 	yourMetrics := prometheus.NewCounterVec(
@@ -92,6 +109,7 @@ func New(config *Config, logger *zap.Logger) (*Agent, error) {
 		process:  processManager,
 		done:     make(chan struct{}),
 		plugins:  make([]plugins.Plugin, 0),
+		keys:     keys,
 	}
 
 	a.InitPlugins()
@@ -113,6 +131,8 @@ func (a *Agent) InitPlugins() {
 		HostURL: sshConfig["host_url"].(string),
 		AgentID: a.config.AgentID,
 		Agents:  []string{}, // Will be populated dynamically
+
+		Exchanger: a.keys,
 	}
 
 	a.plugins = append(a.plugins, sshKeyPlugin)
@@ -136,7 +156,7 @@ func (a *Agent) InitPlugins() {
 
 func (a *Agent) Start(ctx context.Context) error {
 	// Register health checks
-	a.health.AddCheck("websocket", wrapHealthCheck(a.ws.HealthCheck))
+	a.health.AddCheck("websocket", a.ws.HealthCheck)
 	a.health.AddCheck("process", wrapHealthCheck(a.process.HealthCheck))
 	a.health.AddCheck("metrics", wrapHealthCheck(a.metrics.HealthCheck))
 	a.health.AddCheck("database", wrapHealthCheck(a.checkDatabase))
@@ -163,7 +183,7 @@ func (a *Agent) Start(ctx context.Context) error {
 	}
 
 	// Register command handler
-	a.ws.RegisterHandler(protocol.TypeCommand, a.handleCommand)
+	a.ws.RegisterCommandHandler(protocol.Handle(a.handleCommand))
 
 	// Start dynamic config reload
 	go a.DynamicConfigReload(ctx, "path/to/config/file")
@@ -210,22 +230,32 @@ func (a *Agent) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-func (a *Agent) handleCommand(ctx context.Context, msg protocol.Message) error {
-	var cmd protocol.AgentCommand
-	if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
-		return fmt.Errorf("invalid command payload: %w", err)
+func (a *Agent) handleCommand(ctx context.Context, msg protocol.Message, cmd protocol.AgentCommand) error {
+	if cmd.Stream {
+		return a.streamCommand(ctx, msg.ID, cmd)
 	}
 
-	result, err := a.process.Execute(ctx, cmd.Command, cmd.Args)
-	if err != nil {
+	// A non-zero exit is a result like any other; only failures to run the
+	// command at all are reported as errors
+	result, err := a.process.Execute(ctx, cmd.Command, cmd.Args, execOptions(cmd)...)
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
 		return fmt.Errorf("failed to execute command %s: %w", cmd.Command, err)
 	}
 
 	response := protocol.ResultPayload{
-		CommandID: msg.ID,
-		ExitCode:  result.ExitCode,
-		Stdout:    result.Stdout,
-		Stderr:    result.Stderr,
+		CommandID:       msg.ID,
+		ExitCode:        result.ExitCode,
+		Signal:          result.Signal,
+		Stdout:          result.Stdout,
+		Stderr:          result.Stderr,
+		StdoutTruncated: result.StdoutTruncated,
+		StderrTruncated: result.StderrTruncated,
+		WallTime:        result.WallTime,
+	}
+	if result.Usage != nil {
+		usage := protocol.ResourceUsage(*result.Usage)
+		response.Usage = &usage
 	}
 
 	responseBytes, err := json.Marshal(response)
@@ -244,6 +274,60 @@ func (a *Agent) handleCommand(ctx context.Context, msg protocol.Message) error {
 	})
 }
 
+// streamCommand runs a command and sends its output to the server as it is produced
+func (a *Agent) streamCommand(ctx context.Context, commandID string, cmd protocol.AgentCommand) error {
+	opts := execOptions(cmd)
+
+	// Refuse before the stream is opened, so the server gets a rejection
+	// rather than an empty stream
+	if err := a.process.Authorize(cmd.Command, cmd.Args, opts...); err != nil {
+		return err
+	}
+
+	stream := a.ws.NewResultStream(ctx, commandID)
+
+	result, execErr := a.process.ExecuteStream(ctx, cmd.Command, cmd.Args, stream.Write, opts...)
+	var exitErr *exec.ExitError
+	if errors.As(execErr, &exitErr) {
+		execErr = nil // Reported through the exit code
+	}
+	if err := stream.CloseResult(result, execErr); err != nil {
+		return fmt.Errorf("failed to close result stream for command %s: %w", cmd.Command, err)
+	}
+
+	return execErr
+}
+
+// execOptions translates the execution settings of cmd
+func execOptions(cmd protocol.AgentCommand) []process.ExecOption {
+	var opts []process.ExecOption
+	if cmd.Cwd != "" {
+		opts = append(opts, process.WithWorkingDir(cmd.Cwd))
+	}
+	if len(cmd.Env) > 0 {
+		opts = append(opts, process.WithEnv(cmd.Env))
+	}
+	if cmd.Stdin != "" {
+		opts = append(opts, process.WithStdin(cmd.Stdin))
+	}
+	if timeout := cmd.TimeoutDuration(); timeout > 0 {
+		opts = append(opts, process.WithTimeout(timeout))
+	}
+	if cmd.Shell {
+		opts = append(opts, process.WithShell())
+	}
+	if cmd.User != "" || cmd.Group != "" {
+		opts = append(opts, process.WithUser(cmd.User, cmd.Group))
+	}
+	if cmd.Limits != nil {
+		opts = append(opts, process.WithLimits(process.Limits(*cmd.Limits)))
+	}
+	if cmd.Priority != nil {
+		opts = append(opts, process.WithPriority(process.Priority(*cmd.Priority)))
+	}
+	return opts
+}
+
 func (a *Agent) checkDatabase(ctx context.Context) error {
 	// Add database connectivity check
 	// Replace with actual database connection logic
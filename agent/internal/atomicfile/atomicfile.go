@@ -0,0 +1,43 @@
+// Package atomicfile replaces files so that readers, and the agent after a
+// crash, see either the old contents or the new ones and never a partial write
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+)
+
+// Write writes data to a temporary file next to path, syncs it and renames it
+// over path. The temporary file is path with a ".tmp" suffix.
+func Write(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to sync %s: %w", tmp, err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close %s: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to commit %s: %w", path, err)
+	}
+
+	return nil
+}
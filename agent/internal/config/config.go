@@ -16,22 +16,76 @@ type Config struct {
 	Metrics   MetricsConfig   `mapstructure:"metrics"`
 	Logging   LoggingConfig   `mapstructure:"logging"`
 	Security  SecurityConfig  `mapstructure:"security"`
+	Recorder  RecorderConfig  `mapstructure:"recorder"`
 }
 
 type AgentConfig struct {
-	ID           string            `mapstructure:"id"`
-	Name         string            `mapstructure:"name"`
-	Version      string            `mapstructure:"version"`
-	Labels       map[string]string `mapstructure:"labels"`
-	DataDir      string            `mapstructure:"data_dir"`
-	MaxJobs      int               `mapstructure:"max_jobs"`
-	ShutdownWait time.Duration     `mapstructure:"shutdown_wait"`
+	ID            string            `mapstructure:"id"`
+	Name          string            `mapstructure:"name"`
+	Version       string            `mapstructure:"version"`
+	Labels        map[string]string `mapstructure:"labels"`
+	DataDir       string            `mapstructure:"data_dir"`
+	MaxJobs       int               `mapstructure:"max_jobs"`
+	MaxOutputSize int               `mapstructure:"max_output_size"` // Bytes of stdout and of stderr kept per command
+	ShutdownWait  time.Duration     `mapstructure:"shutdown_wait"`
+	Dispatch      DispatchConfig    `mapstructure:"dispatch"`
+	Cgroup        CgroupConfig      `mapstructure:"cgroup"`
+	Sessions      SessionConfig     `mapstructure:"sessions"`
+
+	// BootstrapToken is the one-time token used to enroll with the server.
+	// Once enrolled, the issued identity in DataDir is used instead.
+	BootstrapToken string `mapstructure:"bootstrap_token"`
+}
+
+// DispatchConfig bounds how many server messages are handled concurrently
+type DispatchConfig struct {
+	Workers   int            `mapstructure:"workers"`
+	QueueSize int            `mapstructure:"queue_size"`
+	Limits    map[string]int `mapstructure:"limits"` // Per message type
+}
+
+// CgroupConfig puts each command, job and session in its own cgroup v2
+// below Path, with limits that apply to each. Zero limits are unlimited.
+type CgroupConfig struct {
+	Enabled   bool    `mapstructure:"enabled"`
+	Path      string  `mapstructure:"path"`       // Created if missing; the agent needs write access
+	MemoryMax int64   `mapstructure:"memory_max"` // Bytes
+	CPUMax    float64 `mapstructure:"cpu_max"`    // CPUs
+	PidsMax   int64   `mapstructure:"pids_max"`
+}
+
+// SessionConfig bounds the interactive terminal sessions the server may open
+type SessionConfig struct {
+	MaxSessions int           `mapstructure:"max_sessions"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"` // Zero disables the timeout
+	Shell       string        `mapstructure:"shell"`        // Login shell; $SHELL when empty
+	Record      bool          `mapstructure:"record"`       // Record session output for audit
+	RecordDir   string        `mapstructure:"record_dir"`   // Defaults to DataDir/sessions
 }
 
 type ServerConfig struct {
-	URL            string        `mapstructure:"url"`
-	ReconnectDelay time.Duration `mapstructure:"reconnect_delay"`
-	Timeout        time.Duration `mapstructure:"timeout"`
+	URL               string        `mapstructure:"url"`
+	URLs              []string      `mapstructure:"urls"`              // Servers in order of preference; overrides URL
+	FailbackInterval  time.Duration `mapstructure:"failback_interval"` // How often to probe the primary while on a fallback
+	ReconnectDelay    time.Duration `mapstructure:"reconnect_delay"`
+	MaxReconnectDelay time.Duration `mapstructure:"max_reconnect_delay"`
+	Timeout           time.Duration `mapstructure:"timeout"`
+	SpoolLimit        int           `mapstructure:"spool_limit"`
+	PingInterval      time.Duration `mapstructure:"ping_interval"`
+	PongTimeout       time.Duration `mapstructure:"pong_timeout"`
+	Proxy             ProxyConfig   `mapstructure:"proxy"`
+	Codecs            []string      `mapstructure:"codecs"`             // Offered to the server, most preferred first
+	CompressionLevel  int           `mapstructure:"compression_level"`  // permessage-deflate level 1-9; 0 disables
+	LongPollFallback  bool          `mapstructure:"long_poll_fallback"` // Fall back to HTTP long-polling if the websocket upgrade is refused
+}
+
+// ProxyConfig configures the HTTP proxy used to reach the server. Unset
+// fields fall back to HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+type ProxyConfig struct {
+	URL      string `mapstructure:"url"` // http:// only
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	NoProxy  string `mapstructure:"no_proxy"` // Comma-separated hosts, domains and CIDRs to reach directly
 }
 
 type MetricsConfig struct {
@@ -49,12 +103,43 @@ type LoggingConfig struct {
 	Compress   bool   `mapstructure:"compress"`
 }
 
+// RecorderConfig enables recording every message exchanged with the server,
+// for replaying with cmd/replay. Recordings contain command payloads and
+// credentials, so only enable this while debugging.
+type RecorderConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	File       string `mapstructure:"file"`     // Defaults to recordings/session.jsonl in the data directory
+	MaxSize    int    `mapstructure:"max_size"` // MB before the file is rotated
+	MaxBackups int    `mapstructure:"max_backups"`
+	Compress   bool   `mapstructure:"compress"`
+}
+
+// Endpoints returns the server URLs in order of preference
+func (s ServerConfig) Endpoints() []string {
+	if len(s.URLs) > 0 {
+		return s.URLs
+	}
+	return []string{s.URL}
+}
+
 type SecurityConfig struct {
-	TLSEnabled  bool   `mapstructure:"tls_enabled"`
-	CertFile    string `mapstructure:"cert_file"`
-	KeyFile     string `mapstructure:"key_file"`
-	CAFile      string `mapstructure:"ca_file"`
-	SkipVerify  bool   `mapstructure:"skip_verify"`
+	TLSEnabled    bool   `mapstructure:"tls_enabled"`
+	CertFile      string `mapstructure:"cert_file"`
+	KeyFile       string `mapstructure:"key_file"`
+	CAFile        string `mapstructure:"ca_file"`
+	SkipVerify    bool   `mapstructure:"skip_verify"`
+	MinTLSVersion string `mapstructure:"min_tls_version"`
+
+	// Server messages must be signed with one of these keys when
+	// RequireSignedCommands is set
+	RequireSignedCommands bool          `mapstructure:"require_signed_commands"`
+	SigningKeyFile        string        `mapstructure:"signing_key_file"`        // HMAC-SHA256 shared secret
+	SigningPublicKeyFile  string        `mapstructure:"signing_public_key_file"` // ed25519 public key
+	MaxClockSkew          time.Duration `mapstructure:"max_clock_skew"`
+
+	// PolicyFile is a JSON policy of the commands the server may run. Without
+	// one the agent runs anything it is sent.
+	PolicyFile string `mapstructure:"policy_file"`
 }
 
 // Load reads configuration from file and environment variables
@@ -101,6 +186,13 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	if config.Recorder.File == "" {
+		config.Recorder.File = filepath.Join(config.Agent.DataDir, "recordings", "session.jsonl")
+	}
+	if config.Agent.Sessions.RecordDir == "" {
+		config.Agent.Sessions.RecordDir = filepath.Join(config.Agent.DataDir, "sessions")
+	}
+
 	return &config, nil
 }
 
@@ -109,12 +201,28 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("agent.version", "1.0.0")
 	v.SetDefault("agent.data_dir", filepath.Join(os.TempDir(), "shh-agent"))
 	v.SetDefault("agent.max_jobs", runtime.NumCPU()*2)
+	v.SetDefault("agent.max_output_size", 1024*1024) // 1MB
 	v.SetDefault("agent.shutdown_wait", 30*time.Second)
+	v.SetDefault("agent.dispatch.workers", runtime.NumCPU()*2)
+	v.SetDefault("agent.dispatch.queue_size", 64)
+	v.SetDefault("agent.cgroup.enabled", false)
+	v.SetDefault("agent.cgroup.path", "/sys/fs/cgroup/shh-agent.slice")
+	v.SetDefault("agent.sessions.max_sessions", 4)
+	v.SetDefault("agent.sessions.idle_timeout", 30*time.Minute)
+	v.SetDefault("agent.sessions.record", false)
 
 	// Server defaults
 	v.SetDefault("server.url", "ws://localhost:4000/ws/agent")
+	v.SetDefault("server.failback_interval", "1m")
+	v.SetDefault("server.codecs", []string{"cbor", "json"})
+	v.SetDefault("server.compression_level", 1)
+	v.SetDefault("server.long_poll_fallback", true)
 	v.SetDefault("server.reconnect_delay", 5*time.Second)
+	v.SetDefault("server.max_reconnect_delay", 2*time.Minute)
 	v.SetDefault("server.timeout", 30*time.Second)
+	v.SetDefault("server.spool_limit", 1000)
+	v.SetDefault("server.ping_interval", 30*time.Second)
+	v.SetDefault("server.pong_timeout", 10*time.Second)
 
 	// Metrics defaults
 	v.SetDefault("metrics.enabled", true)
@@ -129,7 +237,16 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("logging.max_age", 28)      // 28 days
 	v.SetDefault("logging.compress", true)
 
+	// Recorder defaults
+	v.SetDefault("recorder.enabled", false)
+	v.SetDefault("recorder.max_size", 50) // 50MB
+	v.SetDefault("recorder.max_backups", 5)
+	v.SetDefault("recorder.compress", true)
+
 	// Security defaults
 	v.SetDefault("security.tls_enabled", false)
 	v.SetDefault("security.skip_verify", false)
+	v.SetDefault("security.min_tls_version", "1.2")
+	v.SetDefault("security.require_signed_commands", false)
+	v.SetDefault("security.max_clock_skew", "5m")
 }
@@ -0,0 +1,20 @@
+package docker
+
+import (
+	"errors"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// Plugin errors carry errdefs classes, like the errors of the Docker client,
+// so callers can classify both the same way
+var (
+	// ErrContainerIDRequired indicates a container command sent without a container ID
+	ErrContainerIDRequired = errdefs.InvalidParameter(errors.New("container ID required"))
+
+	// ErrUnknownCommand indicates a command the plugin does not handle
+	ErrUnknownCommand = errdefs.NotImplemented(errors.New("unknown Docker command"))
+
+	// ErrStreamingUnsupported indicates a command whose output cannot be streamed
+	ErrStreamingUnsupported = errdefs.NotImplemented(errors.New("streaming not supported"))
+)
@@ -12,7 +12,10 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"go.uber.org/zap"
+
+	"shh/agent/internal/process"
 )
 
 // ContainerEvent represents a Docker container event
@@ -145,6 +148,36 @@ func (m *Manager) GetContainerLogs(ctx context.Context, id string, tail int) (st
 	return logs.String(), nil
 }
 
+// StreamContainerLogs passes each log line of a container to emit, following
+// new output until ctx is done when follow is set
+func (m *Manager) StreamContainerLogs(ctx context.Context, id string, tail int, follow bool, emit func(process.CommandOutput) error) error {
+	options := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       fmt.Sprintf("%d", tail),
+		Follow:     follow,
+	}
+
+	reader, err := m.client.ContainerLogs(ctx, id, options)
+	if err != nil {
+		return fmt.Errorf("failed to get container logs: %w", err)
+	}
+	defer reader.Close()
+
+	stdout := process.NewLineWriter("stdout", emit)
+	stderr := process.NewLineWriter("stderr", emit)
+
+	// Containers without a TTY multiplex stdout and stderr on one stream
+	if _, err := stdcopy.StdCopy(stdout, stderr, reader); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("error reading container logs: %w", err)
+	}
+
+	if err := stdout.Flush(); err != nil {
+		return err
+	}
+	return stderr.Flush()
+}
+
 func (m *Manager) PullImage(ctx context.Context, image string) error {
 	reader, err := m.client.ImagePull(ctx, image, types.ImagePullOptions{})
 	if err != nil {
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+
+	"shh/agent/internal/process"
 )
 
 // Plugin implements the agent.Plugin interface for Docker operations
@@ -55,22 +57,22 @@ func (p *Plugin) HandleCommand(ctx context.Context, cmd string, args []string) (
 		return p.handleListContainers(ctx)
 	case "docker:container:start":
 		if len(args) < 1 {
-			return nil, fmt.Errorf("container ID required")
+			return nil, ErrContainerIDRequired
 		}
 		return nil, p.manager.StartContainer(ctx, args[0])
 	case "docker:container:stop":
 		if len(args) < 1 {
-			return nil, fmt.Errorf("container ID required")
+			return nil, ErrContainerIDRequired
 		}
 		return nil, p.manager.StopContainer(ctx, args[0], nil)
 	case "docker:container:restart":
 		if len(args) < 1 {
-			return nil, fmt.Errorf("container ID required")
+			return nil, ErrContainerIDRequired
 		}
 		return nil, p.manager.RestartContainer(ctx, args[0], nil)
 	case "docker:container:logs":
 		if len(args) < 1 {
-			return nil, fmt.Errorf("container ID required")
+			return nil, ErrContainerIDRequired
 		}
 		tail := 100 // Default to last 100 lines
 		if len(args) > 1 {
@@ -78,7 +80,25 @@ func (p *Plugin) HandleCommand(ctx context.Context, cmd string, args []string) (
 		}
 		return p.manager.GetContainerLogs(ctx, args[0], tail)
 	default:
-		return nil, fmt.Errorf("unknown Docker command: %s", cmd)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, cmd)
+	}
+}
+
+// HandleStream processes Docker commands whose output is streamed line by line
+func (p *Plugin) HandleStream(ctx context.Context, cmd string, args []string, emit func(process.CommandOutput) error) error {
+	switch cmd {
+	case "docker:container:logs":
+		if len(args) < 1 {
+			return ErrContainerIDRequired
+		}
+		tail := 100 // Default to last 100 lines
+		if len(args) > 1 {
+			fmt.Sscanf(args[1], "%d", &tail)
+		}
+		follow := len(args) > 2 && args[2] == "follow"
+		return p.manager.StreamContainerLogs(ctx, args[0], tail, follow, emit)
+	default:
+		return fmt.Errorf("%w: %s", ErrStreamingUnsupported, cmd)
 	}
 }
 
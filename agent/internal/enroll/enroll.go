@@ -0,0 +1,138 @@
+// Package enroll keeps the identity an agent is issued when it enrolls with
+// the server. A new agent presents the one-time bootstrap token from its
+// configuration; the server answers with a stable agent ID and a credential,
+// which are persisted and presented on every later registration in place of
+// the token. The server may rotate the credential at any time.
+package enroll
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/atomicfile"
+	"shh/agent/internal/protocol"
+)
+
+// identityFile is the name of the identity file inside the data directory
+const identityFile = "identity.json"
+
+// ErrNotEnrolled indicates the agent has neither an identity nor a bootstrap token
+var ErrNotEnrolled = errors.New("agent is not enrolled and no bootstrap token is configured")
+
+// Identity is the persisted result of enrollment
+type Identity struct {
+	AgentID    string     `json:"agent_id"`
+	Credential string     `json:"credential"`
+	IssuedAt   time.Time  `json:"issued_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// Store holds the agent identity and the bootstrap token used to obtain it
+type Store struct {
+	path           string
+	bootstrapToken string
+	logger         *zap.Logger
+
+	mu       sync.RWMutex
+	identity *Identity
+}
+
+// NewStore loads the identity kept in dataDir, if the agent has enrolled before
+func NewStore(dataDir, bootstrapToken string, logger *zap.Logger) (*Store, error) {
+	s := &Store{
+		path:           filepath.Join(dataDir, identityFile),
+		bootstrapToken: bootstrapToken,
+		logger:         logger,
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent identity: %w", err)
+	}
+
+	var identity Identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("failed to parse agent identity %s: %w", s.path, err)
+	}
+	if identity.AgentID == "" || identity.Credential == "" {
+		return nil, fmt.Errorf("agent identity %s is incomplete", s.path)
+	}
+	s.identity = &identity
+
+	return s, nil
+}
+
+// Identity returns the enrolled identity, if any
+func (s *Store) Identity() (Identity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.identity == nil {
+		return Identity{}, false
+	}
+	return *s.identity, true
+}
+
+// Apply fills in the identity fields of a registration: the enrolled agent ID
+// and credential, or the bootstrap token when the agent has not enrolled yet
+func (s *Store) Apply(reg *protocol.RegisterPayload) error {
+	if identity, ok := s.Identity(); ok {
+		reg.ID = identity.AgentID
+		reg.Credential = identity.Credential
+		return nil
+	}
+
+	if s.bootstrapToken == "" {
+		return ErrNotEnrolled
+	}
+	reg.BootstrapToken = s.bootstrapToken
+	return nil
+}
+
+// Update persists credentials issued by the server, either at enrollment or
+// when rotating. The file is replaced atomically so a crash never leaves the
+// agent without a usable identity.
+func (s *Store) Update(creds protocol.AgentCredentials) error {
+	if creds.AgentID == "" || creds.Credential == "" {
+		return fmt.Errorf("server issued incomplete credentials")
+	}
+
+	identity := Identity{
+		AgentID:    creds.AgentID,
+		Credential: creds.Credential,
+		IssuedAt:   time.Now(),
+		ExpiresAt:  creds.ExpiresAt,
+	}
+
+	data, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal agent identity: %w", err)
+	}
+
+	if err := atomicfile.Write(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+
+	s.mu.Lock()
+	previous := s.identity
+	s.identity = &identity
+	s.mu.Unlock()
+
+	if previous == nil {
+		s.logger.Info("Enrolled with server", zap.String("agent_id", identity.AgentID))
+	} else {
+		s.logger.Info("Rotated agent credential", zap.String("agent_id", identity.AgentID))
+	}
+
+	return nil
+}
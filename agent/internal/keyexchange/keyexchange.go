@@ -2,20 +2,58 @@ package keyexchange
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
+
+	"shh/agent/internal/config"
+	"shh/agent/internal/proxy"
 )
 
+// Exchanger sends SSH keys over HTTP through the configured proxy
+type Exchanger struct {
+	client *http.Client
+}
+
+// NewExchanger creates an exchanger whose requests use the proxy settings in cfg
+func NewExchanger(cfg config.ProxyConfig) (*Exchanger, error) {
+	transport, err := proxy.Transport(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure proxy: %w", err)
+	}
+
+	return &Exchanger{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// defaultExchanger is used by the package-level functions and takes its
+// proxy settings from the environment
+var defaultExchanger = &Exchanger{client: &http.Client{Timeout: 30 * time.Second}}
+
 // ExchangeKeys sends the SSH keys to the host.
 func ExchangeKeys(keys []string, hostURL string) error {
+	return defaultExchanger.ExchangeKeys(keys, hostURL)
+}
+
+// DistributeKeys sends the keys to all agents.
+func DistributeKeys(keys []string, agents []string) error {
+	return defaultExchanger.DistributeKeys(keys, agents)
+}
+
+// ExchangeKeys sends the SSH keys to the host.
+func (e *Exchanger) ExchangeKeys(keys []string, hostURL string) error {
 	for _, key := range keys {
 		keyData, err := ioutil.ReadFile(key)
 		if err != nil {
 			return err
 		}
 
-		_, err = http.Post(hostURL+"/api/keys", "text/plain", bytes.NewBuffer(keyData))
-		if err != nil {
+		if err := e.post(hostURL+"/api/keys", keyData); err != nil {
 			return err
 		}
 	}
@@ -23,15 +61,23 @@ func ExchangeKeys(keys []string, hostURL string) error {
 }
 
 // DistributeKeys sends the keys to all agents.
-func DistributeKeys(keys []string, agents []string) error {
+func (e *Exchanger) DistributeKeys(keys []string, agents []string) error {
 	for _, agent := range agents {
 		for _, key := range keys {
 			// Send the key to the agent's endpoint
-			_, err := http.Post(agent+"/api/keys", "text/plain", bytes.NewBuffer([]byte(key)))
-			if err != nil {
+			if err := e.post(agent+"/api/keys", []byte(key)); err != nil {
 				return err
 			}
 		}
 	}
 	return nil
 }
+
+func (e *Exchanger) post(url string, body []byte) error {
+	resp, err := e.client.Post(url, "text/plain", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -53,6 +53,8 @@ type ProcessMetrics struct {
 	Nice         int32   `json:"nice"`
 	IONiceness   int32   `json:"io_niceness"`
 	CtxSwitches  *process.NumCtxSwitchesStat `json:"ctx_switches"`
+	CPUTime      time.Duration `json:"cpu_time,omitempty"`  // Of a finished command, counting what it started
+	OOMKills     int           `json:"oom_kills,omitempty"` // Processes of a command killed by its memory limit
 }
 
 // AdvancedMetrics contains detailed system metrics
@@ -0,0 +1,305 @@
+package mockserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+// registerTimeout bounds how long a new connection may take to register
+const registerTimeout = 10 * time.Second
+
+// serveAgent runs one agent connection until it closes
+func (s *Server) serveAgent(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error("Failed to upgrade agent connection", zap.Error(err))
+		return
+	}
+	defer ws.Close()
+
+	conn := &agentConn{ws: ws, codec: protocol.JSON}
+
+	ws.SetReadDeadline(time.Now().Add(registerTimeout))
+	msg, err := readMessage(ws)
+	if err != nil {
+		s.logger.Warn("Agent disconnected before registering", zap.Error(err))
+		return
+	}
+	if msg.Type != protocol.TypeRegister {
+		s.logger.Warn("Agent did not register first", zap.String("type", string(msg.Type)))
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	agentID, err := s.register(conn, msg)
+	if err != nil {
+		s.logger.Error("Registration failed", zap.Error(err))
+		return
+	}
+	defer s.disconnected(agentID, conn)
+
+	for {
+		msg, err := readMessage(ws)
+		if err != nil {
+			s.logger.Info("Agent disconnected",
+				zap.String("agent_id", agentID),
+				zap.Error(err))
+			return
+		}
+		s.handle(agentID, conn, msg)
+	}
+}
+
+// readMessage reads one message, decoding it according to the frame type
+func readMessage(ws *websocket.Conn) (protocol.Message, error) {
+	frameType, data, err := ws.ReadMessage()
+	if err != nil {
+		return protocol.Message{}, err
+	}
+
+	codec := protocol.JSON
+	if frameType == websocket.BinaryMessage {
+		codec = protocol.CBOR
+	}
+
+	var msg protocol.Message
+	if err := codec.Unmarshal(data, &msg); err != nil {
+		return protocol.Message{}, fmt.Errorf("failed to decode message: %w", err)
+	}
+	return msg, nil
+}
+
+// register records the agent and answers its registration. The ack is sent
+// as JSON; everything after it uses the negotiated codec.
+func (s *Server) register(conn *agentConn, msg protocol.Message) (string, error) {
+	var reg protocol.RegisterPayload
+	if err := json.Unmarshal(msg.Payload, &reg); err != nil {
+		return "", fmt.Errorf("invalid registration: %w", err)
+	}
+
+	ack := protocol.RegisterAck{
+		ProtocolVersion: protocol.ProtocolVersion,
+		SessionID:       newID(),
+		Codec:           s.selectCodec(reg.Codecs),
+		Settings:        s.settings,
+	}
+
+	agentID := reg.ID
+	if reg.BootstrapToken != "" {
+		if agentID == "" {
+			agentID = "agent-" + newID()
+		}
+		ack.Credentials = &protocol.AgentCredentials{
+			AgentID:    agentID,
+			Credential: newID(),
+		}
+	}
+	if agentID == "" {
+		return "", fmt.Errorf("registration has no agent ID")
+	}
+
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal registration ack: %w", err)
+	}
+
+	if err := conn.write(protocol.Message{
+		Type:          protocol.TypeRegistered,
+		ID:            "registered-" + ack.SessionID,
+		CorrelationID: msg.ID,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+	}); err != nil {
+		return "", err
+	}
+
+	codec, err := protocol.LookupCodec(ack.Codec)
+	if err != nil {
+		return "", err
+	}
+	conn.writeMu.Lock()
+	conn.codec = codec
+	conn.writeMu.Unlock()
+
+	s.mu.Lock()
+	a, ok := s.agents[agentID]
+	if !ok {
+		a = &agentState{}
+		s.agents[agentID] = a
+	}
+	a.conn = conn
+	a.status.Registration = reg
+	a.status.SessionID = ack.SessionID
+	a.status.Codec = ack.Codec
+	a.status.Connected = true
+	a.status.ConnectedAt = time.Now()
+	a.status.Connections++
+	s.mu.Unlock()
+
+	s.logger.Info("Agent registered",
+		zap.String("agent_id", agentID),
+		zap.String("hostname", reg.Hostname),
+		zap.String("version", reg.Version),
+		zap.Int("protocol_version", reg.ProtocolVersion),
+		zap.String("codec", ack.Codec))
+
+	return agentID, nil
+}
+
+// selectCodec picks the first server codec the agent offered
+func (s *Server) selectCodec(offered []string) string {
+	for _, name := range s.codecs {
+		for _, o := range offered {
+			if o == name {
+				return name
+			}
+		}
+	}
+	return protocol.CodecJSON
+}
+
+// disconnected marks the agent offline unless it has already reconnected
+func (s *Server) disconnected(agentID string, conn *agentConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.agents[agentID]; ok && a.conn == conn {
+		a.conn = nil
+		a.status.Connected = false
+	}
+}
+
+// handle processes one message from an agent
+func (s *Server) handle(agentID string, conn *agentConn, msg protocol.Message) {
+	switch msg.Type {
+	case protocol.TypeHeartbeat:
+		var hb protocol.AgentHeartbeat
+		if err := json.Unmarshal(msg.Payload, &hb); err != nil {
+			s.logger.Warn("Invalid heartbeat", zap.Error(err))
+			return
+		}
+		s.mu.Lock()
+		if a, ok := s.agents[agentID]; ok {
+			a.status.Heartbeats++
+			a.status.LastHeartbeat = &hb
+		}
+		s.mu.Unlock()
+		s.logger.Debug("Heartbeat",
+			zap.String("agent_id", agentID),
+			zap.String("status", hb.Status))
+
+	case protocol.TypeResult:
+		s.finish(msg.ID, func(r *Result) {
+			r.Payload = msg.Payload
+			var payload protocol.ResultPayload
+			if json.Unmarshal(msg.Payload, &payload) == nil {
+				r.ExitCode = payload.ExitCode
+				r.Error = payload.Error
+				r.Failure = payload.Failure
+			}
+		})
+
+	case protocol.TypeResultChunk:
+		var chunk protocol.ResultChunk
+		if err := json.Unmarshal(msg.Payload, &chunk); err != nil {
+			s.logger.Warn("Invalid result chunk", zap.Error(err))
+			return
+		}
+		s.ackChunk(conn, chunk)
+
+		if !chunk.Final {
+			s.update(chunk.CommandID, func(r *Result) {
+				r.Output = append(r.Output, chunk.Lines...)
+			})
+			return
+		}
+		s.finish(chunk.CommandID, func(r *Result) {
+			r.Output = append(r.Output, chunk.Lines...)
+			r.ExitCode = chunk.ExitCode
+			r.Error = chunk.Error
+			r.Failure = chunk.Failure
+		})
+
+	case protocol.TypeRejected:
+		var rejection protocol.Rejection
+		if err := json.Unmarshal(msg.Payload, &rejection); err != nil {
+			s.logger.Warn("Invalid rejection", zap.Error(err))
+			return
+		}
+		s.logger.Warn("Agent rejected message",
+			zap.String("agent_id", agentID),
+			zap.String("id", rejection.ID),
+			zap.String("reason", rejection.Reason))
+		s.finish(rejection.ID, func(r *Result) {
+			r.Rejection = &rejection
+		})
+
+	default:
+		s.logger.Info("Agent sent message",
+			zap.String("agent_id", agentID),
+			zap.String("type", string(msg.Type)),
+			zap.String("id", msg.ID))
+	}
+}
+
+// ackChunk acknowledges a streamed frame so the agent keeps sending
+func (s *Server) ackChunk(conn *agentConn, chunk protocol.ResultChunk) {
+	if chunk.Final {
+		return
+	}
+
+	payload, err := json.Marshal(protocol.ResultAck{CommandID: chunk.CommandID, Seq: chunk.Seq})
+	if err != nil {
+		return
+	}
+
+	if err := conn.write(protocol.Message{
+		Type:      protocol.TypeResultAck,
+		ID:        fmt.Sprintf("ack-%s-%d", chunk.CommandID, chunk.Seq),
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}); err != nil {
+		s.logger.Warn("Failed to acknowledge result chunk", zap.Error(err))
+	}
+}
+
+// update applies fn to a command's result while it is still running
+func (s *Server) update(commandID string, fn func(*Result)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.results[commandID]; ok && !r.Done {
+		fn(r)
+	}
+}
+
+// finish applies fn to a command's result and marks it done
+func (s *Server) finish(commandID string, fn func(*Result)) {
+	s.mu.Lock()
+	r, ok := s.results[commandID]
+	if !ok || r.Done {
+		s.mu.Unlock()
+		s.logger.Warn("Result for unknown or finished command", zap.String("command_id", commandID))
+		return
+	}
+	fn(r)
+	r.Done = true
+	close(r.done)
+	result := *r
+	s.mu.Unlock()
+
+	s.logger.Info("Command finished",
+		zap.String("command_id", commandID),
+		zap.String("agent_id", result.AgentID),
+		zap.String("command", result.Command.Command),
+		zap.Int("exit_code", result.ExitCode),
+		zap.Int("lines", len(result.Output)),
+		zap.Duration("duration", time.Since(result.SentAt)))
+}
@@ -0,0 +1,121 @@
+package mockserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"shh/agent/internal/protocol"
+)
+
+// serveAPI handles the JSON API:
+//
+//	GET  /api/agents                    list agents
+//	GET  /api/agents/{id}               show an agent
+//	POST /api/agents/{id}/commands      send a protocol.AgentCommand; with
+//	                                    ?wait=30s, wait for and return the result
+//	GET  /api/commands/{id}             show a command's result so far
+//	POST /api/commands/{id}/cancel      cancel a running command
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "agents" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Agents())
+
+	case len(parts) == 2 && parts[0] == "agents" && r.Method == http.MethodGet:
+		status, ok := s.Agent(parts[1])
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrAgentNotConnected)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case len(parts) == 3 && parts[0] == "agents" && parts[2] == "commands" && r.Method == http.MethodPost:
+		s.apiSend(w, r, parts[1])
+
+	case len(parts) == 2 && parts[0] == "commands" && r.Method == http.MethodGet:
+		result, err := s.Result(parts[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 3 && parts[0] == "commands" && parts[2] == "cancel" && r.Method == http.MethodPost:
+		if err := s.Cancel(parts[1], r.URL.Query().Get("reason")); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// apiSend sends the command in the request body to an agent
+func (s *Server) apiSend(w http.ResponseWriter, r *http.Request, agentID string) {
+	var cmd protocol.AgentCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	id, err := s.Send(agentID, cmd)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	if wait <= 0 {
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": id})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	result, err := s.Wait(ctx, id)
+	if err != nil {
+		// Still running; return what has arrived so far
+		result, _ = s.Result(id)
+		writeJSON(w, http.StatusAccepted, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// statusFor maps server errors to HTTP status codes
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrAgentNotConnected), errors.Is(err, ErrUnknownCommand):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,343 @@
+// Package mockserver is a small stand-in for the dashboard server. It accepts
+// agent connections, answers the registration handshake, records heartbeats
+// and collects command results, so the agent can be exercised in development
+// and in tests without the full dashboard.
+package mockserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+var (
+	// ErrAgentNotConnected indicates no agent with the given ID is connected
+	ErrAgentNotConnected = errors.New("agent not connected")
+
+	// ErrUnknownCommand indicates no command with the given ID was sent
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+// AgentStatus is what the server knows about an agent
+type AgentStatus struct {
+	Registration  protocol.RegisterPayload `json:"registration"`
+	SessionID     string                   `json:"session_id"`
+	Codec         string                   `json:"codec"`
+	Connected     bool                     `json:"connected"`
+	ConnectedAt   time.Time                `json:"connected_at"`
+	Connections   int                      `json:"connections"`
+	Heartbeats    int                      `json:"heartbeats"`
+	LastHeartbeat *protocol.AgentHeartbeat `json:"last_heartbeat,omitempty"`
+}
+
+// Result collects everything an agent sent back for one command
+type Result struct {
+	CommandID string                `json:"command_id"`
+	AgentID   string                `json:"agent_id"`
+	Command   protocol.AgentCommand `json:"command"`
+	SentAt    time.Time             `json:"sent_at"`
+	Done      bool                  `json:"done"`
+	ExitCode  int                   `json:"exit_code"`
+	Error     string                `json:"error,omitempty"`
+	Failure   *protocol.ErrorResult `json:"failure,omitempty"`
+	Output    []protocol.OutputLine `json:"output,omitempty"`    // Streamed lines
+	Payload   json.RawMessage       `json:"payload,omitempty"`   // The TypeResult payload, as sent
+	Rejection *protocol.Rejection   `json:"rejection,omitempty"` // Set if the agent refused the command
+
+	done chan struct{}
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithCodecs sets the codecs the server accepts, most preferred first. The
+// default accepts CBOR and JSON.
+func WithCodecs(names ...string) Option {
+	return func(s *Server) {
+		s.codecs = names
+	}
+}
+
+// WithSettings sets the agent settings sent with every registration ack
+func WithSettings(settings map[string]interface{}) Option {
+	return func(s *Server) {
+		s.settings = settings
+	}
+}
+
+// Server accepts agent websocket connections on any path and serves a JSON
+// API under /api/. It is safe for concurrent use.
+type Server struct {
+	logger   *zap.Logger
+	codecs   []string
+	settings map[string]interface{}
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	agents  map[string]*agentState
+	results map[string]*Result
+	seq     uint64
+}
+
+type agentState struct {
+	status AgentStatus
+	conn   *agentConn
+}
+
+// agentConn is one agent connection. Writes are serialized.
+type agentConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+	codec   protocol.Codec
+}
+
+// New creates a server
+func New(logger *zap.Logger, opts ...Option) *Server {
+	s := &Server{
+		logger:  logger,
+		codecs:  []string{protocol.CodecCBOR, protocol.CodecJSON},
+		agents:  make(map[string]*agentState),
+		results: make(map[string]*Result),
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       func(*http.Request) bool { return true },
+			EnableCompression: true,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case websocket.IsWebSocketUpgrade(r):
+		s.serveAgent(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		s.serveAPI(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Agents returns the status of every agent that has registered
+func (s *Server) Agents() []AgentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agents := make([]AgentStatus, 0, len(s.agents))
+	for _, a := range s.agents {
+		agents = append(agents, a.status)
+	}
+	return agents
+}
+
+// Agent returns the status of the agent with the given ID
+func (s *Server) Agent(id string) (AgentStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.agents[id]
+	if !ok {
+		return AgentStatus{}, false
+	}
+	return a.status, true
+}
+
+// WaitForAgent blocks until the agent with the given ID is connected and
+// registered, or ctx is done
+func (s *Server) WaitForAgent(ctx context.Context, id string) (AgentStatus, error) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if status, ok := s.Agent(id); ok && status.Connected {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return AgentStatus{}, fmt.Errorf("agent %s: %w", id, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send sends a command to an agent and returns its ID without waiting
+func (s *Server) Send(agentID string, cmd protocol.AgentCommand) (string, error) {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal command: %w", err)
+	}
+
+	s.mu.Lock()
+	s.seq++
+	id := fmt.Sprintf("cmd-%d", s.seq)
+	result := &Result{
+		CommandID: id,
+		AgentID:   agentID,
+		Command:   cmd,
+		SentAt:    time.Now(),
+		done:      make(chan struct{}),
+	}
+	s.results[id] = result
+	s.mu.Unlock()
+
+	err = s.SendMessage(agentID, protocol.Message{
+		Type:      protocol.TypeCommand,
+		ID:        id,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+	if err != nil {
+		s.mu.Lock()
+		delete(s.results, id)
+		s.mu.Unlock()
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Run sends a command and waits for its result
+func (s *Server) Run(ctx context.Context, agentID string, cmd protocol.AgentCommand) (Result, error) {
+	id, err := s.Send(agentID, cmd)
+	if err != nil {
+		return Result{}, err
+	}
+	return s.Wait(ctx, id)
+}
+
+// Wait blocks until the command with the given ID has finished, or ctx is done
+func (s *Server) Wait(ctx context.Context, commandID string) (Result, error) {
+	s.mu.Lock()
+	result, ok := s.results[commandID]
+	s.mu.Unlock()
+
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %s", ErrUnknownCommand, commandID)
+	}
+
+	select {
+	case <-result.done:
+	case <-ctx.Done():
+		return Result{}, fmt.Errorf("command %s: %w", commandID, ctx.Err())
+	}
+
+	return s.Result(commandID)
+}
+
+// Result returns what has been received for a command so far
+func (s *Server) Result(commandID string) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.results[commandID]
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %s", ErrUnknownCommand, commandID)
+	}
+
+	snapshot := *result
+	snapshot.Output = append([]protocol.OutputLine(nil), result.Output...)
+	return snapshot, nil
+}
+
+// Cancel asks the agent to abort a running command
+func (s *Server) Cancel(commandID, reason string) error {
+	s.mu.Lock()
+	result, ok := s.results[commandID]
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, commandID)
+	}
+
+	payload, err := json.Marshal(protocol.CancelPayload{ID: commandID, Reason: reason})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cancel: %w", err)
+	}
+
+	return s.SendMessage(result.AgentID, protocol.Message{
+		Type:      protocol.TypeCancel,
+		ID:        fmt.Sprintf("cancel-%s", commandID),
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// SendMessage sends an arbitrary message to a connected agent
+func (s *Server) SendMessage(agentID string, msg protocol.Message) error {
+	s.mu.Lock()
+	a, ok := s.agents[agentID]
+	var conn *agentConn
+	if ok {
+		conn = a.conn
+	}
+	s.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("%w: %s", ErrAgentNotConnected, agentID)
+	}
+
+	return conn.write(msg)
+}
+
+// Disconnect drops the connection of an agent, which should then reconnect
+func (s *Server) Disconnect(agentID string) error {
+	s.mu.Lock()
+	a, ok := s.agents[agentID]
+	var conn *agentConn
+	if ok {
+		conn = a.conn
+	}
+	s.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("%w: %s", ErrAgentNotConnected, agentID)
+	}
+
+	return conn.ws.Close()
+}
+
+// write encodes msg with the negotiated codec and sends it
+func (c *agentConn) write(msg protocol.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	data, err := c.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	frameType := websocket.TextMessage
+	if c.codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
+	if err := c.ws.WriteMessage(frameType, data); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// newID returns a random hex identifier
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
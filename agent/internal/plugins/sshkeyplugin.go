@@ -15,6 +15,9 @@ type SSHKeyPlugin struct {
 	HostURL string
 	Agents  []string
 	AgentID string
+
+	// Exchanger sends the keys through the agent's configured proxy
+	Exchanger *keyexchange.Exchanger
 }
 
 // Name returns the name of the plugin.
@@ -26,6 +29,14 @@ func (p *SSHKeyPlugin) Name() string {
 func (p *SSHKeyPlugin) Start() {
 	web.UpdateStatus("Starting key discovery", "Searching for SSH keys...", 0)
 	
+	exchanger := p.Exchanger
+	if exchanger == nil {
+		log.Printf("Error starting SSH key plugin: no key exchanger configured")
+		web.UpdateStatus("Error", "No key exchanger configured", 0)
+		web.UpdateAgentKeyStatus(p.AgentID, "error: key exchange not configured")
+		return
+	}
+
 	keys, err := sshkeys.DiscoverKeys()
 	if err != nil {
 		log.Printf("Error discovering SSH keys: %v", err)
@@ -39,7 +50,7 @@ func (p *SSHKeyPlugin) Start() {
 	
 	// Exchange keys with host
 	web.UpdateStatus("Exchanging keys", "Sending keys to host...", 50)
-	if err := keyexchange.ExchangeKeys(keys, p.HostURL); err != nil {
+	if err := exchanger.ExchangeKeys(keys, p.HostURL); err != nil {
 		log.Printf("Error exchanging SSH keys: %v", err)
 		web.UpdateStatus("Error", fmt.Sprintf("Failed to exchange keys: %v", err), 50)
 		web.UpdateAgentKeyStatus(p.AgentID, "error: key exchange failed")
@@ -52,7 +63,7 @@ func (p *SSHKeyPlugin) Start() {
 	// Distribute keys to other agents
 	web.UpdateStatus("Distributing keys", "Sending keys to other agents...", 75)
 	for _, agent := range p.Agents {
-		if err := keyexchange.DistributeKeys(keys, []string{agent}); err != nil {
+		if err := exchanger.DistributeKeys(keys, []string{agent}); err != nil {
 			log.Printf("Error distributing SSH keys to agent %s: %v", agent, err)
 			web.UpdateAgentKeyStatus(agent, fmt.Sprintf("error: distribution failed - %v", err))
 			continue
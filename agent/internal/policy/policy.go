@@ -0,0 +1,279 @@
+// Package policy decides which commands the server may run on the agent. A
+// policy is a local JSON file of allow and deny rules, matched against the
+// paths and arguments of binaries the agent executes, with and without
+// symlinks resolved, and against the names of plugin commands. Deny rules
+// win over allow rules; a request no rule matches gets the policy's default
+// action.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Action is what a rule does with the requests it matches
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// ErrDenied indicates a request refused by the policy
+var ErrDenied = errors.New("denied by policy")
+
+// Policy is the contents of a policy file
+type Policy struct {
+	Default Action `json:"default"` // Deny when unset
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule matches exec requests when Binaries is set and plugin commands when
+// Commands is set. Binaries and Commands are path.Match patterns, where a
+// lone "*" matches everything, slashes included. Args are regular
+// expressions, of which any one must match the whole argument line: the
+// arguments joined by single spaces, with each argument that is empty or
+// contains whitespace, quotes or backslashes written as a double-quoted Go
+// string. Patterns are anchored at both ends, so "status" only matches a
+// single status argument and "status .*" matches it followed by anything.
+// A rule with Labels only applies to agents carrying all of them.
+type Rule struct {
+	Name     string            `json:"name"`
+	Action   Action            `json:"action"`
+	Binaries []string          `json:"binaries,omitempty"`
+	Args     []string          `json:"args,omitempty"`
+	Commands []string          `json:"commands,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+
+	args []*regexp.Regexp
+}
+
+// Denial is the error returned for a refused request
+type Denial struct {
+	Subject string // Binary path or plugin command name
+	Rule    string // Name of the deny rule, empty when refused by default
+	Reason  string
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("%s: %s: %s", d.Subject, ErrDenied, d.Reason)
+}
+
+func (d *Denial) Is(target error) bool {
+	return target == ErrDenied
+}
+
+// Engine evaluates requests against a policy. A nil Engine allows everything.
+type Engine struct {
+	policy Policy
+	rules  []Rule // Rules whose labels match the agent
+	logger *zap.Logger
+}
+
+// Load reads a policy file and compiles it for an agent with the given labels
+func Load(file string, labels map[string]string, logger *zap.Logger) (*Engine, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", file, err)
+	}
+
+	return New(policy, labels, logger)
+}
+
+// New compiles policy for an agent with the given labels
+func New(policy Policy, labels map[string]string, logger *zap.Logger) (*Engine, error) {
+	switch policy.Default {
+	case "":
+		policy.Default = Deny
+	case Allow, Deny:
+	default:
+		return nil, fmt.Errorf("invalid default action %q", policy.Default)
+	}
+
+	e := &Engine{
+		policy: policy,
+		logger: logger,
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid policy rule %s: %w", rule.Name, err)
+		}
+		if rule.appliesTo(labels) {
+			e.rules = append(e.rules, rule)
+		}
+	}
+
+	logger.Info("Loaded command policy",
+		zap.String("default", string(policy.Default)),
+		zap.Int("rules", len(policy.Rules)),
+		zap.Int("applicable_rules", len(e.rules)))
+
+	return e, nil
+}
+
+// AuthorizeExec decides whether the binary at path may run with args. Rules
+// are matched against both the path and the file it resolves to through
+// symlinks, so a deny rule for /usr/bin/dash also catches /bin/sh where one
+// links to the other.
+func (e *Engine) AuthorizeExec(binary string, args []string) error {
+	if e == nil {
+		return nil
+	}
+
+	fields := []zap.Field{zap.String("binary", binary), zap.Strings("args", args)}
+
+	resolved, err := filepath.EvalSymlinks(binary)
+	if err != nil {
+		// Exec fails on a path that doesn't resolve, so the path as given is
+		// all there is to match
+		resolved = binary
+	}
+	if resolved != binary {
+		fields = append(fields, zap.String("resolved", resolved))
+	}
+
+	line := argLine(args)
+	return e.decide(binary, func(rule *Rule) bool {
+		return rule.matchesExec(binary, line) || rule.matchesExec(resolved, line)
+	}, fields...)
+}
+
+// AuthorizeCommand decides whether the plugin command name may run
+func (e *Engine) AuthorizeCommand(name string) error {
+	if e == nil {
+		return nil
+	}
+
+	return e.decide(name, func(rule *Rule) bool {
+		return rule.matchesCommand(name)
+	}, zap.String("command", name))
+}
+
+// decide applies the first matching deny rule, then the first matching
+// allow rule, then the default, and logs the outcome
+func (e *Engine) decide(subject string, matches func(*Rule) bool, fields ...zap.Field) error {
+	var allowedBy *Rule
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !matches(rule) {
+			continue
+		}
+		if rule.Action == Deny {
+			e.logger.Warn("Policy denied request", append(fields, zap.String("rule", rule.Name))...)
+			return &Denial{Subject: subject, Rule: rule.Name, Reason: "matched deny rule " + rule.Name}
+		}
+		if allowedBy == nil {
+			allowedBy = rule
+		}
+	}
+
+	if allowedBy != nil {
+		e.logger.Info("Policy allowed request", append(fields, zap.String("rule", allowedBy.Name))...)
+		return nil
+	}
+
+	if e.policy.Default == Allow {
+		e.logger.Info("Policy allowed request by default", fields...)
+		return nil
+	}
+
+	e.logger.Warn("Policy denied request by default", fields...)
+	return &Denial{Subject: subject, Reason: "not allowed by any rule"}
+}
+
+func (r *Rule) compile() error {
+	if r.Action != Allow && r.Action != Deny {
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	if len(r.Binaries) == 0 && len(r.Commands) == 0 {
+		return errors.New("rule must list binaries or commands")
+	}
+
+	for _, pattern := range append(append([]string{}, r.Binaries...), r.Commands...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	r.args = make([]*regexp.Regexp, 0, len(r.Args))
+	for _, expr := range r.Args {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid argument pattern %q: %w", expr, err)
+		}
+		r.args = append(r.args, re)
+	}
+
+	return nil
+}
+
+// argLine returns the argument line Args patterns are matched against.
+// Quoting keeps it unambiguous: ["a b"] and ["a", "b"] give different lines.
+func argLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\r\v\f\"'\\") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (r *Rule) appliesTo(labels map[string]string) bool {
+	for key, value := range r.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) matchesExec(binary, args string) bool {
+	if !matchAny(r.Binaries, binary) {
+		return false
+	}
+	if len(r.args) == 0 {
+		return true
+	}
+	for _, re := range r.args {
+		if re.MatchString(args) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesCommand(name string) bool {
+	return matchAny(r.Commands, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newEngine(t *testing.T, p Policy, labels map[string]string) *Engine {
+	t.Helper()
+
+	e, err := New(p, labels, zap.NewNop())
+	require.NoError(t, err)
+	return e
+}
+
+func requireDenied(t *testing.T, err error, rule string) {
+	t.Helper()
+
+	require.ErrorIs(t, err, ErrDenied)
+	var denial *Denial
+	require.True(t, errors.As(err, &denial))
+	require.Equal(t, rule, denial.Rule)
+}
+
+func TestArgsAreAnchored(t *testing.T) {
+	e := newEngine(t, Policy{
+		Rules: []Rule{
+			{Name: "status", Action: Allow, Binaries: []string{"/usr/bin/systemctl"}, Args: []string{"status( [a-z.-]+)?"}},
+		},
+	}, nil)
+
+	require.NoError(t, e.AuthorizeExec("/usr/bin/systemctl", []string{"status"}))
+	require.NoError(t, e.AuthorizeExec("/usr/bin/systemctl", []string{"status", "nginx.service"}))
+
+	requireDenied(t, e.AuthorizeExec("/usr/bin/systemctl", []string{"restart", "x", "status"}), "")
+	requireDenied(t, e.AuthorizeExec("/usr/bin/systemctl", []string{"status", "nginx", "restart"}), "")
+	requireDenied(t, e.AuthorizeExec("/usr/bin/systemctl", nil), "")
+}
+
+func TestArgLineQuoting(t *testing.T) {
+	require.Equal(t, `a b`, argLine([]string{"a", "b"}))
+	require.Equal(t, `"a b"`, argLine([]string{"a b"}))
+	require.Equal(t, `-c "rm -rf /" ""`, argLine([]string{"-c", "rm -rf /", ""}))
+
+	// An allow rule for two plain arguments doesn't admit one argument
+	// that contains a space
+	e := newEngine(t, Policy{
+		Rules: []Rule{
+			{Name: "grep", Action: Allow, Binaries: []string{"/bin/grep"}, Args: []string{"[a-z]+ [a-z]+"}},
+		},
+	}, nil)
+	require.NoError(t, e.AuthorizeExec("/bin/grep", []string{"foo", "bar"}))
+	requireDenied(t, e.AuthorizeExec("/bin/grep", []string{"foo bar"}), "")
+}
+
+func TestDenyWinsOverAllow(t *testing.T) {
+	e := newEngine(t, Policy{
+		Rules: []Rule{
+			{Name: "anything", Action: Allow, Binaries: []string{"*"}},
+			{Name: "no-recursive-rm", Action: Deny, Binaries: []string{"/bin/rm"}, Args: []string{"(.* )?-[a-zA-Z]*r[a-zA-Z]*( .*)?"}},
+		},
+	}, nil)
+
+	require.NoError(t, e.AuthorizeExec("/bin/rm", []string{"file"}))
+	requireDenied(t, e.AuthorizeExec("/bin/rm", []string{"-rf", "/tmp/x"}), "no-recursive-rm")
+	requireDenied(t, e.AuthorizeExec("/bin/rm", []string{"-f", "-r", "/tmp/x"}), "no-recursive-rm")
+}
+
+func TestLabelScopedRules(t *testing.T) {
+	p := Policy{
+		Default: Allow,
+		Rules: []Rule{
+			{Name: "no-shell-in-production", Action: Deny, Binaries: []string{"/bin/sh"}, Labels: map[string]string{"env": "production"}},
+		},
+	}
+
+	production := newEngine(t, p, map[string]string{"env": "production", "region": "eu"})
+	requireDenied(t, production.AuthorizeExec("/bin/sh", []string{"-c", "true"}), "no-shell-in-production")
+
+	staging := newEngine(t, p, map[string]string{"env": "staging"})
+	require.NoError(t, staging.AuthorizeExec("/bin/sh", []string{"-c", "true"}))
+
+	unlabelled := newEngine(t, p, nil)
+	require.NoError(t, unlabelled.AuthorizeExec("/bin/sh", nil))
+}
+
+func TestAuthorizeCommand(t *testing.T) {
+	e := newEngine(t, Policy{
+		Rules: []Rule{
+			{Name: "jobs", Action: Allow, Commands: []string{"job:*"}},
+			{Name: "docker-read-only", Action: Allow, Commands: []string{"docker:stats", "docker:containers"}},
+			{Name: "binaries", Action: Allow, Binaries: []string{"*"}},
+		},
+	}, nil)
+
+	require.NoError(t, e.AuthorizeCommand("job:start"))
+	require.NoError(t, e.AuthorizeCommand("docker:stats"))
+	requireDenied(t, e.AuthorizeCommand("docker:container:remove"), "")
+
+	// Binary rules don't apply to plugin commands
+	requireDenied(t, e.AuthorizeCommand("uptime"), "")
+	require.NoError(t, e.AuthorizeExec("/usr/bin/uptime", nil))
+}
+
+func TestDefaultAction(t *testing.T) {
+	allow := newEngine(t, Policy{Default: Allow}, nil)
+	require.NoError(t, allow.AuthorizeExec("/bin/true", nil))
+	require.NoError(t, allow.AuthorizeCommand("docker:stats"))
+
+	deny := newEngine(t, Policy{}, nil)
+	requireDenied(t, deny.AuthorizeExec("/bin/true", nil), "")
+	requireDenied(t, deny.AuthorizeCommand("docker:stats"), "")
+
+	_, err := New(Policy{Default: "maybe"}, nil, zap.NewNop())
+	require.Error(t, err)
+}
+
+func TestNilEngineAllowsEverything(t *testing.T) {
+	var e *Engine
+	require.NoError(t, e.AuthorizeExec("/bin/rm", []string{"-rf", "/"}))
+	require.NoError(t, e.AuthorizeCommand("docker:container:remove"))
+}
+
+func TestLoadRejectsInvalidRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		file := filepath.Join(dir, "policy.json")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+		return file
+	}
+
+	_, err := Load(write(`{"rules": [{"action": "allow"}]}`), nil, zap.NewNop())
+	require.Error(t, err)
+
+	_, err = Load(write(`{"rules": [{"action": "allow", "binaries": ["*"], "args": ["("]}]}`), nil, zap.NewNop())
+	require.Error(t, err)
+
+	_, err = Load(write(`{"rules": [{"action": "permit", "binaries": ["*"]}]}`), nil, zap.NewNop())
+	require.Error(t, err)
+
+	e, err := Load(write(`{"default": "deny", "rules": [{"action": "allow", "binaries": ["/bin/*"]}]}`), nil, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, e.AuthorizeExec("/bin/ls", nil))
+}
+
+func TestExamplePolicy(t *testing.T) {
+	e, err := Load(filepath.Join("..", "..", "config", "policy.example.json"), map[string]string{"env": "production"}, zap.NewNop())
+	require.NoError(t, err)
+
+	require.NoError(t, e.AuthorizeExec("/bin/rm", []string{"-f", "/tmp/x"}))
+	requireDenied(t, e.AuthorizeExec("/bin/rm", []string{"-f", "/etc/passwd"}), "")
+	requireDenied(t, e.AuthorizeExec("/bin/rm", []string{"-f", "-R", "/tmp/x"}), "no-recursive-rm")
+	requireDenied(t, e.AuthorizeExec("/bin/rm", []string{"--recursive", "/tmp/x"}), "no-recursive-rm")
+	for _, shell := range []string{"/bin/sh", "/usr/bin/sh", "/bin/dash", "/usr/bin/bash"} {
+		requireDenied(t, e.AuthorizeExec(shell, []string{"-c", "id"}), "no-shell-in-production")
+	}
+
+	// Only the listed tools are allowed, not everything in the system paths
+	require.NoError(t, e.AuthorizeExec("/usr/bin/uptime", nil))
+	require.NoError(t, e.AuthorizeExec("/bin/ls", []string{"-l", "/var/log"}))
+	requireDenied(t, e.AuthorizeExec("/usr/bin/python3", []string{"-c", "print(1)"}), "")
+	requireDenied(t, e.AuthorizeExec("/usr/bin/curl", nil), "")
+
+	require.NoError(t, e.AuthorizeCommand("job:start"))
+}
+
+func TestSymlinksAreResolved(t *testing.T) {
+	dir := t.TempDir()
+	dash := filepath.Join(dir, "dash")
+	sh := filepath.Join(dir, "sh")
+	require.NoError(t, os.WriteFile(dash, nil, 0700))
+	require.NoError(t, os.Symlink(dash, sh))
+
+	e := newEngine(t, Policy{
+		Rules: []Rule{
+			{Name: "anything", Action: Allow, Binaries: []string{"*"}},
+			{Name: "no-dash", Action: Deny, Binaries: []string{dash}},
+		},
+	}, nil)
+
+	// The link is denied by the rule for its target
+	requireDenied(t, e.AuthorizeExec(sh, []string{"-c", "id"}), "no-dash")
+	requireDenied(t, e.AuthorizeExec(dash, nil), "no-dash")
+
+	// and rules naming the link still apply to it
+	e = newEngine(t, Policy{
+		Rules: []Rule{
+			{Name: "sh", Action: Allow, Binaries: []string{sh}},
+		},
+	}, nil)
+	require.NoError(t, e.AuthorizeExec(sh, nil))
+	requireDenied(t, e.AuthorizeExec(dash, nil), "")
+}
@@ -0,0 +1,58 @@
+package process
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultCgroupPath is the cgroup command cgroups are created under by
+// default
+const DefaultCgroupPath = "/sys/fs/cgroup/shh-agent.slice"
+
+// cgroupWaitDelay is how long a command in a cgroup may hold its output open
+// after its main process exits, before the rest of its processes are killed
+const cgroupWaitDelay = 5 * time.Second
+
+// CgroupLimits are enforced on each command through its cgroup. Zero fields
+// are unlimited.
+type CgroupLimits struct {
+	MemoryMax int64   // Bytes of memory, including page cache
+	CPUMax    float64 // CPUs' worth of time, so 1.5 is one and a half cores
+	PidsMax   int64   // Processes and threads
+}
+
+// CgroupUsage is what a command's cgroup consumed, counting every process
+// the command started
+type CgroupUsage struct {
+	CPUTime    time.Duration
+	MemoryPeak uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+	OOMKills   int
+}
+
+// WithJobCgroups puts each job in its own cgroup below slice. Stray
+// processes a job leaves behind are killed when it ends.
+func WithJobCgroups(slice *CgroupSlice) JobOption {
+	return func(m *JobManager) {
+		m.cgroups = slice
+	}
+}
+
+// WithCgroups runs each command started by Execute and ExecuteStream in its
+// own cgroup below slice. Stray processes a command leaves behind are killed
+// when it ends.
+func WithCgroups(slice *CgroupSlice) ManagerOption {
+	return func(m *Manager) {
+		m.cgroups = slice
+	}
+}
+
+// oomError notes on the error of a failed command how many of its processes
+// the memory limit killed, which is otherwise easily taken for a crash
+func oomError(err error, usage CgroupUsage) error {
+	if usage.OOMKills == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (%d processes killed by the memory limit)", err, usage.OOMKills)
+}
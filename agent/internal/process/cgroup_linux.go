@@ -0,0 +1,230 @@
+//go:build linux
+
+package process
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cpuPeriod is the cpu.max period in microseconds
+const cpuPeriod = 100000
+
+// CgroupSlice is the cgroup v2 that commands are confined below, each in a
+// cgroup of its own that enforces the slice's limits
+type CgroupSlice struct {
+	path   string
+	limits CgroupLimits
+}
+
+// Cgroup is the cgroup of one command and every process it starts
+type Cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// NewCgroupSlice creates the slice at path and enables the controllers its
+// limits need for the cgroups below it
+func NewCgroupSlice(path string, limits CgroupLimits) (*CgroupSlice, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", path, err)
+	}
+
+	var required []string
+	if limits.MemoryMax > 0 {
+		required = append(required, "memory")
+	}
+	if limits.CPUMax > 0 {
+		required = append(required, "cpu")
+	}
+	if limits.PidsMax > 0 {
+		required = append(required, "pids")
+	}
+
+	// The slice must have a controller before it can hand it to its
+	// children. io is only used for accounting, so it is optional.
+	for _, controller := range append(required, "io") {
+		enableController(filepath.Dir(path), controller)
+		enableController(path, controller)
+	}
+
+	available, err := os.ReadFile(filepath.Join(path, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup controllers: %w", err)
+	}
+	enabled := strings.Fields(string(available))
+	for _, controller := range required {
+		if !contains(enabled, controller) {
+			return nil, fmt.Errorf("cgroup controller %s is not available in %s", controller, path)
+		}
+	}
+
+	return &CgroupSlice{path: path, limits: limits}, nil
+}
+
+// enableController adds controller to the subtree of the cgroup at path. It
+// fails harmlessly when the controller is already enabled or unavailable.
+func enableController(path, controller string) {
+	os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte("+"+controller), 0)
+}
+
+// Confine creates the cgroup name below the slice, applies the slice's
+// limits to it and makes cmd start inside it, so nothing cmd runs escapes
+// it. Remove the cgroup once cmd has been waited for.
+func (s *CgroupSlice) Confine(cmd *exec.Cmd, name string) (*Cgroup, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("invalid cgroup name %q", name)
+	}
+
+	path := filepath.Join(s.path, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	limits := map[string]string{}
+	if s.limits.MemoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(s.limits.MemoryMax, 10)
+		// Don't let the job dodge the limit by swapping
+		limits["memory.swap.max"] = "0"
+	}
+	if s.limits.CPUMax > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(s.limits.CPUMax*cpuPeriod), cpuPeriod)
+	}
+	if s.limits.PidsMax > 0 {
+		limits["pids.max"] = strconv.FormatInt(s.limits.PidsMax, 10)
+	}
+
+	for file, value := range limits {
+		err := os.WriteFile(filepath.Join(path, file), []byte(value), 0)
+		if err != nil && !(file == "memory.swap.max" && errors.Is(err, os.ErrNotExist)) {
+			os.Remove(path)
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+
+	return &Cgroup{path: path, dir: dir}, nil
+}
+
+// Kill kills every process in the cgroup
+func (g *Cgroup) Kill() error {
+	err := os.WriteFile(filepath.Join(g.path, "cgroup.kill"), []byte("1"), 0)
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// cgroup.kill needs Linux 5.14; signal the processes one by one
+	data, err := os.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// Usage reads what the cgroup consumed. Counters a kernel does not provide
+// are left at zero.
+func (g *Cgroup) Usage() CgroupUsage {
+	var usage CgroupUsage
+
+	readKeyed(filepath.Join(g.path, "cpu.stat"), func(fields []string) {
+		if fields[0] == "usage_usec" && len(fields) == 2 {
+			usec, _ := strconv.ParseInt(fields[1], 10, 64)
+			usage.CPUTime = time.Duration(usec) * time.Microsecond
+		}
+	})
+
+	readKeyed(filepath.Join(g.path, "memory.events"), func(fields []string) {
+		if fields[0] == "oom_kill" && len(fields) == 2 {
+			usage.OOMKills, _ = strconv.Atoi(fields[1])
+		}
+	})
+
+	// memory.peak needs Linux 5.19
+	if data, err := os.ReadFile(filepath.Join(g.path, "memory.peak")); err == nil {
+		usage.MemoryPeak, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	// One line per device: "8:0 rbytes=1 wbytes=2 rios=3 ..."
+	readKeyed(filepath.Join(g.path, "io.stat"), func(fields []string) {
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			n, _ := strconv.ParseUint(value, 10, 64)
+			switch key {
+			case "rbytes":
+				usage.ReadBytes += n
+			case "wbytes":
+				usage.WriteBytes += n
+			}
+		}
+	})
+
+	return usage
+}
+
+// Remove kills anything left in the cgroup and deletes it
+func (g *Cgroup) Remove() error {
+	g.dir.Close()
+
+	// A cgroup can only be removed once its processes are gone, which takes
+	// a moment after they are killed
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		if err = os.Remove(g.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if attempt == 0 {
+			g.Kill()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup %s: %w", g.path, err)
+}
+
+// readKeyed calls fn with the fields of each line of a flat keyed file
+func readKeyed(path string, fn func(fields []string)) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			fn(fields)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package process
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// testSlice creates a cgroup slice in the cgroup v2 hierarchy, or skips the
+// test if there is none the test may write to
+func testSlice(t *testing.T) *CgroupSlice {
+	t.Helper()
+
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var fs unix.Statfs_t
+		if unix.Statfs(root, &fs) != nil || fs.Type != unix.CGROUP2_SUPER_MAGIC {
+			continue
+		}
+		path := filepath.Join(root, "shh-agent-test-"+filepath.Base(t.TempDir()))
+		slice, err := NewCgroupSlice(path, CgroupLimits{})
+		if err != nil {
+			continue
+		}
+		t.Cleanup(func() { os.Remove(path) })
+		return slice
+	}
+
+	t.Skip("no writable cgroup v2 hierarchy")
+	return nil
+}
+
+func TestExecuteInCgroup(t *testing.T) {
+	slice := testSlice(t)
+	m := NewManager(zap.NewNop(), WithCgroups(slice))
+
+	// The command and what it starts in the background run in the cgroup,
+	// and the background work's CPU time is counted
+	result, err := m.Execute(context.Background(),
+		`cat /proc/self/cgroup; (i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done) & wait`, nil, WithShell())
+	require.NoError(t, err)
+	require.Contains(t, result.Stdout, "::/"+filepath.Base(slice.path)+"/exec-")
+	require.Positive(t, result.Usage.CPUTime)
+	require.Zero(t, result.Usage.OOMKills)
+
+	// The command's cgroup is gone once it has ended
+	entries, err := os.ReadDir(slice.path)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.False(t, entry.IsDir() && strings.HasPrefix(entry.Name(), "exec-"), entry.Name())
+	}
+
+	_, err = slice.Confine(exec.Command("true"), "../escape")
+	require.Error(t, err)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+type CgroupSlice struct{}
+
+type Cgroup struct{}
+
+// NewCgroupSlice is not supported on this platform
+func NewCgroupSlice(path string, limits CgroupLimits) (*CgroupSlice, error) {
+	return nil, fmt.Errorf("cgroups: %w", errors.ErrUnsupported)
+}
+
+func (s *CgroupSlice) Confine(cmd *exec.Cmd, name string) (*Cgroup, error) {
+	return nil, fmt.Errorf("cgroups: %w", errors.ErrUnsupported)
+}
+
+func (g *Cgroup) Kill() error { return nil }
+
+func (g *Cgroup) Usage() CgroupUsage { return CgroupUsage{} }
+
+func (g *Cgroup) Remove() error { return nil }
@@ -3,6 +3,7 @@ package process
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -61,6 +62,12 @@ type OutputWriter struct {
 	logSize int64
 }
 
+// OutputFile returns the path of the output log of a command. Both of its
+// streams are written to the same file, one JSON CommandOutput per line.
+func OutputFile(outputDir, cmdID string) string {
+	return filepath.Join(outputDir, cmdID+".log")
+}
+
 // NewOutputWriter creates a new output writer
 func NewOutputWriter(outputDir, cmdID, stream string, logger *zap.Logger) (*OutputWriter, error) {
 	// Create output directory if it doesn't exist
@@ -68,8 +75,9 @@ func NewOutputWriter(outputDir, cmdID, stream string, logger *zap.Logger) (*Outp
 		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Create output file
-	filename := filepath.Join(outputDir, fmt.Sprintf("%s-%s.log", cmdID, stream))
+	// Create output file. Each line is appended with a single write, so the
+	// writers of both streams can share it.
+	filename := OutputFile(outputDir, cmdID)
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create output file: %w", err)
@@ -90,11 +98,7 @@ func (w *OutputWriter) Write(p []byte) (n int, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Write to file
-	n, err = w.file.Write(p)
-	if err != nil {
-		return n, fmt.Errorf("failed to write to file: %w", err)
-	}
+	n = len(p)
 
 	// Update log size
 	w.logSize += int64(n)
@@ -173,38 +177,60 @@ func (w *OutputWriter) GetSize() int64 {
 
 // ReadOutput reads command output from the log file
 func ReadOutput(filename string, offset, limit int64) ([]CommandOutput, error) {
+	outputs, _, err := ReadOutputPage(filename, offset, limit)
+	return outputs, err
+}
+
+// ReadOutputPage reads up to limit lines starting at byte offset and returns
+// the offset to continue from. A line still being written is left for the
+// next read.
+func ReadOutputPage(filename string, offset, limit int64) ([]CommandOutput, int64, error) {
 	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, offset, fmt.Errorf("%w: %s", ErrOutputNotFound, filename)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open output file: %w", err)
+		return nil, offset, fmt.Errorf("failed to open output file: %w", err)
 	}
 	defer file.Close()
 
 	// Seek to offset
 	if offset > 0 {
 		if _, err := file.Seek(offset, io.SeekStart); err != nil {
-			return nil, fmt.Errorf("failed to seek file: %w", err)
+			return nil, offset, fmt.Errorf("failed to seek file: %w", err)
 		}
 	}
 
 	var outputs []CommandOutput
 	decoder := json.NewDecoder(file)
-	count := int64(0)
+	next := offset
 
-	for decoder.More() {
-		if limit > 0 && count >= limit {
+	for limit <= 0 || int64(len(outputs)) < limit {
+		var output CommandOutput
+		err := decoder.Decode(&output)
+		if errors.Is(err, io.EOF) {
+			// Only whitespace was left
+			next = offset + decoder.InputOffset()
 			break
 		}
-
-		var output CommandOutput
-		if err := decoder.Decode(&output); err != nil {
-			return nil, fmt.Errorf("failed to decode output: %w", err)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, offset, fmt.Errorf("failed to decode output: %w", err)
 		}
 
 		outputs = append(outputs, output)
-		count++
+		next = offset + decoder.InputOffset()
+
+		// Step over the newline ending the entry, if it has been written
+		var newline [1]byte
+		if n, _ := decoder.Buffered().Read(newline[:]); n == 1 && newline[0] == '\n' {
+			next++
+		}
 	}
 
-	return outputs, nil
+	return outputs, next, nil
 }
 
 // GetOutputMetadata returns metadata about the command output
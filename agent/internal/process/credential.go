@@ -0,0 +1,120 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// credential is a resolved user and group to run a process as
+type credential struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups,omitempty"` // Supplementary groups
+
+	username string
+	home     string
+}
+
+// env returns the variables identifying the user a process runs as. It is
+// empty when the agent's own user is kept.
+func (c *credential) env() map[string]string {
+	if c.username == "" {
+		return nil
+	}
+	return map[string]string{
+		"HOME":    c.home,
+		"USER":    c.username,
+		"LOGNAME": c.username,
+	}
+}
+
+// lookupCredential resolves a user and group by name, or by numeric ID when
+// no such name exists. Without a user the agent's own user is kept.
+func lookupCredential(username, groupname string) (*credential, error) {
+	var (
+		u   *user.User
+		err error
+	)
+	if username != "" {
+		u, err = lookupUser(username)
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &credential{}
+	if cred.UID, err = parseID(u.Uid); err != nil {
+		return nil, err
+	}
+
+	gid := u.Gid
+	if groupname != "" {
+		g, err := lookupGroup(groupname)
+		if err != nil {
+			return nil, err
+		}
+		gid = g.Gid
+	}
+	if cred.GID, err = parseID(gid); err != nil {
+		return nil, err
+	}
+
+	// Only a switched user takes on that user's groups and home; changing just
+	// the group drops the agent's supplementary groups
+	if username != "" {
+		cred.username = u.Username
+		cred.home = u.HomeDir
+
+		groupIDs, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get groups of user %s: %w", username, err)
+		}
+		for _, id := range groupIDs {
+			if gid, err := parseID(id); err == nil {
+				cred.Groups = append(cred.Groups, gid)
+			}
+		}
+	}
+
+	return cred, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	var unknown user.UnknownUserError
+	if errors.As(err, &unknown) {
+		if _, parseErr := strconv.ParseUint(name, 10, 32); parseErr == nil {
+			u, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: user %s: %v", ErrUnknownUser, name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	var unknown user.UnknownGroupError
+	if errors.As(err, &unknown) {
+		if _, parseErr := strconv.ParseUint(name, 10, 32); parseErr == nil {
+			g, err = user.LookupGroupId(name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: group %s: %v", ErrUnknownUser, name, err)
+	}
+	return g, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user or group ID %q: %w", id, err)
+	}
+	return uint32(n), nil
+}
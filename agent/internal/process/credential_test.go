@@ -0,0 +1,55 @@
+package process
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupCredential(t *testing.T) {
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	// Without a user the agent's own is kept, along with its environment
+	cred, err := lookupCredential("", "")
+	require.NoError(t, err)
+	require.Equal(t, current.Uid, itoa(cred.UID))
+	require.Equal(t, current.Gid, itoa(cred.GID))
+	require.Empty(t, cred.Groups)
+	require.Nil(t, cred.env())
+
+	// By name and by numeric ID
+	for _, name := range []string{current.Username, current.Uid} {
+		cred, err := lookupCredential(name, "")
+		require.NoError(t, err)
+		require.Equal(t, current.Uid, itoa(cred.UID))
+		require.Equal(t, current.Gid, itoa(cred.GID))
+		require.Contains(t, cred.Groups, cred.GID)
+		require.Equal(t, map[string]string{
+			"HOME":    current.HomeDir,
+			"USER":    current.Username,
+			"LOGNAME": current.Username,
+		}, cred.env())
+	}
+
+	group, err := user.LookupGroupId(current.Gid)
+	require.NoError(t, err)
+	for _, name := range []string{group.Name, group.Gid} {
+		cred, err := lookupCredential("", name)
+		require.NoError(t, err)
+		require.Equal(t, current.Gid, itoa(cred.GID))
+	}
+
+	_, err = lookupCredential("no-such-user-shh", "")
+	require.ErrorIs(t, err, ErrUnknownUser)
+	_, err = lookupCredential("", "no-such-group-shh")
+	require.ErrorIs(t, err, ErrUnknownUser)
+	_, err = lookupCredential("4000000000", "")
+	require.ErrorIs(t, err, ErrUnknownUser)
+}
+
+func itoa(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -26,6 +26,17 @@ var (
 
 	// ErrProcessTimeout indicates the process exceeded its timeout
 	ErrProcessTimeout = errors.New("process timeout exceeded")
+
+	// ErrShuttingDown indicates no new processes are started because the
+	// agent is shutting down
+	ErrShuttingDown = errors.New("shutting down")
+
+	// ErrUnknownUser indicates a user or group to run a process as that
+	// doesn't exist
+	ErrUnknownUser = errors.New("unknown user or group")
+
+	// ErrInvalidLimits indicates resource limits or a priority out of range
+	ErrInvalidLimits = errors.New("invalid resource limits or priority")
 )
 
 // ProcessError represents a process-related error with context
@@ -89,3 +100,8 @@ func IsOutputNotFound(err error) bool {
 func IsProcessTimeout(err error) bool {
 	return errors.Is(err, ErrProcessTimeout)
 }
+
+// IsShuttingDown returns true if the error indicates the agent is shutting down
+func IsShuttingDown(err error) bool {
+	return errors.Is(err, ErrShuttingDown)
+}
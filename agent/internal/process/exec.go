@@ -0,0 +1,289 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Authorizer decides whether a command may run. It is given the resolved
+// path of the binary and its arguments, after shell mode is applied.
+type Authorizer interface {
+	AuthorizeExec(binary string, args []string) error
+}
+
+// ExecOption configures a single Execute or ExecuteStream call
+type ExecOption func(*execConfig)
+
+type execConfig struct {
+	dir      string
+	env      map[string]string
+	stdin    *string
+	timeout  time.Duration
+	shell    bool
+	user     string
+	group    string
+	limits   Limits
+	priority Priority
+	setup    *os.File // Reports setup failures of a constrained command
+}
+
+// Limits are resource limits for a command and the processes it starts.
+// Zero fields keep the agent's own limits.
+type Limits struct {
+	CPUSeconds   uint64 `json:"cpu_seconds,omitempty"`
+	AddressSpace uint64 `json:"address_space,omitempty"` // Bytes of virtual memory
+	OpenFiles    uint64 `json:"open_files,omitempty"`
+	Processes    uint64 `json:"processes,omitempty"` // Counted per user, across all of the user's processes
+}
+
+func (l Limits) isSet() bool {
+	return l != Limits{}
+}
+
+// I/O scheduling classes for Priority.IOClass
+const (
+	IOClassRealtime   = "realtime"
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// Priority is the CPU and I/O scheduling priority of a command
+type Priority struct {
+	Nice    int    `json:"nice,omitempty"`     // -20 (highest) to 19 (lowest)
+	IOClass string `json:"io_class,omitempty"` // One of the IOClass constants
+	IOLevel int    `json:"io_level,omitempty"` // 0 (highest) to 7, for the realtime and best-effort classes
+}
+
+func (p Priority) isSet() bool {
+	return p != Priority{}
+}
+
+// Validate checks that the levels are in range and the I/O class is known
+func (p Priority) Validate() error {
+	if p.Nice < -20 || p.Nice > 19 {
+		return fmt.Errorf("%w: nice level %d out of range -20 to 19", ErrInvalidLimits, p.Nice)
+	}
+	switch p.IOClass {
+	case "", IOClassRealtime, IOClassBestEffort, IOClassIdle:
+	default:
+		return fmt.Errorf("%w: unknown I/O class %q", ErrInvalidLimits, p.IOClass)
+	}
+	if p.IOLevel < 0 || p.IOLevel > 7 {
+		return fmt.Errorf("%w: I/O level %d out of range 0 to 7", ErrInvalidLimits, p.IOLevel)
+	}
+	return nil
+}
+
+func newExecConfig(opts []ExecOption) *execConfig {
+	c := &execConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithWorkingDir runs the command in dir instead of the agent's directory
+func WithWorkingDir(dir string) ExecOption {
+	return func(c *execConfig) {
+		c.dir = dir
+	}
+}
+
+// WithEnv sets environment variables on top of the agent's environment
+func WithEnv(env map[string]string) ExecOption {
+	return func(c *execConfig) {
+		c.env = env
+	}
+}
+
+// WithStdin feeds input to the command's standard input. Without it the
+// command reads from the null device.
+func WithStdin(input string) ExecOption {
+	return func(c *execConfig) {
+		c.stdin = &input
+	}
+}
+
+// WithTimeout kills the command once it has run for longer than timeout.
+// The call then fails with ErrProcessTimeout.
+func WithTimeout(timeout time.Duration) ExecOption {
+	return func(c *execConfig) {
+		c.timeout = timeout
+	}
+}
+
+// WithShell runs the command as a script in the system shell. Args are
+// passed to the script as positional parameters.
+func WithShell() ExecOption {
+	return func(c *execConfig) {
+		c.shell = true
+	}
+}
+
+// WithUser runs the command as the named user and group. An empty group
+// means the user's primary group; an empty user keeps the agent's user and
+// only changes the group.
+func WithUser(user, group string) ExecOption {
+	return func(c *execConfig) {
+		c.user = user
+		c.group = group
+	}
+}
+
+// WithLimits applies resource limits to the command. They are set before
+// the command runs and are inherited by everything it starts. Raising a
+// limit above the agent's own needs CAP_SYS_RESOURCE.
+func WithLimits(limits Limits) ExecOption {
+	return func(c *execConfig) {
+		c.limits = limits
+	}
+}
+
+// WithPriority sets the command's nice level and I/O scheduling priority
+func WithPriority(priority Priority) ExecOption {
+	return func(c *execConfig) {
+		c.priority = priority
+	}
+}
+
+// command builds the exec.Cmd for a call. The returned context replaces ctx
+// for the call and must be released with the returned cancel function.
+func (c *execConfig) command(ctx context.Context, command string, args []string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+
+	name, argv := command, args
+	if c.shell {
+		name, argv = shellCommand(command, args)
+	}
+
+	cmd := exec.CommandContext(ctx, name, argv...)
+	cmd.Dir = c.dir
+	if len(c.env) > 0 {
+		cmd.Env = MergeEnv(os.Environ(), c.env)
+	}
+	if c.stdin != nil {
+		cmd.Stdin = strings.NewReader(*c.stdin)
+	}
+
+	return cmd, ctx, cancel
+}
+
+// prepare sets the identity, limits and priority cmd runs with, before
+// anything is started. Limits and priority are applied by starting the
+// command through the agent itself, see RunTrampoline.
+func (c *execConfig) prepare(cmd *exec.Cmd) error {
+	constrained := c.limits.isSet() || c.priority.isSet()
+	if constrained {
+		if !canConstrain {
+			return fmt.Errorf("resource limits and priority: %w", errors.ErrUnsupported)
+		}
+		if err := c.priority.Validate(); err != nil {
+			return err
+		}
+	}
+
+	var cred *credential
+	if c.user != "" || c.group != "" {
+		var err error
+		if cred, err = lookupCredential(c.user, c.group); err != nil {
+			return err
+		}
+		if env := cred.env(); env != nil {
+			// Variables set with WithEnv still win
+			for name, value := range c.env {
+				env[name] = value
+			}
+			cmd.Env = MergeEnv(os.Environ(), env)
+		}
+	}
+
+	if cmd.Err != nil {
+		// Start fails with the lookup error
+		return nil
+	}
+
+	if constrained {
+		setup, err := constrain(cmd, c.limits, c.priority, cred)
+		if err != nil {
+			return err
+		}
+		c.setup = setup
+		return nil
+	}
+
+	if cred != nil {
+		return setCredential(cmd, cred)
+	}
+	return nil
+}
+
+// start starts cmd as prepared
+func (c *execConfig) start(cmd *exec.Cmd) error {
+	if c.setup != nil {
+		return startConstrained(cmd, c.setup)
+	}
+	return cmd.Start()
+}
+
+// authorize checks cmd against a, if set
+func authorize(a Authorizer, cmd *exec.Cmd) error {
+	if a == nil || cmd.Err != nil {
+		// A binary that cannot be found fails when the command starts
+		return nil
+	}
+	return a.AuthorizeExec(cmd.Path, cmd.Args[1:])
+}
+
+// runError reports a command killed because its context ended as the
+// context's error rather than as the kill signal. Running past the timeout
+// set with WithTimeout is reported as ErrProcessTimeout.
+func (c *execConfig) runError(parent, ctx context.Context, command string, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command %s: %w after %s", command, ErrProcessTimeout, c.timeout)
+	}
+	return fmt.Errorf("command %s: %w", command, ctx.Err())
+}
+
+// shellCommand returns the invocation running script in the system shell
+func shellCommand(script string, args []string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		return "cmd", append([]string{"/C", script}, args...)
+	}
+	// The first argument after the script becomes $0
+	return "/bin/sh", append([]string{"-c", script, "sh"}, args...)
+}
+
+// MergeEnv returns base with the variables in overrides set
+func MergeEnv(base []string, overrides map[string]string) []string {
+	env := make([]string, 0, len(base)+len(overrides))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := overrides[name]; !ok {
+			env = append(env, kv)
+		}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+overrides[name])
+	}
+
+	return env
+}
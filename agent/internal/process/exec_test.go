@@ -0,0 +1,96 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// Constrained commands start through the test binary
+	RunTrampoline()
+	os.Exit(m.Run())
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	m := NewManager(zap.NewNop())
+
+	start := time.Now()
+	result, err := m.Execute(context.Background(), "sleep", []string{"10"}, WithTimeout(100*time.Millisecond))
+	require.ErrorIs(t, err, ErrProcessTimeout)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, -1, result.ExitCode)
+	require.Equal(t, "killed", result.Signal)
+
+	// The caller's own deadline is reported as such, not as a timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = m.Execute(ctx, "sleep", []string{"10"}, WithTimeout(time.Minute))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.False(t, errors.Is(err, ErrProcessTimeout))
+
+	// Finishing in time is not an error
+	result, err = m.Execute(context.Background(), "true", nil, WithTimeout(time.Minute))
+	require.NoError(t, err)
+	require.Zero(t, result.ExitCode)
+}
+
+func TestExecuteShell(t *testing.T) {
+	m := NewManager(zap.NewNop())
+
+	// Args become the script's positional parameters and $0 is the shell's
+	// name, so none of them is interpreted by the shell
+	result, err := m.Execute(context.Background(), `printf '%s|' "$0" "$#" "$@"`, []string{"a b", "$(id)", ";"}, WithShell())
+	require.NoError(t, err)
+	require.Equal(t, "sh|3|a b|$(id)|;|", result.Stdout)
+
+	result, err = m.Execute(context.Background(), "exit 3", nil, WithShell())
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, result.ExitCode)
+}
+
+func TestExecuteEnvStdinAndDir(t *testing.T) {
+	m := NewManager(zap.NewNop())
+	dir := t.TempDir()
+
+	result, err := m.Execute(context.Background(), `read line; echo "$line $GREETING $(pwd)"`, nil,
+		WithShell(), WithStdin("hello\n"), WithEnv(map[string]string{"GREETING": "world"}), WithWorkingDir(dir))
+	require.NoError(t, err)
+	require.Equal(t, "hello world "+dir+"\n", result.Stdout)
+}
+
+func TestMergeEnv(t *testing.T) {
+	base := []string{"PATH=/bin", "HOME=/root", "TERM=dumb", "EMPTY="}
+
+	env := MergeEnv(base, map[string]string{"HOME": "/home/app", "LANG": "C.UTF-8", "EMPTY": "set"})
+	require.Equal(t, []string{"PATH=/bin", "TERM=dumb", "EMPTY=set", "HOME=/home/app", "LANG=C.UTF-8"}, env)
+
+	// Values may contain '=' and overriding with nothing keeps the variable
+	env = MergeEnv(base, map[string]string{"PATH": "a=b", "TERM": ""})
+	require.Equal(t, []string{"HOME=/root", "EMPTY=", "PATH=a=b", "TERM="}, env)
+
+	require.Equal(t, base, MergeEnv(base, nil))
+}
+
+func TestPriorityValidate(t *testing.T) {
+	require.NoError(t, Priority{}.Validate())
+	require.NoError(t, Priority{Nice: -20, IOClass: IOClassRealtime, IOLevel: 7}.Validate())
+	require.NoError(t, Priority{Nice: 19, IOClass: IOClassIdle}.Validate())
+
+	for _, p := range []Priority{
+		{Nice: -21},
+		{Nice: 20},
+		{IOClass: "urgent"},
+		{IOClass: IOClassBestEffort, IOLevel: -1},
+		{IOClass: IOClassBestEffort, IOLevel: 8},
+	} {
+		require.ErrorIs(t, p.Validate(), ErrInvalidLimits, "%+v", p)
+	}
+}
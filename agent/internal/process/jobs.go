@@ -0,0 +1,490 @@
+package process
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/metrics"
+)
+
+// DefaultJobRetention is how long finished jobs and their output are kept
+const DefaultJobRetention = 24 * time.Hour
+
+// OutputPage is a slice of a job's output. Pass NextOffset as the offset of
+// the next read; Done is set once the job has finished and every line has
+// been read.
+type OutputPage struct {
+	JobID      string          `json:"job_id"`
+	Lines      []CommandOutput `json:"lines"`
+	NextOffset int64           `json:"next_offset"`
+	Done       bool            `json:"done"`
+}
+
+// JobManager runs commands in the background. Each job's output is logged
+// to disk, so callers start a job, return, and read the output in pages
+// while or after it runs.
+type JobManager struct {
+	logger    *zap.Logger
+	outputDir string
+	maxJobs   int
+	retention time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	authorizer Authorizer
+	cgroups    *CgroupSlice
+
+	mu   sync.RWMutex
+	jobs map[string]*job
+}
+
+// JobOption configures a JobManager
+type JobOption func(*JobManager)
+
+// WithJobAuthorizer makes Start refuse commands a does not authorize
+func WithJobAuthorizer(a Authorizer) JobOption {
+	return func(m *JobManager) {
+		m.authorizer = a
+	}
+}
+
+type job struct {
+	result CommandResult
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewJobManager creates a job manager that keeps output in outputDir and
+// runs at most maxJobs jobs at a time
+func NewJobManager(outputDir string, maxJobs int, logger *zap.Logger, opts ...JobOption) (*JobManager, error) {
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create job output directory: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &JobManager{
+		logger:    logger,
+		outputDir: outputDir,
+		maxJobs:   maxJobs,
+		retention: DefaultJobRetention,
+		ctx:       ctx,
+		cancel:    cancel,
+		jobs:      make(map[string]*job),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m, nil
+}
+
+// Start runs a command in the background and returns the new job. Jobs are
+// not tied to the caller's context; use Cancel to stop one. Once Shutdown
+// has been called Start returns ErrShuttingDown.
+func (m *JobManager) Start(command string, args []string) (*CommandResult, error) {
+	m.prune()
+
+	// The command authorized is the one started, so the binary it resolves
+	// to cannot change in between
+	ctx, cancel := context.WithCancel(m.ctx)
+	cmd := exec.CommandContext(ctx, command, args...)
+	if err := authorize(m.authorizer, cmd); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.ctx.Err() != nil {
+		m.mu.Unlock()
+		cancel()
+		return nil, ErrShuttingDown
+	}
+	if m.maxJobs > 0 && m.runningLocked() >= m.maxJobs {
+		m.mu.Unlock()
+		cancel()
+		return nil, fmt.Errorf("%w: %d jobs running", ErrMaxProcessesReached, m.maxJobs)
+	}
+
+	j := &job{
+		result: CommandResult{
+			ID:         id,
+			Command:    command,
+			Args:       args,
+			StartTime:  time.Now(),
+			State:      StateStarting,
+			OutputFile: OutputFile(m.outputDir, id),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.jobs[id] = j
+
+	// Counted under the lock so Shutdown either sees the job or turns it away
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	if err := m.run(ctx, j, cmd); err != nil {
+		cancel()
+		m.finish(j, -1, StateFailed, err, nil)
+		m.wg.Done()
+		return nil, NewProcessError(id, "start", err)
+	}
+
+	result := j.snapshot(&m.mu)
+	return &result, nil
+}
+
+// run starts the job's process and waits for it in the background. The job
+// is already counted in m.wg; the waiting goroutine marks it done.
+func (m *JobManager) run(ctx context.Context, j *job, cmd *exec.Cmd) error {
+	id := j.result.ID
+
+	stdout, err := NewOutputWriter(m.outputDir, id, "stdout", m.logger)
+	if err != nil {
+		return err
+	}
+	stderr, err := NewOutputWriter(m.outputDir, id, "stderr", m.logger)
+	if err != nil {
+		stdout.Close()
+		return err
+	}
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	var cgroup *Cgroup
+	if m.cgroups != nil {
+		if cgroup, err = m.cgroups.Confine(cmd, id); err != nil {
+			stdout.Close()
+			stderr.Close()
+			return err
+		}
+		// Cancelling kills everything the job started, and processes left
+		// behind holding its output don't keep it running
+		cmd.Cancel = cgroup.Kill
+		cmd.WaitDelay = cgroupWaitDelay
+	}
+
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stderr.Close()
+		if cgroup != nil {
+			cgroup.Remove()
+		}
+		return err
+	}
+	start := time.Now()
+
+	m.mu.Lock()
+	j.result.State = StateRunning
+	m.mu.Unlock()
+
+	m.logger.Info("Job started",
+		zap.String("job_id", id),
+		zap.String("command", j.result.Command),
+		zap.Int("pid", cmd.Process.Pid))
+
+	go func() {
+		defer m.wg.Done()
+
+		err := cmd.Wait()
+		wall := time.Since(start)
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// The job itself succeeded; what it left running is killed with
+			// its cgroup below
+			m.logger.Warn("Job left processes running", zap.String("job_id", id))
+			err = nil
+		}
+		for _, w := range []*OutputWriter{stdout, stderr} {
+			if closeErr := w.Close(); closeErr != nil {
+				m.logger.Warn("Failed to close job output", zap.String("job_id", id), zap.Error(closeErr))
+			}
+		}
+
+		state := StateComplete
+		switch {
+		case ctx.Err() != nil:
+			state = StateCancelled
+			err = ctx.Err()
+		case err != nil:
+			state = StateFailed
+		}
+
+		var cgroupUsage *CgroupUsage
+		if cgroup != nil {
+			usage := cgroup.Usage()
+			cgroupUsage = &usage
+			if removeErr := cgroup.Remove(); removeErr != nil {
+				m.logger.Warn("Failed to remove job cgroup", zap.String("job_id", id), zap.Error(removeErr))
+			}
+			if state == StateFailed {
+				err = oomError(err, usage)
+			}
+		}
+
+		m.finish(j, newExecuteResult(cmd, 0, nil).ExitCode, state, err, jobUsage(cmd, wall, cgroupUsage))
+	}()
+
+	return nil
+}
+
+// finish records how a job ended
+func (m *JobManager) finish(j *job, exitCode int, state CommandState, err error, usage *metrics.ProcessMetrics) {
+	m.mu.Lock()
+	j.result.EndTime = time.Now()
+	j.result.ExitCode = exitCode
+	j.result.State = state
+	j.result.ResourceUsage = usage
+	if err != nil {
+		j.result.Error = err.Error()
+	}
+	j.cancel()
+	close(j.done)
+	m.mu.Unlock()
+
+	m.logger.Info("Job finished",
+		zap.String("job_id", j.result.ID),
+		zap.String("state", string(state)),
+		zap.Int("exit_code", exitCode))
+}
+
+// jobUsage summarizes what a finished job consumed. The cgroup's counters
+// cover every process the job started; without one only the job's main
+// process and the children it waited for are counted, and I/O is unknown.
+func jobUsage(cmd *exec.Cmd, wall time.Duration, cgroup *CgroupUsage) *metrics.ProcessMetrics {
+	if cmd.ProcessState == nil {
+		return nil
+	}
+
+	state := cmd.ProcessState
+	usage := &metrics.ProcessMetrics{
+		PID:       int32(state.Pid()),
+		Name:      filepath.Base(cmd.Path),
+		MemoryRSS: uint64(maxRSS(state)),
+	}
+	cpu := state.UserTime() + state.SystemTime()
+
+	if cgroup != nil {
+		cpu = cgroup.CPUTime
+		if cgroup.MemoryPeak > 0 {
+			usage.MemoryRSS = cgroup.MemoryPeak
+		}
+		usage.ReadBytes = cgroup.ReadBytes
+		usage.WriteBytes = cgroup.WriteBytes
+		usage.OOMKills = cgroup.OOMKills
+	}
+
+	usage.CPUTime = cpu
+	if wall > 0 {
+		usage.CPUPercent = float64(cpu) / float64(wall) * 100
+	}
+
+	return usage
+}
+
+// List returns every job, most recently started first
+func (m *JobManager) List() []CommandResult {
+	m.prune()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	results := make([]CommandResult, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		results = append(results, j.result)
+	}
+	sort.Slice(results, func(i, k int) bool {
+		return results[i].StartTime.After(results[k].StartTime)
+	})
+	return results
+}
+
+// Get returns the current state of a job
+func (m *JobManager) Get(id string) (*CommandResult, error) {
+	j, err := m.job(id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := j.snapshot(&m.mu)
+	return &result, nil
+}
+
+// Cancel stops a running job. The job finishes in StateCancelled.
+func (m *JobManager) Cancel(id string) error {
+	j, err := m.job(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-j.done:
+		return NewProcessError(id, "cancel", ErrProcessNotRunning)
+	default:
+	}
+
+	j.cancel()
+	return nil
+}
+
+// Wait blocks until a job finishes or ctx is done
+func (m *JobManager) Wait(ctx context.Context, id string) (*CommandResult, error) {
+	j, err := m.job(id)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	result := j.snapshot(&m.mu)
+	return &result, nil
+}
+
+// Output reads up to limit lines of a job's output starting at byte offset
+func (m *JobManager) Output(id string, offset, limit int64) (*OutputPage, error) {
+	j, err := m.job(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check before reading, so output written just before the job ended is
+	// not skipped when reporting Done
+	finished := false
+	select {
+	case <-j.done:
+		finished = true
+	default:
+	}
+
+	lines, next, err := ReadOutputPage(j.result.OutputFile, offset, limit)
+	if errors.Is(err, ErrOutputNotFound) && !finished {
+		// Nothing written yet
+		return &OutputPage{JobID: id, NextOffset: offset}, nil
+	}
+	if err != nil {
+		return nil, NewProcessError(id, "read output", err)
+	}
+
+	page := &OutputPage{
+		JobID:      id,
+		Lines:      lines,
+		NextOffset: next,
+	}
+	if finished {
+		if info, err := os.Stat(j.result.OutputFile); err == nil && next >= info.Size() {
+			page.Done = true
+		}
+	}
+
+	return page, nil
+}
+
+// Shutdown cancels every running job and waits for them to exit
+func (m *JobManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.cancel()
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("jobs still running: %w", ctx.Err())
+	}
+}
+
+// job looks up a job by ID
+func (m *JobManager) job(id string) (*job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, NewProcessError(id, "lookup", ErrProcessNotFound)
+	}
+	return j, nil
+}
+
+// runningLocked counts unfinished jobs. Must be called with m.mu held.
+func (m *JobManager) runningLocked() int {
+	running := 0
+	for _, j := range m.jobs {
+		if j.result.State == StateStarting || j.result.State == StateRunning {
+			running++
+		}
+	}
+	return running
+}
+
+// prune forgets jobs that finished longer than the retention period ago and
+// deletes their output
+func (m *JobManager) prune() {
+	cutoff := time.Now().Add(-m.retention)
+
+	m.mu.Lock()
+	var expired []string
+	for id, j := range m.jobs {
+		if !j.result.EndTime.IsZero() && j.result.EndTime.Before(cutoff) {
+			expired = append(expired, j.result.OutputFile)
+			delete(m.jobs, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, file := range expired {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			m.logger.Warn("Failed to remove job output", zap.String("file", file), zap.Error(err))
+		}
+	}
+}
+
+// snapshot copies the job's result under mu
+func (j *job) snapshot(mu *sync.RWMutex) CommandResult {
+	mu.RLock()
+	defer mu.RUnlock()
+	return j.result
+}
+
+// newJobID returns a random job identifier
+func newJobID() (string, error) {
+	return newID("job")
+}
+
+// newID returns a random identifier starting with prefix
+func newID(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate %s ID: %w", prefix, err)
+	}
+	return prefix + "-" + hex.EncodeToString(b), nil
+}
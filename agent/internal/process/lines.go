@@ -0,0 +1,79 @@
+package process
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// MaxLineLength is the longest line a LineWriter emits; longer lines are
+// split so a single line can never exceed a protocol frame
+const MaxLineLength = 16 * 1024
+
+// LineWriter is an io.Writer that splits what is written to it into lines
+// and hands each one to emit as a CommandOutput
+type LineWriter struct {
+	stream string
+	emit   func(CommandOutput) error
+	mu     sync.Mutex
+	buf    []byte
+}
+
+// NewLineWriter creates a line writer for the named stream (stdout or stderr)
+func NewLineWriter(stream string, emit func(CommandOutput) error) *LineWriter {
+	return &LineWriter{
+		stream: stream,
+		emit:   emit,
+	}
+}
+
+// Write implements io.Writer
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 || i > MaxLineLength {
+			if len(w.buf) < MaxLineLength {
+				return len(p), nil
+			}
+			i = MaxLineLength
+		}
+
+		line := w.buf[:i]
+		rest := w.buf[i:]
+		if len(rest) > 0 && rest[0] == '\n' {
+			rest = rest[1:]
+		}
+
+		if err := w.send(line); err != nil {
+			return len(p), err
+		}
+		w.buf = append(w.buf[:0], rest...)
+	}
+}
+
+// Flush emits any trailing partial line
+func (w *LineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.send(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *LineWriter) send(line []byte) error {
+	return w.emit(CommandOutput{
+		Timestamp: time.Now(),
+		Stream:    w.stream,
+		Line:      string(bytes.TrimSuffix(line, []byte("\r"))),
+	})
+}
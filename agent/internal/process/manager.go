@@ -2,6 +2,7 @@ package process
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"sync"
@@ -55,28 +56,77 @@ type PageFaultStats struct {
 	MajorFaults uint64 `json:"major_faults"`
 }
 
+// ExecuteResult is the outcome of a command that ran. A command killed by a
+// signal has ExitCode -1 and the signal's name in Signal.
 type ExecuteResult struct {
-	ExitCode int    `json:"exit_code"`
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
+	ExitCode        int            `json:"exit_code"`
+	Signal          string         `json:"signal,omitempty"`
+	Stdout          string         `json:"stdout"`
+	Stderr          string         `json:"stderr"`
+	StdoutTruncated bool           `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool           `json:"stderr_truncated,omitempty"`
+	WallTime        time.Duration  `json:"wall_time"`
+	Usage           *ResourceUsage `json:"usage,omitempty"`
+}
+
+// ResourceUsage is what an exited command consumed. UserTime, SystemTime
+// and MaxRSS cover the command's own process and the children it waited for;
+// CPUTime and OOMKills cover everything it started when it ran in a cgroup.
+type ResourceUsage struct {
+	UserTime   time.Duration `json:"user_time"`
+	SystemTime time.Duration `json:"system_time"`
+	MaxRSS     int64         `json:"max_rss"` // Peak resident set size in bytes
+	CPUTime    time.Duration `json:"cpu_time"`
+	OOMKills   int           `json:"oom_kills,omitempty"` // Processes killed by the cgroup's memory limit
 }
 
 type Manager struct {
-	logger *zap.Logger
-	mu     sync.RWMutex
-	procs  map[int32]*process.Process
-	ctx    context.Context
-	cancel context.CancelFunc
+	logger      *zap.Logger
+	mu          sync.RWMutex
+	procs       map[int32]*process.Process
+	ctx         context.Context
+	cancel      context.CancelFunc
+	outputLimit int
+	authorizer  Authorizer
+	cgroups     *CgroupSlice
+}
+
+// ManagerOption configures a Manager
+type ManagerOption func(*Manager)
+
+// WithOutputLimit caps how many bytes of stdout and of stderr Execute keeps.
+// Output past the limit is dropped and a truncation marker appended.
+func WithOutputLimit(limit int) ManagerOption {
+	return func(m *Manager) {
+		if limit > 0 {
+			m.outputLimit = limit
+		}
+	}
 }
 
-func NewManager(logger *zap.Logger) *Manager {
+// WithAuthorizer makes Execute and ExecuteStream refuse commands a does not
+// authorize
+func WithAuthorizer(a Authorizer) ManagerOption {
+	return func(m *Manager) {
+		m.authorizer = a
+	}
+}
+
+func NewManager(logger *zap.Logger, opts ...ManagerOption) *Manager {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Manager{
-		logger: logger,
-		procs:  make(map[int32]*process.Process),
-		ctx:    ctx,
-		cancel: cancel,
+	m := &Manager{
+		logger:      logger,
+		procs:       make(map[int32]*process.Process),
+		ctx:         ctx,
+		cancel:      cancel,
+		outputLimit: DefaultOutputLimit,
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
 }
 
 func (m *Manager) Start(ctx context.Context) error {
@@ -100,28 +150,157 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-func (m *Manager) Execute(ctx context.Context, command string, args []string) (*ExecuteResult, error) {
-	cmd := exec.CommandContext(ctx, command, args...)
+// Execute runs a command to completion and returns its output. A non-zero
+// exit is returned as an *exec.ExitError alongside the result; a command
+// aborted because ctx ended returns the context's error.
+func (m *Manager) Execute(ctx context.Context, command string, args []string, opts ...ExecOption) (*ExecuteResult, error) {
+	stdout := newCappedBuffer(m.outputLimit)
+	stderr := newCappedBuffer(m.outputLimit)
+
+	config := newExecConfig(opts)
+	cmd, runCtx, cancel := config.command(ctx, command, args)
+	defer cancel()
+	if err := authorize(m.authorizer, cmd); err != nil {
+		return newExecuteResult(cmd, 0, nil), err
+	}
+	if err := config.prepare(cmd); err != nil {
+		return newExecuteResult(cmd, 0, nil), err
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	cgroupUsage, err := m.run(config, cmd)
+
+	result := newExecuteResult(cmd, time.Since(start), cgroupUsage)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.StdoutTruncated = stdout.Truncated()
+	result.StderrTruncated = stderr.Truncated()
+
+	return result, config.runError(ctx, runCtx, command, err)
+}
+
+// Authorize reports whether Execute would refuse to run the command, so
+// callers can check before committing to a response
+func (m *Manager) Authorize(command string, args []string, opts ...ExecOption) error {
+	cmd, _, cancel := newExecConfig(opts).command(context.Background(), command, args)
+	defer cancel()
+	return authorize(m.authorizer, cmd)
+}
+
+// newExecuteResult reads the exit status and resource usage of a finished
+// command, and of its cgroup if it ran in one. Commands that never started
+// have exit code -1.
+func newExecuteResult(cmd *exec.Cmd, wallTime time.Duration, cgroup *CgroupUsage) *ExecuteResult {
+	result := &ExecuteResult{
+		ExitCode: -1,
+		WallTime: wallTime,
+	}
+
+	state := cmd.ProcessState
+	if state == nil {
+		return result
+	}
+
+	result.ExitCode = state.ExitCode()
+	result.Signal = exitSignal(state)
+	result.Usage = &ResourceUsage{
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+		MaxRSS:     maxRSS(state),
+		CPUTime:    state.UserTime() + state.SystemTime(),
+	}
+	if cgroup != nil {
+		result.Usage.CPUTime = cgroup.CPUTime
+		result.Usage.OOMKills = cgroup.OOMKills
+	}
+
+	return result
+}
+
+// ExecuteStream runs a command and passes each line of stdout and stderr to
+// emit as it is produced. Calls to emit are serialized; an error from emit
+// aborts the command.
+func (m *Manager) ExecuteStream(ctx context.Context, command string, args []string, emit func(CommandOutput) error, opts ...ExecOption) (*ExecuteResult, error) {
+	var mu sync.Mutex
+	serialized := func(output CommandOutput) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return emit(output)
+	}
+
+	stdout := NewLineWriter("stdout", serialized)
+	stderr := NewLineWriter("stderr", serialized)
+
+	config := newExecConfig(opts)
+	cmd, runCtx, cancel := config.command(ctx, command, args)
+	defer cancel()
+	if err := authorize(m.authorizer, cmd); err != nil {
+		return newExecuteResult(cmd, 0, nil), err
+	}
+	if err := config.prepare(cmd); err != nil {
+		return newExecuteResult(cmd, 0, nil), err
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	cgroupUsage, err := m.run(config, cmd)
+	if flushErr := stdout.Flush(); err == nil {
+		err = flushErr
+	}
+	if flushErr := stderr.Flush(); err == nil {
+		err = flushErr
+	}
+
+	return newExecuteResult(cmd, time.Since(start), cgroupUsage), config.runError(ctx, runCtx, command, err)
+}
+
+// run starts cmd as config prepared it and waits for it. With cgroups, the
+// command and everything it starts run in a cgroup of their own, and what
+// they consumed is returned.
+func (m *Manager) run(config *execConfig, cmd *exec.Cmd) (*CgroupUsage, error) {
+	if m.cgroups == nil {
+		if err := config.start(cmd); err != nil {
+			return nil, err
+		}
+		return nil, cmd.Wait()
+	}
 
-	// Capture stdout and stderr
-	stdout, err := cmd.Output()
+	name, err := newID("exec")
+	if err != nil {
+		return nil, err
+	}
+	cgroup, err := m.cgroups.Confine(cmd, name)
 	if err != nil {
-		var stderr string
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			stderr = string(exitErr.Stderr)
+		return nil, err
+	}
+	defer func() {
+		if err := cgroup.Remove(); err != nil {
+			m.logger.Warn("Failed to remove command cgroup", zap.String("cgroup", name), zap.Error(err))
 		}
-		return &ExecuteResult{
-			ExitCode: 1,
-			Stdout:   string(stdout),
-			Stderr:   stderr,
-		}, err
-	}
-
-	return &ExecuteResult{
-		ExitCode: 0,
-		Stdout:   string(stdout),
-		Stderr:   "",
-	}, nil
+	}()
+	// Cancelling kills everything the command started, and processes left
+	// behind holding its output don't keep it running
+	cmd.Cancel = cgroup.Kill
+	cmd.WaitDelay = cgroupWaitDelay
+
+	if err := config.start(cmd); err != nil {
+		return nil, err
+	}
+	err = cmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The command itself succeeded; what it left running is killed
+		// with its cgroup
+		err = nil
+	}
+
+	usage := cgroup.Usage()
+	if err != nil {
+		err = oomError(err, usage)
+	}
+	return &usage, err
 }
 
 func (m *Manager) updateProcessList() error {
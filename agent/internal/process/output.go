@@ -0,0 +1,57 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// DefaultOutputLimit is how much of each output stream Execute keeps when no
+// limit is configured
+const DefaultOutputLimit = 1024 * 1024
+
+// cappedBuffer keeps the first limit bytes written to it and counts the rest
+type cappedBuffer struct {
+	mu      sync.Mutex
+	limit   int
+	buf     bytes.Buffer
+	dropped int64
+}
+
+func newCappedBuffer(limit int) *cappedBuffer {
+	return &cappedBuffer{limit: limit}
+}
+
+// Write implements io.Writer. It never fails, so a chatty command is not
+// killed by a broken pipe once the limit is reached.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keep := len(p)
+	if room := b.limit - b.buf.Len(); keep > room {
+		keep = room
+	}
+	b.buf.Write(p[:keep])
+	b.dropped += int64(len(p) - keep)
+
+	return len(p), nil
+}
+
+// Truncated reports whether any output was dropped
+func (b *cappedBuffer) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped > 0
+}
+
+// String returns the kept output, followed by a marker if any was dropped
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.dropped == 0 {
+		return b.buf.String()
+	}
+	return fmt.Sprintf("%s\n[output truncated: %d bytes dropped]\n", b.buf.String(), b.dropped)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package process
+
+import "os"
+
+// maxRSS is not available on this platform
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
+
+// exitSignal is not available on this platform
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
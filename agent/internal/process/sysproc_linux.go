@@ -0,0 +1,228 @@
+//go:build linux
+
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set arguments, from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// ioClasses maps the IOClass constants to kernel class numbers
+var ioClasses = map[string]int{
+	IOClassRealtime:   1,
+	IOClassBestEffort: 2,
+	IOClassIdle:       3,
+}
+
+// canConstrain reports whether constrain is supported on this platform
+const canConstrain = true
+
+// trampolineArg marks an agent re-executed by constrain. It is followed by
+// the constraints as JSON, the command's path and its argv.
+const trampolineArg = "__shh_constrain"
+
+// constraints are applied by the trampoline to itself before it execs the
+// command, so they are in place before the command runs any code
+type constraints struct {
+	Limits     Limits      `json:"limits"`
+	Priority   Priority    `json:"priority"`
+	Credential *credential `json:"credential,omitempty"`
+	ErrorFD    int         `json:"error_fd"`
+}
+
+// setupError is a failure reported by the trampoline
+type setupError struct {
+	Message string        `json:"message"`
+	Errno   syscall.Errno `json:"errno,omitempty"`
+}
+
+func (e *setupError) Error() string {
+	return e.Message
+}
+
+func (e *setupError) Unwrap() error {
+	if e.Errno == 0 {
+		return nil
+	}
+	return e.Errno
+}
+
+// setCredential makes cmd run as cred
+func setCredential(cmd *exec.Cmd, cred *credential) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    cred.UID,
+		Gid:    cred.GID,
+		Groups: cred.Groups,
+	}
+	return nil
+}
+
+// constrain makes cmd start through a re-exec of the agent, which applies
+// limits and priority to itself, switches to cred if set, and then execs the
+// command in its place. The returned pipe carries any setup failure and must
+// be passed to startConstrained.
+func constrain(cmd *exec.Cmd, limits Limits, priority Priority, cred *credential) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe: %w", err)
+	}
+
+	spec, err := json.Marshal(constraints{
+		Limits:     limits,
+		Priority:   priority,
+		Credential: cred,
+		ErrorFD:    3 + len(cmd.ExtraFiles),
+	})
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, fmt.Errorf("failed to marshal constraints: %w", err)
+	}
+
+	cmd.Args = append([]string{os.Args[0], trampolineArg, string(spec), cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+
+	return r, nil
+}
+
+// startConstrained starts a command rewritten by constrain and waits until
+// it has exec'd. A command whose setup failed is reaped and never started.
+func startConstrained(cmd *exec.Cmd, setup *os.File) error {
+	defer setup.Close()
+
+	err := cmd.Start()
+	// The trampoline holds the only other write end now
+	cmd.ExtraFiles[len(cmd.ExtraFiles)-1].Close()
+	if err != nil {
+		return err
+	}
+
+	report, err := io.ReadAll(setup)
+	if err != nil || len(report) == 0 {
+		// Closed on exec
+		return err
+	}
+
+	cmd.Wait()
+	cmd.ProcessState = nil
+
+	var setupErr setupError
+	if err := json.Unmarshal(report, &setupErr); err != nil {
+		return fmt.Errorf("command setup failed: %s", report)
+	}
+	return &setupErr
+}
+
+// RunTrampoline completes the start of a command with limits, a priority or
+// a user applied through constrain. It must be the first thing main calls;
+// in any process that is not such a re-exec it returns immediately.
+func RunTrampoline() {
+	if len(os.Args) < 5 || os.Args[1] != trampolineArg {
+		return
+	}
+
+	// Nice and I/O priority belong to a thread, and exec keeps the calling
+	// one's
+	runtime.LockOSThread()
+
+	var c constraints
+	if err := json.Unmarshal([]byte(os.Args[2]), &c); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid constraints: %v\n", err)
+		os.Exit(127)
+	}
+
+	report := os.NewFile(uintptr(c.ErrorFD), "setup")
+	syscall.CloseOnExec(c.ErrorFD)
+
+	err := c.apply()
+	if err == nil {
+		err = syscall.Exec(os.Args[3], os.Args[4:], os.Environ())
+		err = fmt.Errorf("failed to run %s: %w", os.Args[3], err)
+	}
+
+	setupErr := setupError{Message: err.Error()}
+	errors.As(err, &setupErr.Errno)
+	data, _ := json.Marshal(setupErr)
+	report.Write(data)
+	os.Exit(127)
+}
+
+// apply sets the limits and priority of the calling process and thread, then
+// switches to the credential. Limits are set while still privileged, and
+// lowering them never needs to be.
+func (c constraints) apply() error {
+	for _, limit := range []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"cpu_seconds", unix.RLIMIT_CPU, c.Limits.CPUSeconds},
+		{"address_space", unix.RLIMIT_AS, c.Limits.AddressSpace},
+		{"open_files", unix.RLIMIT_NOFILE, c.Limits.OpenFiles},
+		{"processes", unix.RLIMIT_NPROC, c.Limits.Processes},
+	} {
+		if limit.value == 0 {
+			continue
+		}
+		rlimit := syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		if limit.resource == unix.RLIMIT_CPU {
+			// Leave a second between the soft and hard limit so the
+			// command gets SIGXCPU before it is killed
+			rlimit.Max++
+		}
+		// syscall's Setrlimit, unlike x/sys, stops exec from restoring the
+		// open files limit the Go runtime raised at startup
+		if err := syscall.Setrlimit(limit.resource, &rlimit); err != nil {
+			return fmt.Errorf("failed to set %s limit: %w", limit.name, err)
+		}
+	}
+
+	if c.Priority.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, c.Priority.Nice); err != nil {
+			return fmt.Errorf("failed to set nice level: %w", err)
+		}
+	}
+
+	if c.Priority.IOClass != "" {
+		ioprio := ioClasses[c.Priority.IOClass]<<ioprioClassShift | c.Priority.IOLevel
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio)); errno != 0 {
+			return fmt.Errorf("failed to set I/O priority: %w", errno)
+		}
+	}
+
+	if cred := c.Credential; cred != nil {
+		groups := make([]int, len(cred.Groups))
+		for i, gid := range cred.Groups {
+			groups[i] = int(gid)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("failed to set groups: %w", err)
+		}
+		if err := syscall.Setgid(int(cred.GID)); err != nil {
+			return fmt.Errorf("failed to set group: %w", err)
+		}
+		if err := syscall.Setuid(int(cred.UID)); err != nil {
+			return fmt.Errorf("failed to set user: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package process
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestExecuteLimitsAndPriority(t *testing.T) {
+	m := NewManager(zap.NewNop())
+
+	// The shell reports the limits it was started with, so they were in
+	// place before the command ran
+	result, err := m.Execute(context.Background(), `ulimit -n; ulimit -t; nice; echo "$0 $1"`, []string{"arg"},
+		WithShell(),
+		WithLimits(Limits{OpenFiles: 64, CPUSeconds: 30}),
+		WithPriority(Priority{Nice: 5, IOClass: IOClassIdle}))
+	require.NoError(t, err)
+	require.Equal(t, "64\n30\n5\nsh arg\n", result.Stdout)
+
+	// Children inherit both
+	result, err = m.Execute(context.Background(), "sh", []string{"-c", "ulimit -n; nice"},
+		WithLimits(Limits{OpenFiles: 32}), WithPriority(Priority{Nice: 3}))
+	require.NoError(t, err)
+	require.Equal(t, "32\n3\n", result.Stdout)
+}
+
+func TestExecuteConstrainedSetupFailure(t *testing.T) {
+	m := NewManager(zap.NewNop())
+
+	// A command that cannot be exec'd is reported as such and never ran
+	script := filepath.Join(t.TempDir(), "script")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho ran\n"), 0644))
+
+	result, err := m.Execute(context.Background(), script, nil, WithLimits(Limits{OpenFiles: 64}))
+	require.ErrorIs(t, err, os.ErrPermission)
+	require.Equal(t, -1, result.ExitCode)
+	require.Empty(t, result.Stdout)
+
+	_, err = m.Execute(context.Background(), "true", nil, WithPriority(Priority{Nice: 40}))
+	require.ErrorIs(t, err, ErrInvalidLimits)
+}
+
+func TestExecuteAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	m := NewManager(zap.NewNop())
+	for _, opts := range [][]ExecOption{
+		{WithUser("nobody", "")},
+		{WithUser("nobody", ""), WithLimits(Limits{OpenFiles: 64})},
+	} {
+		result, err := m.Execute(context.Background(), `echo "$(id -u) $(id -g) $HOME $USER $LOGNAME $EXTRA"`, nil,
+			append(opts, WithShell(), WithEnv(map[string]string{"LOGNAME": "override", "EXTRA": "x"}))...)
+		require.NoError(t, err)
+		require.Equal(t, nobody.Uid+" "+nobody.Gid+" "+nobody.HomeDir+" nobody override x\n", result.Stdout)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// canConstrain reports whether constrain is supported on this platform
+const canConstrain = false
+
+// setCredential is not supported on this platform
+func setCredential(cmd *exec.Cmd, cred *credential) error {
+	return fmt.Errorf("running as another user: %w", errors.ErrUnsupported)
+}
+
+// constrain is not supported on this platform
+func constrain(cmd *exec.Cmd, limits Limits, priority Priority, cred *credential) (*os.File, error) {
+	return nil, fmt.Errorf("resource limits and priority: %w", errors.ErrUnsupported)
+}
+
+// startConstrained is not supported on this platform
+func startConstrained(cmd *exec.Cmd, setup *os.File) error {
+	return fmt.Errorf("resource limits and priority: %w", errors.ErrUnsupported)
+}
+
+// RunTrampoline does nothing on this platform, where commands cannot be
+// constrained
+func RunTrampoline() {}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CodecCBOR is the compact binary codec. Message fields are encoded as CBOR
+// under their JSON names; Payload stays an opaque byte string so signatures
+// over the JSON payload remain valid.
+const CodecCBOR = "cbor"
+
+// Codec encodes and decodes messages for the wire
+type Codec interface {
+	// Name is the identifier negotiated in RegisterPayload.Codecs
+	Name() string
+
+	// Binary reports whether encoded messages are sent as binary frames
+	Binary() bool
+
+	Marshal(msg Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+}
+
+// JSON is the text codec every agent and server supports
+var JSON Codec = jsonCodec{}
+
+// CBOR encodes messages as CBOR
+var CBOR Codec = newCBORCodec()
+
+// codecs lists the supported codecs by name
+var codecs = map[string]Codec{
+	CodecJSON: JSON,
+	CodecCBOR: CBOR,
+}
+
+// LookupCodec returns the codec with the given name
+func LookupCodec(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q", name)
+	}
+	return codec, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Marshal(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	// Timestamps keep nanosecond precision so signed messages verify
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(fmt.Sprintf("invalid CBOR encoding options: %v", err))
+	}
+	dec, err := cbor.DecOptions{}.DecMode()
+	if err != nil {
+		panic(fmt.Sprintf("invalid CBOR decoding options: %v", err))
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string { return CodecCBOR }
+func (cborCodec) Binary() bool { return true }
+
+func (c cborCodec) Marshal(msg Message) ([]byte, error) {
+	return c.enc.Marshal(msg)
+}
+
+func (c cborCodec) Unmarshal(data []byte, msg *Message) error {
+	return c.dec.Unmarshal(data, msg)
+}
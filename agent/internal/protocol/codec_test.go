@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	msg := Message{
+		Type:          TypeCommand,
+		ID:            "cmd-1",
+		CorrelationID: "req-1",
+		Timestamp:     time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+		Payload:       json.RawMessage(`{"command":"uptime","args":["-p"]}`),
+	}
+
+	for _, name := range []string{CodecJSON, CodecCBOR} {
+		codec, err := LookupCodec(name)
+		require.NoError(t, err)
+		require.Equal(t, name, codec.Name())
+
+		data, err := codec.Marshal(msg)
+		require.NoError(t, err)
+
+		var decoded Message
+		require.NoError(t, codec.Unmarshal(data, &decoded))
+		require.True(t, msg.Timestamp.Equal(decoded.Timestamp), name)
+
+		// The payload comes back byte for byte, so signatures over it still hold
+		require.Equal(t, string(msg.Payload), string(decoded.Payload), name)
+
+		decoded.Timestamp = msg.Timestamp
+		require.Equal(t, msg, decoded, name)
+	}
+
+	require.False(t, JSON.Binary())
+	require.True(t, CBOR.Binary())
+}
+
+func TestLookupUnknownCodec(t *testing.T) {
+	_, err := LookupCodec("msgpack")
+	require.ErrorContains(t, err, "msgpack")
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// ErrorCode is a stable identifier for a class of command failure. Servers
+// can rely on codes; messages are for people and may change.
+type ErrorCode string
+
+const (
+	CodeInvalidPayload   ErrorCode = "invalid_payload"
+	CodeInvalidArgument  ErrorCode = "invalid_argument"
+	CodeUnsupported      ErrorCode = "unsupported"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeAlreadyExists    ErrorCode = "already_exists"
+	CodeConflict         ErrorCode = "conflict"
+	CodeLimitReached     ErrorCode = "limit_reached"
+	CodeNotRunning       ErrorCode = "not_running"
+	CodeInvalidState     ErrorCode = "invalid_state"
+	CodeTimeout          ErrorCode = "timeout"
+	CodeCancelled        ErrorCode = "cancelled"
+	CodePermissionDenied ErrorCode = "permission_denied"
+	CodeUnavailable      ErrorCode = "unavailable"
+	CodeInternal         ErrorCode = "internal"
+)
+
+// ErrorResult is the structured description of a failed command, sent in
+// the terminal ResultPayload or final ResultChunk
+type ErrorResult struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ErrorResult) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// ErrorClassifier maps errors from outside this package to codes. It
+// returns an empty code for errors it does not recognise.
+type ErrorClassifier func(error) ErrorCode
+
+// NewErrorResult describes err with the code of the first class it matches.
+// The classifiers are consulted in order before the classes ErrorCodeFor
+// knows about.
+func NewErrorResult(err error, classifiers ...ErrorClassifier) *ErrorResult {
+	var result *ErrorResult
+	if errors.As(err, &result) {
+		return result
+	}
+
+	code := ErrorCode("")
+	for _, classify := range classifiers {
+		if code = classify(err); code != "" {
+			break
+		}
+	}
+	if code == "" {
+		code = ErrorCodeFor(err)
+	}
+
+	return &ErrorResult{
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+// ErrorCodeFor maps err to an error code. Payload errors, context errors and
+// the standard library's not found, permission and unsupported errors are
+// recognised anywhere in the wrap chain; anything else is CodeInternal.
+func ErrorCodeFor(err error) ErrorCode {
+	var payloadErr *PayloadError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &payloadErr):
+		return CodeInvalidPayload
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, context.Canceled):
+		return CodeCancelled
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return CodeNotFound
+	case errors.Is(err, os.ErrPermission):
+		return CodePermissionDenied
+	case errors.Is(err, errors.ErrUnsupported):
+		return CodeUnsupported
+	default:
+		return CodeInternal
+	}
+}
@@ -10,29 +10,62 @@ import (
 // MessageType represents the type of message being sent
 type MessageType string
 
+// Protocol versions understood by this agent. Version 1 is the original
+// unacknowledged registration; version 2 adds the register handshake.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// CodecJSON is the text codec every agent and server supports
+const CodecJSON = "json"
+
 // Protocol message types
 const (
 	// Server -> Agent messages
-	TypeCommand  MessageType = "command"
-	TypeConfig   MessageType = "config"
-	TypeUpdate   MessageType = "update"
-	TypeMetrics  MessageType = "metrics"
-	TypeLogs     MessageType = "logs"
-	TypeResponse MessageType = "response"
+	TypeCommand     MessageType = "command"
+	TypeConfig      MessageType = "config"
+	TypeUpdate      MessageType = "update"
+	TypeMetrics     MessageType = "metrics"
+	TypeLogs        MessageType = "logs"
+	TypeResponse    MessageType = "response"
+	TypeRegistered  MessageType = "registered"
+	TypeCancel      MessageType = "cancel"
+	TypeResultAck   MessageType = "result_ack"
+	TypeCredentials MessageType = "credentials"
+
+	// Terminal sessions. Input, resize and close are handled in the order
+	// they arrive.
+	TypeSessionOpen   MessageType = "session_open"
+	TypeSessionInput  MessageType = "session_input"
+	TypeSessionResize MessageType = "session_resize"
+	TypeSessionClose  MessageType = "session_close"
 
 	// Agent -> Server messages
-	TypeRegister  MessageType = "register"
-	TypeHeartbeat MessageType = "heartbeat"
-	TypeResult    MessageType = "result"
+	TypeRegister    MessageType = "register"
+	TypeHeartbeat   MessageType = "heartbeat"
+	TypeResult      MessageType = "result"
+	TypeResultChunk MessageType = "result_chunk"
+	TypeRejected    MessageType = "rejected"
+
+	TypeSessionOutput MessageType = "session_output"
+	TypeSessionExit   MessageType = "session_exit"
 )
 
 // Message represents a protocol message between agent and server
 type Message struct {
-	Type      MessageType     `json:"type"`
-	ID        string         `json:"id"`
-	Timestamp time.Time      `json:"timestamp"`
-	Payload   json.RawMessage `json:"payload"`
+	Type          MessageType     `json:"type"`
+	ID            string          `json:"id"`
+	CorrelationID string          `json:"correlation_id,omitempty"` // ID of the request this message answers
+	Timestamp     time.Time       `json:"timestamp"`
+	Payload       json.RawMessage `json:"payload"`
+	Nonce         string          `json:"nonce,omitempty"`     // Unique per signed message, for replay protection
+	Signature     string          `json:"signature,omitempty"` // "<algorithm>:<base64 signature>"
 }
 
 // MessageHandler is a function that handles a specific type of message
 type MessageHandler func(ctx context.Context, msg Message) error
+
+// RequestHandler handles a message that expects a reply. The returned value
+// is sent back as the data of an AgentResponse correlated to the request.
+type RequestHandler func(ctx context.Context, msg Message) (interface{}, error)
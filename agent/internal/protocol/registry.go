@@ -0,0 +1,277 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownPayload indicates no payload type is registered for a message type or command
+	ErrUnknownPayload = errors.New("no payload type registered")
+
+	// ErrMalformedPayload indicates a payload that is not valid JSON for its type
+	ErrMalformedPayload = errors.New("malformed payload")
+
+	// ErrInvalidPayload indicates a payload that decoded but failed validation
+	ErrInvalidPayload = errors.New("invalid payload")
+)
+
+// Validator is implemented by payloads that check their own fields after decoding
+type Validator interface {
+	Validate() error
+}
+
+// FieldError reports the payload field that failed validation
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// missing returns a FieldError for a required field that is empty
+func missing(field string) error {
+	return &FieldError{Field: field, Reason: "is required"}
+}
+
+// PayloadError describes a message whose payload could not be decoded or
+// failed validation. Err wraps ErrMalformedPayload or ErrInvalidPayload, and
+// a *FieldError when the failure is tied to one field.
+type PayloadError struct {
+	Type    MessageType
+	Command string
+	Err     error
+}
+
+func (e *PayloadError) Error() string {
+	if e.Command != "" {
+		return fmt.Sprintf("%s %s payload: %v", e.Type, e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s payload: %v", e.Type, e.Err)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
+
+// Field returns the name of the offending field, if known
+func (e *PayloadError) Field() string {
+	var fieldErr *FieldError
+	if errors.As(e.Err, &fieldErr) {
+		return fieldErr.Field
+	}
+	return ""
+}
+
+// Registry maps message types, and command names within TypeCommand, to the
+// Go types of their payloads
+type Registry struct {
+	mu       sync.RWMutex
+	types    map[MessageType]reflect.Type
+	commands map[string]reflect.Type
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		types:    make(map[MessageType]reflect.Type),
+		commands: make(map[string]reflect.Type),
+	}
+}
+
+// DefaultRegistry holds the payload types of the built-in server messages
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.Register(TypeCommand, AgentCommand{})
+	DefaultRegistry.Register(TypeConfig, AgentConfig{})
+	DefaultRegistry.Register(TypeUpdate, AgentUpdate{})
+	DefaultRegistry.Register(TypeRegistered, RegisterAck{})
+	DefaultRegistry.Register(TypeCancel, CancelPayload{})
+	DefaultRegistry.Register(TypeResultAck, ResultAck{})
+	DefaultRegistry.Register(TypeCredentials, AgentCredentials{})
+	DefaultRegistry.Register(TypeSessionOpen, SessionOpen{})
+	DefaultRegistry.Register(TypeSessionInput, SessionInput{})
+	DefaultRegistry.Register(TypeSessionResize, SessionResize{})
+	DefaultRegistry.Register(TypeSessionClose, SessionClose{})
+
+	DefaultRegistry.RegisterCommand("job:start", JobStartParams{})
+	DefaultRegistry.RegisterCommand("job:status", JobParams{})
+	DefaultRegistry.RegisterCommand("job:cancel", JobParams{})
+	DefaultRegistry.RegisterCommand("job:output", JobOutputParams{})
+}
+
+// Register sets the payload type of messages of type t to the type of sample
+func (r *Registry) Register(t MessageType, sample interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[t] = payloadType(sample)
+}
+
+// RegisterCommand sets the type of AgentCommand.Params for the named command
+func (r *Registry) RegisterCommand(name string, sample interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[name] = payloadType(sample)
+}
+
+func payloadType(sample interface{}) reflect.Type {
+	t := reflect.TypeOf(sample)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Decode returns a pointer to the registered payload type of msg, filled
+// from its payload and validated
+func (r *Registry) Decode(msg Message) (interface{}, error) {
+	r.mu.RLock()
+	t, ok := r.types[msg.Type]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, &PayloadError{Type: msg.Type, Err: ErrUnknownPayload}
+	}
+
+	v := reflect.New(t).Interface()
+	if err := decodeInto(msg.Payload, v); err != nil {
+		return nil, &PayloadError{Type: msg.Type, Err: err}
+	}
+
+	return v, nil
+}
+
+// DecodeParams returns a pointer to the registered params type of cmd,
+// filled from cmd.Params and validated
+func (r *Registry) DecodeParams(cmd AgentCommand) (interface{}, error) {
+	r.mu.RLock()
+	t, ok := r.commands[cmd.Command]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, &PayloadError{Type: TypeCommand, Command: cmd.Command, Err: ErrUnknownPayload}
+	}
+
+	v := reflect.New(t).Interface()
+	if err := decodeInto(cmd.Params, v); err != nil {
+		return nil, &PayloadError{Type: TypeCommand, Command: cmd.Command, Err: err}
+	}
+
+	return v, nil
+}
+
+// Validate checks that msg decodes to its registered payload type, and for
+// commands with registered params, that the params do too. Messages of
+// unregistered types pass unchecked.
+func (r *Registry) Validate(msg Message) error {
+	v, err := r.Decode(msg)
+	if errors.Is(err, ErrUnknownPayload) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd, ok := v.(*AgentCommand)
+	if !ok {
+		return nil
+	}
+
+	if _, err := r.DecodeParams(*cmd); err != nil && !errors.Is(err, ErrUnknownPayload) {
+		return err
+	}
+	return nil
+}
+
+// decodeInto unmarshals data into v and runs its Validate method
+func decodeInto(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		data = json.RawMessage("{}")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return fmt.Errorf("%w: %w", ErrMalformedPayload,
+				&FieldError{Field: typeErr.Field, Reason: "must be " + typeErr.Type.String()})
+		}
+		return fmt.Errorf("%w: %v", ErrMalformedPayload, err)
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+		}
+	}
+
+	return nil
+}
+
+// DecodePayload unmarshals and validates the payload of msg as a T
+func DecodePayload[T any](msg Message) (T, error) {
+	var payload T
+	if err := decodeInto(msg.Payload, &payload); err != nil {
+		return payload, &PayloadError{Type: msg.Type, Err: err}
+	}
+	return payload, nil
+}
+
+// DecodeParams unmarshals and validates the params of cmd as a T
+func DecodeParams[T any](cmd AgentCommand) (T, error) {
+	var params T
+	if err := decodeInto(cmd.Params, &params); err != nil {
+		return params, &PayloadError{Type: TypeCommand, Command: cmd.Command, Err: err}
+	}
+	return params, nil
+}
+
+// EncodePayload validates payload and builds a message carrying it
+func EncodePayload(t MessageType, id string, payload interface{}) (Message, error) {
+	if validator, ok := payload.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return Message{}, &PayloadError{Type: t, Err: fmt.Errorf("%w: %w", ErrInvalidPayload, err)}
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to marshal %s payload: %w", t, err)
+	}
+
+	return Message{
+		Type:      t,
+		ID:        id,
+		Timestamp: time.Now(),
+		Payload:   data,
+	}, nil
+}
+
+// Handle adapts a handler taking a typed payload to a MessageHandler
+func Handle[T any](fn func(ctx context.Context, msg Message, payload T) error) MessageHandler {
+	return func(ctx context.Context, msg Message) error {
+		payload, err := DecodePayload[T](msg)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, msg, payload)
+	}
+}
+
+// HandleRequest adapts a request handler taking a typed payload to a RequestHandler
+func HandleRequest[T any](fn func(ctx context.Context, msg Message, payload T) (interface{}, error)) RequestHandler {
+	return func(ctx context.Context, msg Message) (interface{}, error) {
+		payload, err := DecodePayload[T](msg)
+		if err != nil {
+			return nil, err
+		}
+		return fn(ctx, msg, payload)
+	}
+}
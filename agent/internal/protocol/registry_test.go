@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type restartParams struct {
+	Service string `json:"service"`
+	Timeout int    `json:"timeout"`
+}
+
+func (p restartParams) Validate() error {
+	if p.Service == "" {
+		return missing("service")
+	}
+	return nil
+}
+
+func message(t MessageType, payload string) Message {
+	return Message{Type: t, ID: "msg-1", Payload: json.RawMessage(payload)}
+}
+
+func requirePayloadError(t *testing.T, err error, kind error, field string) {
+	t.Helper()
+
+	var payloadErr *PayloadError
+	require.True(t, errors.As(err, &payloadErr), "not a PayloadError: %v", err)
+	require.ErrorIs(t, err, kind)
+	require.Equal(t, field, payloadErr.Field())
+}
+
+func TestRegistryDecode(t *testing.T) {
+	v, err := DefaultRegistry.Decode(message(TypeCancel, `{"id":"cmd-1","reason":"timeout"}`))
+	require.NoError(t, err)
+	require.Equal(t, &CancelPayload{ID: "cmd-1", Reason: "timeout"}, v)
+
+	_, err = DefaultRegistry.Decode(message(TypeCancel, `{"reason":"timeout"}`))
+	requirePayloadError(t, err, ErrInvalidPayload, "id")
+
+	_, err = DefaultRegistry.Decode(message(TypeCancel, `{"id":42}`))
+	requirePayloadError(t, err, ErrMalformedPayload, "id")
+
+	_, err = DefaultRegistry.Decode(message(TypeCancel, `{"id":`))
+	requirePayloadError(t, err, ErrMalformedPayload, "")
+
+	// A missing payload decodes as an empty object, so required fields still fail
+	_, err = DefaultRegistry.Decode(Message{Type: TypeUpdate})
+	requirePayloadError(t, err, ErrInvalidPayload, "version")
+
+	_, err = DefaultRegistry.Decode(message("unknown", `{}`))
+	require.ErrorIs(t, err, ErrUnknownPayload)
+}
+
+func TestRegistryValidate(t *testing.T) {
+	r := NewRegistry()
+	r.Register(TypeCommand, AgentCommand{})
+	r.RegisterCommand("restart", &restartParams{})
+
+	// Unregistered message types and commands pass unchecked
+	require.NoError(t, r.Validate(message(TypeConfig, `not json`)))
+	require.NoError(t, r.Validate(message(TypeCommand, `{"command":"uptime","params":{"anything":1}}`)))
+
+	require.NoError(t, r.Validate(message(TypeCommand, `{"command":"restart","params":{"service":"nginx"}}`)))
+
+	err := r.Validate(message(TypeCommand, `{"args":["-a"]}`))
+	requirePayloadError(t, err, ErrInvalidPayload, "command")
+
+	err = r.Validate(message(TypeCommand, `{"command":"restart","params":{"timeout":5}}`))
+	requirePayloadError(t, err, ErrInvalidPayload, "service")
+	require.Contains(t, err.Error(), "command restart payload")
+
+	err = r.Validate(message(TypeCommand, `{"command":"restart","params":{"service":"nginx","timeout":"5s"}}`))
+	requirePayloadError(t, err, ErrMalformedPayload, "timeout")
+
+	params, err := r.DecodeParams(AgentCommand{Command: "restart", Params: json.RawMessage(`{"service":"nginx","timeout":5}`)})
+	require.NoError(t, err)
+	require.Equal(t, &restartParams{Service: "nginx", Timeout: 5}, params)
+}
+
+func TestEncodePayloadValidates(t *testing.T) {
+	msg, err := EncodePayload(TypeResultAck, "ack-1", ResultAck{CommandID: "cmd-1", Seq: 3})
+	require.NoError(t, err)
+	require.Equal(t, TypeResultAck, msg.Type)
+	require.Equal(t, "ack-1", msg.ID)
+	require.False(t, msg.Timestamp.IsZero())
+
+	ack, err := DecodePayload[ResultAck](msg)
+	require.NoError(t, err)
+	require.Equal(t, ResultAck{CommandID: "cmd-1", Seq: 3}, ack)
+
+	_, err = EncodePayload(TypeResultAck, "ack-2", ResultAck{Seq: 3})
+	requirePayloadError(t, err, ErrInvalidPayload, "command_id")
+}
+
+func TestHandleDecodesTypedPayload(t *testing.T) {
+	var got CancelPayload
+	handler := Handle(func(ctx context.Context, msg Message, payload CancelPayload) error {
+		got = payload
+		return nil
+	})
+
+	require.NoError(t, handler(context.Background(), message(TypeCancel, `{"id":"cmd-1"}`)))
+	require.Equal(t, "cmd-1", got.ID)
+
+	err := handler(context.Background(), message(TypeCancel, `{}`))
+	requirePayloadError(t, err, ErrInvalidPayload, "id")
+
+	request := HandleRequest(func(ctx context.Context, msg Message, cmd AgentCommand) (interface{}, error) {
+		return DecodeParams[restartParams](cmd)
+	})
+
+	data, err := request(context.Background(), message(TypeCommand, `{"command":"restart","params":{"service":"nginx"}}`))
+	require.NoError(t, err)
+	require.Equal(t, restartParams{Service: "nginx"}, data)
+
+	_, err = request(context.Background(), message(TypeCommand, `{"command":"restart","params":{}}`))
+	requirePayloadError(t, err, ErrInvalidPayload, "service")
+}
@@ -2,41 +2,253 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
 // AgentInfo contains information about the agent
 type AgentInfo struct {
-	ID          string            `json:"id"`
-	Version     string            `json:"version"`
-	Hostname    string            `json:"hostname"`
-	Platform    string            `json:"platform"`
-	OS          string            `json:"os"`
-	Arch        string            `json:"arch"`
-	Labels      map[string]string `json:"labels,omitempty"`
-	Features    []string          `json:"features,omitempty"`
+	ID       string            `json:"id"`
+	Version  string            `json:"version"`
+	Hostname string            `json:"hostname"`
+	Platform string            `json:"platform"`
+	OS       string            `json:"os"`
+	Arch     string            `json:"arch"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Features []string          `json:"features,omitempty"`
+}
+
+// RegisterPayload is sent with TypeRegister. AgentInfo is embedded so
+// servers that predate the handshake still find the fields they expect.
+type RegisterPayload struct {
+	AgentInfo
+	ProtocolVersion    int           `json:"protocol_version"`
+	MinProtocolVersion int           `json:"min_protocol_version"`
+	MessageTypes       []MessageType `json:"message_types,omitempty"`
+	Codecs             []string      `json:"codecs,omitempty"`
+	BootstrapToken     string        `json:"bootstrap_token,omitempty"` // One-time token presented to enroll
+	Credential         string        `json:"credential,omitempty"`      // Issued at enrollment, presented afterwards
+}
+
+// RegisterAck is the server's TypeRegistered reply to a registration
+type RegisterAck struct {
+	ProtocolVersion int                    `json:"protocol_version"`
+	SessionID       string                 `json:"session_id"`
+	Codec           string                 `json:"codec,omitempty"`
+	ResultAcks      bool                   `json:"result_acks,omitempty"` // Server acks streamed frames with TypeResultAck
+	Settings        map[string]interface{} `json:"settings,omitempty"`
+	Credentials     *AgentCredentials      `json:"credentials,omitempty"` // Set on enrollment or rotation
+}
+
+// AgentCredentials is the identity the server issues to an enrolled agent,
+// sent in a RegisterAck or a TypeCredentials message
+type AgentCredentials struct {
+	AgentID    string     `json:"agent_id"`
+	Credential string     `json:"credential"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+func (c AgentCredentials) Validate() error {
+	if c.AgentID == "" {
+		return missing("agent_id")
+	}
+	if c.Credential == "" {
+		return missing("credential")
+	}
+	return nil
 }
 
 // AgentCommand represents a command to be executed by the agent
 type AgentCommand struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Stream  bool              `json:"stream,omitempty"`  // Send output as TypeResultChunk frames while running
+	Params  json.RawMessage   `json:"params,omitempty"`  // Typed arguments, for commands registered with Registry.RegisterCommand
+	Cwd     string            `json:"cwd,omitempty"`     // Working directory, the agent's own when empty
+	Env     map[string]string `json:"env,omitempty"`     // Set on top of the agent's environment
+	Stdin   string            `json:"stdin,omitempty"`   // Fed to the command's standard input
+	Timeout string            `json:"timeout,omitempty"` // Duration such as "30s" after which the command is killed
+	Shell   bool              `json:"shell,omitempty"`   // Run Command as a shell script with Args as its parameters
+
+	// Identity and resource constraints, resolved and applied by the agent
+	User     string    `json:"user,omitempty"`  // User name to run as, the agent's user when empty
+	Group    string    `json:"group,omitempty"` // Group name to run as, the user's primary group when empty
+	Limits   *Limits   `json:"limits,omitempty"`
+	Priority *Priority `json:"priority,omitempty"`
+}
+
+// Limits caps the resources a command may use. Zero fields are unlimited.
+type Limits struct {
+	CPUSeconds   uint64 `json:"cpu_seconds,omitempty"`
+	AddressSpace uint64 `json:"address_space,omitempty"` // Bytes of virtual memory
+	OpenFiles    uint64 `json:"open_files,omitempty"`
+	Processes    uint64 `json:"processes,omitempty"` // Counted per user, across all of the user's processes
+}
+
+// Priority is the CPU and I/O scheduling priority of a command. Levels are
+// range checked by the agent when the command runs.
+type Priority struct {
+	Nice    int    `json:"nice,omitempty"`     // -20 (highest) to 19 (lowest)
+	IOClass string `json:"io_class,omitempty"` // realtime, best-effort or idle
+	IOLevel int    `json:"io_level,omitempty"` // 0 (highest) to 7, for the realtime and best-effort classes
+}
+
+func (c AgentCommand) Validate() error {
+	if c.Command == "" {
+		return missing("command")
+	}
+	for name := range c.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return &FieldError{Field: "env", Reason: fmt.Sprintf("invalid variable name %q", name)}
+		}
+	}
+	if c.Timeout != "" {
+		if timeout, err := time.ParseDuration(c.Timeout); err != nil || timeout <= 0 {
+			return &FieldError{Field: "timeout", Reason: "must be a positive duration"}
+		}
+	}
+	return nil
+}
+
+// TimeoutDuration returns the parsed Timeout, zero when none is set
+func (c AgentCommand) TimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(c.Timeout)
+	return timeout
+}
+
+// CancelPayload asks the agent to abort the in-flight message with the given ID
+type CancelPayload struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (c CancelPayload) Validate() error {
+	if c.ID == "" {
+		return missing("id")
+	}
+	return nil
+}
+
+// JobStartParams are the params of the job:start command
+type JobStartParams struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args,omitempty"`
 }
 
+func (p JobStartParams) Validate() error {
+	if p.Command == "" {
+		return missing("command")
+	}
+	return nil
+}
+
+// JobParams are the params of the job:status and job:cancel commands
+type JobParams struct {
+	ID string `json:"id"`
+}
+
+func (p JobParams) Validate() error {
+	if p.ID == "" {
+		return missing("id")
+	}
+	return nil
+}
+
+// JobOutputParams are the params of the job:output command. Offset is the
+// NextOffset of the previous page, zero for the first one.
+type JobOutputParams struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset,omitempty"`
+	Limit  int64  `json:"limit,omitempty"`
+}
+
+func (p JobOutputParams) Validate() error {
+	if p.ID == "" {
+		return missing("id")
+	}
+	if p.Offset < 0 {
+		return &FieldError{Field: "offset", Reason: "must not be negative"}
+	}
+	if p.Limit < 0 {
+		return &FieldError{Field: "limit", Reason: "must not be negative"}
+	}
+	return nil
+}
+
+// Rejection reports a server message the agent refused to process
+type Rejection struct {
+	ID     string      `json:"id"`
+	Type   MessageType `json:"type"`
+	Reason string      `json:"reason"`
+	Field  string      `json:"field,omitempty"` // Payload field that failed validation
+	Rule   string      `json:"rule,omitempty"`  // Local policy rule that refused the message
+}
+
 // AgentResponse represents a response from the agent
 type AgentResponse struct {
 	Success bool            `json:"success"`
 	Data    json.RawMessage `json:"data,omitempty"`
-	Error   string         `json:"error,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// ResourceUsage is the CPU time and peak memory used by a command
+type ResourceUsage struct {
+	UserTime   time.Duration `json:"user_time"`
+	SystemTime time.Duration `json:"system_time"`
+	MaxRSS     int64         `json:"max_rss"`             // Peak resident set size in bytes
+	CPUTime    time.Duration `json:"cpu_time"`            // Including every process the command started, when the agent confines commands to cgroups
+	OOMKills   int           `json:"oom_kills,omitempty"` // Processes killed by the memory limit of the command's cgroup
+}
+
+// OutputLine is one line a command wrote
+type OutputLine struct {
+	Timestamp time.Time `json:"timestamp"`
+	Stream    string    `json:"stream"` // stdout or stderr
+	Line      string    `json:"line"`
 }
 
 // ResultPayload represents the result of a command execution
 type ResultPayload struct {
+	CommandID       string         `json:"command_id"`
+	ExitCode        int            `json:"exit_code"`
+	Signal          string         `json:"signal,omitempty"` // Signal that killed the command; ExitCode is then -1
+	Stdout          string         `json:"stdout"`
+	Stderr          string         `json:"stderr"`
+	StdoutTruncated bool           `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool           `json:"stderr_truncated,omitempty"`
+	WallTime        time.Duration  `json:"wall_time,omitempty"`
+	Usage           *ResourceUsage `json:"usage,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	Failure         *ErrorResult   `json:"failure,omitempty"` // Set when the command failed rather than ran to completion
+}
+
+// ResultChunk is one frame of a streamed command result. Frames are numbered
+// from 1 per command; the final frame carries the exit code and ends the stream.
+type ResultChunk struct {
+	CommandID string         `json:"command_id"`
+	Seq       uint64         `json:"seq"`
+	Lines     []OutputLine   `json:"lines,omitempty"`
+	Final     bool           `json:"final,omitempty"`
+	ExitCode  int            `json:"exit_code"`
+	Signal    string         `json:"signal,omitempty"`
+	WallTime  time.Duration  `json:"wall_time,omitempty"`
+	Usage     *ResourceUsage `json:"usage,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Failure   *ErrorResult   `json:"failure,omitempty"`
+}
+
+// ResultAck acknowledges every streamed frame of a command up to and including Seq
+type ResultAck struct {
 	CommandID string `json:"command_id"`
-	ExitCode  int    `json:"exit_code"`
-	Stdout    string `json:"stdout"`
-	Stderr    string `json:"stderr"`
-	Error     string `json:"error,omitempty"`
+	Seq       uint64 `json:"seq"`
+}
+
+func (a ResultAck) Validate() error {
+	if a.CommandID == "" {
+		return missing("command_id")
+	}
+	return nil
 }
 
 // AgentMetrics represents system metrics collected by the agent
@@ -54,7 +266,7 @@ type AgentMetrics struct {
 type AgentLog struct {
 	Level     string                 `json:"level"`
 	Message   string                 `json:"message"`
-	Timestamp time.Time             `json:"timestamp"`
+	Timestamp time.Time              `json:"timestamp"`
 	Fields    map[string]interface{} `json:"fields,omitempty"`
 }
 
@@ -70,13 +282,26 @@ type AgentUpdate struct {
 	Checksum    string `json:"checksum"`
 }
 
+func (u AgentUpdate) Validate() error {
+	if u.Version == "" {
+		return missing("version")
+	}
+	if u.DownloadURL == "" {
+		return missing("download_url")
+	}
+	return nil
+}
+
 // AgentHeartbeat represents a heartbeat message from the agent
 type AgentHeartbeat struct {
 	Status    string       `json:"status"`
-	Uptime    int64       `json:"uptime"`
-	LoadAvg   [3]float64  `json:"load_avg"`
-	Processes int         `json:"processes"`
+	Uptime    int64        `json:"uptime"`
+	LoadAvg   [3]float64   `json:"load_avg"`
+	Processes int          `json:"processes"`
 	Metrics   AgentMetrics `json:"metrics"`
+	LatencyMs float64      `json:"latency_ms,omitempty"` // Last ping round-trip time to the server
+	LastPong  *time.Time   `json:"last_pong,omitempty"`
+	Server    string       `json:"server,omitempty"` // URL of the server the agent is connected to
 }
 
 // CommandResult represents the result of executing a command
@@ -85,3 +310,104 @@ type CommandResult struct {
 	Stdout   string `json:"stdout"`
 	Stderr   string `json:"stderr"`
 }
+
+// SessionOpen asks the agent for an interactive terminal session. The
+// session is identified by the ID of this message; the agent replies with a
+// SessionInfo.
+type SessionOpen struct {
+	Command string            `json:"command,omitempty"` // Login shell when empty
+	Args    []string          `json:"args,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"` // Home directory when empty
+	Env     map[string]string `json:"env,omitempty"`
+	Term    string            `json:"term,omitempty"` // TERM, xterm-256color when empty
+	Cols    uint16            `json:"cols,omitempty"` // 80 when zero
+	Rows    uint16            `json:"rows,omitempty"` // 24 when zero
+}
+
+func (o SessionOpen) Validate() error {
+	for name := range o.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return &FieldError{Field: "env", Reason: fmt.Sprintf("invalid variable name %q", name)}
+		}
+	}
+	return nil
+}
+
+// SessionInfo describes a session the agent opened
+type SessionInfo struct {
+	SessionID string `json:"session_id"`
+	PID       int    `json:"pid"`
+	Recording string `json:"recording,omitempty"` // Path of the audit recording on the agent
+}
+
+// SessionInput is typed into a session
+type SessionInput struct {
+	SessionID string `json:"session_id"`
+	Data      []byte `json:"data"`
+}
+
+func (i SessionInput) Validate() error {
+	if i.SessionID == "" {
+		return missing("session_id")
+	}
+	return nil
+}
+
+// SessionResize changes the window size of a session
+type SessionResize struct {
+	SessionID string `json:"session_id"`
+	Cols      uint16 `json:"cols"`
+	Rows      uint16 `json:"rows"`
+}
+
+func (r SessionResize) Validate() error {
+	if r.SessionID == "" {
+		return missing("session_id")
+	}
+	if r.Cols == 0 {
+		return missing("cols")
+	}
+	if r.Rows == 0 {
+		return missing("rows")
+	}
+	return nil
+}
+
+// SessionClose ends a session. The agent hangs up the terminal and answers
+// with a SessionExit once the session's process is gone.
+type SessionClose struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (c SessionClose) Validate() error {
+	if c.SessionID == "" {
+		return missing("session_id")
+	}
+	return nil
+}
+
+// SessionOutput is what a session wrote to its terminal. Seq counts up from
+// one per session.
+type SessionOutput struct {
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+	Data      []byte `json:"data"`
+}
+
+// Reasons a session ended, for SessionExit.Reason
+const (
+	SessionExited      = "exited"
+	SessionClosed      = "closed"
+	SessionIdleTimeout = "idle_timeout"
+	SessionShutdown    = "shutdown"
+)
+
+// SessionExit reports that a session ended
+type SessionExit struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason"`
+	ExitCode  int    `json:"exit_code"`
+	Signal    string `json:"signal,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
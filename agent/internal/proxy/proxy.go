@@ -0,0 +1,74 @@
+// Package proxy selects the HTTP proxy used for outbound connections to the
+// server. Explicit settings take precedence over the standard HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"shh/agent/internal/config"
+)
+
+// ErrUnsupportedScheme indicates a proxy URL other than http://. The websocket
+// dialer cannot speak TLS to the proxy itself; connections tunnelled through
+// an http:// proxy are still TLS end to end with wss:// servers.
+var ErrUnsupportedScheme = errors.New("unsupported proxy scheme")
+
+// Func returns the proxy selection function for cfg, suitable for
+// http.Transport.Proxy and websocket.Dialer.Proxy. Requests are tunnelled
+// through the proxy with HTTP CONNECT; credentials in the proxy URL or in
+// cfg are sent as basic auth. Only http:// proxies are supported, whether
+// configured or taken from the environment.
+func Func(cfg config.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	settings := httpproxy.FromEnvironment()
+
+	if cfg.URL != "" {
+		proxyURL, err := url.Parse(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		if proxyURL.Scheme != "http" {
+			return nil, fmt.Errorf("%w %q", ErrUnsupportedScheme, proxyURL.Scheme)
+		}
+		settings.HTTPProxy = cfg.URL
+		settings.HTTPSProxy = cfg.URL
+	}
+	if cfg.NoProxy != "" {
+		settings.NoProxy = cfg.NoProxy
+	}
+
+	proxyFor := settings.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxyFor(req.URL)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		if proxyURL.Scheme != "http" {
+			return nil, fmt.Errorf("%w %q", ErrUnsupportedScheme, proxyURL.Scheme)
+		}
+		if cfg.Username != "" && proxyURL.User == nil {
+			withAuth := *proxyURL
+			withAuth.User = url.UserPassword(cfg.Username, cfg.Password)
+			return &withAuth, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// Transport returns an HTTP transport that uses the proxy settings in cfg
+func Transport(cfg config.ProxyConfig) (*http.Transport, error) {
+	proxyFunc, err := Func(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc
+	return transport, nil
+}
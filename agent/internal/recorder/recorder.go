@@ -0,0 +1,156 @@
+// Package recorder writes the protocol messages exchanged with the server to
+// a rotating file, and reads such recordings back for replay
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"shh/agent/internal/config"
+	"shh/agent/internal/protocol"
+)
+
+// Direction says which way a recorded message travelled
+type Direction string
+
+const (
+	Inbound  Direction = "in"  // Server to agent
+	Outbound Direction = "out" // Agent to server
+)
+
+// Entry is one recorded message. Conn numbers the connections made by the
+// agent, starting at 1, so a recording spanning reconnects can be split.
+type Entry struct {
+	Time      time.Time        `json:"time"`
+	Conn      uint64           `json:"conn"`
+	Direction Direction        `json:"direction"`
+	Server    string           `json:"server,omitempty"`
+	Transport string           `json:"transport,omitempty"`
+	Message   protocol.Message `json:"message"`
+}
+
+// Recorder appends entries to a size-rotated JSON lines file. It is safe for
+// concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	writer *lumberjack.Logger
+	enc    *json.Encoder
+}
+
+// New opens a recorder writing to the configured file
+func New(cfg config.RecorderConfig) (*Recorder, error) {
+	if cfg.File == "" {
+		return nil, fmt.Errorf("recorder file is not set")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	writer := &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSize, // MB
+		MaxBackups: cfg.MaxBackups,
+		Compress:   cfg.Compress,
+	}
+
+	return &Recorder{
+		writer: writer,
+		enc:    json.NewEncoder(writer),
+	}, nil
+}
+
+// Record appends an entry, stamping it with the current time if unset
+func (r *Recorder) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(entry); err != nil {
+		return fmt.Errorf("failed to record message: %w", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writer.Close()
+}
+
+// Load reads every entry from a recording. Rotated files compressed with
+// gzip are read transparently.
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress recording: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var entries []Entry
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var entry Entry
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			// A crash can leave a truncated last line; keep what came before
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return entries, nil
+			}
+			return nil, fmt.Errorf("failed to read entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Conns returns the connection numbers present in entries, in order
+func Conns(entries []Entry) []uint64 {
+	var conns []uint64
+	seen := make(map[uint64]bool)
+	for _, e := range entries {
+		if !seen[e.Conn] {
+			seen[e.Conn] = true
+			conns = append(conns, e.Conn)
+		}
+	}
+	return conns
+}
+
+// Filter returns the entries recorded on connection conn
+func Filter(entries []Entry, conn uint64) []Entry {
+	var filtered []Entry
+	for _, e := range entries {
+		if e.Conn == conn {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package session
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY allocates a pseudo-terminal and returns its master and slave ends
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+
+	var (
+		number  uint32
+		ctrlErr error
+	)
+	raw, err := master.SyscallConn()
+	if err == nil {
+		err = raw.Control(func(fd uintptr) {
+			if ctrlErr = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); ctrlErr != nil {
+				return
+			}
+			number, ctrlErr = unix.IoctlGetUint32(int(fd), unix.TIOCGPTN)
+		})
+	}
+	if err == nil {
+		err = ctrlErr
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(number)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty slave: %w", err)
+	}
+
+	return master, slave, nil
+}
+
+// setWinsize sets the window size of the terminal behind f
+func setWinsize(f *os.File, cols, rows uint16) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ctrlErr error
+	err = raw.Control(func(fd uintptr) {
+		ctrlErr = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Col: cols, Row: rows})
+	})
+	if err != nil {
+		return err
+	}
+	if ctrlErr != nil {
+		return fmt.Errorf("failed to set window size: %w", ctrlErr)
+	}
+	return nil
+}
+
+// attachPTY makes slave the standard streams and controlling terminal of
+// cmd, in a session of its own
+func attachPTY(cmd *exec.Cmd, slave *os.File) {
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+		Ctty:    0, // The child's stdin
+	}
+}
+
+// hangup signals the session's process group, as a terminal closing would
+func hangup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// openPTY is not supported on this platform
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, fmt.Errorf("terminal sessions: %w", errors.ErrUnsupported)
+}
+
+func setWinsize(f *os.File, cols, rows uint16) error {
+	return fmt.Errorf("terminal sessions: %w", errors.ErrUnsupported)
+}
+
+func attachPTY(cmd *exec.Cmd, slave *os.File) {}
+
+func hangup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recording writes a session in the asciicast v2 format, playable with
+// asciinema. Only what the terminal displayed is kept, not what was typed,
+// so passwords entered at prompts are not recorded.
+type recording struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// newRecording creates the recording of session id in dir
+func newRecording(dir, id string, header castHeader) (*recording, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, id+".cast"), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	r := &recording{
+		file:  file,
+		w:     bufio.NewWriter(file),
+		start: time.Now(),
+	}
+
+	header.Version = 2
+	header.Timestamp = r.start.Unix()
+	if err := json.NewEncoder(r.w).Encode(header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	return r, nil
+}
+
+// Path returns the file the recording is written to
+func (r *recording) Path() string {
+	return r.file.Name()
+}
+
+// output records data written to the terminal
+func (r *recording) output(data []byte) error {
+	return r.event("o", string(data))
+}
+
+// resize records a change of window size
+func (r *recording) resize(cols, rows uint16) error {
+	return r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *recording) event(kind, data string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := time.Since(r.start).Seconds()
+	return json.NewEncoder(r.w).Encode([]interface{}{elapsed, kind, data})
+}
+
+// Close flushes and closes the recording
+func (r *recording) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return fmt.Errorf("failed to flush recording: %w", err)
+	}
+	return r.file.Close()
+}
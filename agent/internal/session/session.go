@@ -0,0 +1,614 @@
+// Package session runs interactive terminal sessions for the server. Each
+// session is a login shell or a given command on a pseudo-terminal of its
+// own. What it writes to the terminal is streamed to the server as
+// TypeSessionOutput messages, and the server's keystrokes and window size
+// changes are applied to it in the order they were sent.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/websocket"
+)
+
+const (
+	// DefaultMaxSessions is how many sessions may be open at once by default
+	DefaultMaxSessions = 4
+
+	// DefaultIdleTimeout is how long a session may go without input or
+	// output before it is closed
+	DefaultIdleTimeout = 30 * time.Minute
+
+	defaultTerm = "xterm-256color"
+	defaultCols = 80
+	defaultRows = 24
+
+	inputQueueSize = 256
+	outputBufSize  = 32 * 1024
+
+	// hangupGrace is how long a session's processes get to exit after
+	// SIGHUP before they are killed
+	hangupGrace = 2 * time.Second
+
+	// drainTimeout bounds how long output still buffered in the terminal is
+	// forwarded after the session's process exits
+	drainTimeout = time.Second
+)
+
+var (
+	// ErrSessionNotFound indicates a session that is not open
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrInputOverflow indicates input arriving faster than the session
+	// reads it
+	ErrInputOverflow = errors.New("session input queue full")
+
+	// ErrShuttingDown indicates a session opened while the manager stops
+	ErrShuttingDown = errors.New("session manager is shutting down")
+
+	// ErrInvalidSessionID indicates a session ID that is not a plain name.
+	// IDs name the session's recording and cgroup, so they must be safe to
+	// use in a path.
+	ErrInvalidSessionID = errors.New("invalid session ID")
+)
+
+// sessionIDPattern matches the IDs sessions may be opened with
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Manager runs terminal sessions
+type Manager struct {
+	logger      *zap.Logger
+	send        func(protocol.Message) error
+	maxSessions int
+	idleTimeout time.Duration
+	shell       string
+	recordDir   string
+	authorizer  process.Authorizer
+	cgroups     *process.CgroupSlice
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	id        string
+	cmd       *exec.Cmd
+	pty       *os.File
+	input     chan []byte
+	recording *recording
+	cgroup    *process.Cgroup // Set if the session is confined to a cgroup
+	idle      *time.Timer
+	done      chan struct{} // Closed once the process has exited
+
+	mu     sync.Mutex
+	reason string // Why the session was ended, if the agent ended it
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// WithMaxSessions caps how many sessions may be open at once
+func WithMaxSessions(n int) Option {
+	return func(m *Manager) {
+		if n > 0 {
+			m.maxSessions = n
+		}
+	}
+}
+
+// WithIdleTimeout closes sessions without input or output for d. Zero
+// disables the timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.idleTimeout = d
+	}
+}
+
+// WithShell sets the login shell, used when a session names no command. The
+// default is $SHELL, or /bin/sh.
+func WithShell(shell string) Option {
+	return func(m *Manager) {
+		m.shell = shell
+	}
+}
+
+// WithRecording records every session in dir for audit, as asciicast files.
+// A session whose recording cannot be created is refused.
+func WithRecording(dir string) Option {
+	return func(m *Manager) {
+		m.recordDir = dir
+	}
+}
+
+// WithAuthorizer makes Open refuse commands a does not authorize
+func WithAuthorizer(a process.Authorizer) Option {
+	return func(m *Manager) {
+		m.authorizer = a
+	}
+}
+
+// WithCgroups runs each session in its own cgroup below slice. Processes a
+// session leaves behind are killed when it ends.
+func WithCgroups(slice *process.CgroupSlice) Option {
+	return func(m *Manager) {
+		m.cgroups = slice
+	}
+}
+
+// NewManager creates a session manager that sends session output and exits
+// with send. Terminal output can hold secrets and is no use late, so send
+// should fail while disconnected rather than queue it.
+func NewManager(send func(protocol.Message) error, logger *zap.Logger, opts ...Option) *Manager {
+	m := &Manager{
+		logger:      logger,
+		send:        send,
+		maxSessions: DefaultMaxSessions,
+		idleTimeout: DefaultIdleTimeout,
+		sessions:    make(map[string]*session),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// Register installs the session message handlers on client. They all run
+// on the read loop, so input sent straight after an open finds the session.
+func (m *Manager) Register(client *websocket.Client) {
+	client.RegisterOrderedRequestHandler(protocol.TypeSessionOpen, protocol.HandleRequest(
+		func(ctx context.Context, msg protocol.Message, req protocol.SessionOpen) (interface{}, error) {
+			return m.Open(msg.ID, req)
+		}))
+
+	client.RegisterOrderedHandler(protocol.TypeSessionInput, protocol.Handle(
+		func(ctx context.Context, msg protocol.Message, input protocol.SessionInput) error {
+			return m.Input(input)
+		}))
+
+	client.RegisterOrderedHandler(protocol.TypeSessionResize, protocol.Handle(
+		func(ctx context.Context, msg protocol.Message, resize protocol.SessionResize) error {
+			return m.Resize(resize)
+		}))
+
+	client.RegisterOrderedHandler(protocol.TypeSessionClose, protocol.Handle(
+		func(ctx context.Context, msg protocol.Message, req protocol.SessionClose) error {
+			return m.Close(req.SessionID, req.Reason)
+		}))
+}
+
+// Open starts a session identified by id
+func (m *Manager) Open(id string, req protocol.SessionOpen) (*protocol.SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !sessionIDPattern.MatchString(id) || id == "." || id == ".." {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSessionID, id)
+	}
+	if m.closed {
+		return nil, ErrShuttingDown
+	}
+	if _, exists := m.sessions[id]; exists {
+		return nil, process.NewProcessError(id, "open session", process.ErrProcessAlreadyExists)
+	}
+	if len(m.sessions) >= m.maxSessions {
+		return nil, fmt.Errorf("%w: %d sessions open", process.ErrMaxProcessesReached, m.maxSessions)
+	}
+
+	s, err := m.start(id, req)
+	if err != nil {
+		return nil, err
+	}
+	m.sessions[id] = s
+
+	m.wg.Add(2)
+	go m.run(s)
+	go m.writeInput(s)
+
+	info := &protocol.SessionInfo{
+		SessionID: id,
+		PID:       s.cmd.Process.Pid,
+	}
+	if s.recording != nil {
+		info.Recording = s.recording.Path()
+	}
+
+	m.logger.Info("Session opened",
+		zap.String("session_id", id),
+		zap.Strings("command", s.cmd.Args),
+		zap.Int("pid", info.PID))
+
+	return info, nil
+}
+
+// start runs the session's command on a new terminal
+func (m *Manager) start(id string, req protocol.SessionOpen) (*session, error) {
+	name, args := req.Command, req.Args
+	if name == "" {
+		name, args = m.loginShell(), []string{"-l"}
+	}
+
+	cmd := exec.Command(name, args...)
+	if m.authorizer != nil && cmd.Err == nil {
+		if err := m.authorizer.AuthorizeExec(cmd.Path, cmd.Args[1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	term := req.Term
+	if term == "" {
+		term = defaultTerm
+	}
+	cols, rows := req.Cols, req.Rows
+	if cols == 0 {
+		cols = defaultCols
+	}
+	if rows == 0 {
+		rows = defaultRows
+	}
+
+	cmd.Dir = req.Cwd
+	if cmd.Dir == "" {
+		cmd.Dir, _ = os.UserHomeDir()
+	}
+	env := map[string]string{"TERM": term}
+	for k, v := range req.Env {
+		env[k] = v
+	}
+	cmd.Env = process.MergeEnv(os.Environ(), env)
+
+	s := &session{
+		id:    id,
+		cmd:   cmd,
+		input: make(chan []byte, inputQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	if m.recordDir != "" {
+		rec, err := newRecording(m.recordDir, id, castHeader{
+			Width:   cols,
+			Height:  rows,
+			Command: strings.Join(cmd.Args, " "),
+			Env:     map[string]string{"TERM": term},
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.recording = rec
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		s.closeRecording(m.logger)
+		return nil, err
+	}
+	if err := setWinsize(master, cols, rows); err != nil {
+		master.Close()
+		slave.Close()
+		s.closeRecording(m.logger)
+		return nil, err
+	}
+
+	attachPTY(cmd, slave)
+	if m.cgroups != nil {
+		if s.cgroup, err = m.cgroups.Confine(cmd, "session-"+id); err != nil {
+			master.Close()
+			slave.Close()
+			s.closeRecording(m.logger)
+			return nil, err
+		}
+	}
+
+	err = cmd.Start()
+	// The child has its own copy; holding on to ours would keep the terminal
+	// open after it exits
+	slave.Close()
+	if err != nil {
+		master.Close()
+		s.removeCgroup(m.logger)
+		s.closeRecording(m.logger)
+		return nil, fmt.Errorf("failed to start session: %w", err)
+	}
+	s.pty = master
+
+	if m.idleTimeout > 0 {
+		s.idle = time.AfterFunc(m.idleTimeout, func() {
+			m.logger.Info("Session idle, closing", zap.String("session_id", id))
+			m.end(s, protocol.SessionIdleTimeout)
+		})
+	}
+
+	return s, nil
+}
+
+// Input types data into a session
+func (m *Manager) Input(input protocol.SessionInput) error {
+	s, err := m.session(input.SessionID)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.input <- input.Data:
+		return nil
+	default:
+		return fmt.Errorf("session %s: %w", s.id, ErrInputOverflow)
+	}
+}
+
+// Resize changes a session's window size
+func (m *Manager) Resize(resize protocol.SessionResize) error {
+	s, err := m.session(resize.SessionID)
+	if err != nil {
+		return err
+	}
+
+	if err := setWinsize(s.pty, resize.Cols, resize.Rows); err != nil {
+		return fmt.Errorf("session %s: %w", s.id, err)
+	}
+	s.touch(m.idleTimeout)
+
+	if s.recording != nil {
+		if err := s.recording.resize(resize.Cols, resize.Rows); err != nil {
+			m.logger.Warn("Failed to record resize", zap.String("session_id", s.id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Close hangs up a session. Its SessionExit is sent once it has ended.
+func (m *Manager) Close(id, reason string) error {
+	s, err := m.session(id)
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info("Closing session", zap.String("session_id", id), zap.String("reason", reason))
+	m.end(s, protocol.SessionClosed)
+	return nil
+}
+
+// Shutdown hangs up every session and waits for them to end
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	sessions := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+
+	for _, s := range sessions {
+		m.end(s, protocol.SessionShutdown)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("sessions still open: %w", ctx.Err())
+	}
+}
+
+// session looks up an open session
+func (m *Manager) session(id string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return s, nil
+}
+
+// end hangs up a session, and kills it if it is still running after the
+// grace period. The first reason given is the one reported.
+func (m *Manager) end(s *session, reason string) {
+	s.mu.Lock()
+	if s.reason != "" {
+		s.mu.Unlock()
+		return
+	}
+	s.reason = reason
+	s.mu.Unlock()
+
+	if err := hangup(s.cmd, syscall.SIGHUP); err != nil {
+		m.logger.Debug("Failed to hang up session", zap.String("session_id", s.id), zap.Error(err))
+	}
+
+	time.AfterFunc(hangupGrace, func() {
+		select {
+		case <-s.done:
+		default:
+			hangup(s.cmd, syscall.SIGKILL)
+			if s.cgroup != nil {
+				s.cgroup.Kill()
+			}
+		}
+	})
+}
+
+// run forwards a session's output until its process exits, then reports
+// the exit and cleans up
+func (m *Manager) run(s *session) {
+	defer m.wg.Done()
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		m.readOutput(s)
+	}()
+
+	waitErr := s.cmd.Wait()
+	close(s.done)
+
+	// Forward what the process wrote before it exited. Processes it left
+	// in the background can keep the terminal open, so don't wait for it
+	// to close on its own.
+	select {
+	case <-outputDone:
+	case <-time.After(drainTimeout):
+	}
+	s.removeCgroup(m.logger)
+	s.pty.Close()
+	<-outputDone
+
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	s.closeRecording(m.logger)
+
+	m.mu.Lock()
+	delete(m.sessions, s.id)
+	m.mu.Unlock()
+
+	s.mu.Lock()
+	exit := protocol.SessionExit{
+		SessionID: s.id,
+		Reason:    s.reason,
+		ExitCode:  -1,
+	}
+	s.mu.Unlock()
+	if exit.Reason == "" {
+		exit.Reason = protocol.SessionExited
+	}
+	if state := s.cmd.ProcessState; state != nil {
+		exit.ExitCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			exit.Signal = status.Signal().String()
+		}
+	}
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		exit.Error = waitErr.Error()
+	}
+
+	m.logger.Info("Session ended",
+		zap.String("session_id", s.id),
+		zap.String("reason", exit.Reason),
+		zap.Int("exit_code", exit.ExitCode))
+
+	if err := m.sendMessage(protocol.TypeSessionExit, exit); err != nil {
+		m.logger.Error("Failed to send session exit", zap.String("session_id", s.id), zap.Error(err))
+	}
+}
+
+// readOutput sends what the session writes to its terminal until the
+// terminal is closed
+func (m *Manager) readOutput(s *session) {
+	buf := make([]byte, outputBufSize)
+	var seq uint64
+
+	for {
+		n, err := s.pty.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			s.touch(m.idleTimeout)
+
+			if s.recording != nil {
+				if err := s.recording.output(data); err != nil {
+					m.logger.Warn("Failed to record session output", zap.String("session_id", s.id), zap.Error(err))
+				}
+			}
+
+			seq++
+			if err := m.sendMessage(protocol.TypeSessionOutput, protocol.SessionOutput{
+				SessionID: s.id,
+				Seq:       seq,
+				Data:      data,
+			}); err != nil {
+				m.logger.Error("Failed to send session output", zap.String("session_id", s.id), zap.Error(err))
+			}
+		}
+		if err != nil {
+			// EIO once every process holding the terminal has exited
+			return
+		}
+	}
+}
+
+// writeInput writes queued input to the session's terminal in order
+func (m *Manager) writeInput(s *session) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case data := <-s.input:
+			s.touch(m.idleTimeout)
+			if _, err := s.pty.Write(data); err != nil {
+				m.logger.Warn("Failed to write session input", zap.String("session_id", s.id), zap.Error(err))
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) sendMessage(t protocol.MessageType, payload interface{}) error {
+	msg, err := protocol.EncodePayload(t, fmt.Sprintf("%s-%d", t, time.Now().UnixNano()), payload)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+// loginShell returns the shell run when a session names no command
+func (m *Manager) loginShell() string {
+	if m.shell != "" {
+		return m.shell
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+// touch postpones the idle timeout
+func (s *session) touch(timeout time.Duration) {
+	if s.idle != nil {
+		s.idle.Reset(timeout)
+	}
+}
+
+// removeCgroup kills whatever the session left running in its cgroup
+func (s *session) removeCgroup(logger *zap.Logger) {
+	if s.cgroup == nil {
+		return
+	}
+	if err := s.cgroup.Remove(); err != nil {
+		logger.Warn("Failed to remove session cgroup", zap.String("session_id", s.id), zap.Error(err))
+	}
+}
+
+func (s *session) closeRecording(logger *zap.Logger) {
+	if s.recording == nil {
+		return
+	}
+	if err := s.recording.Close(); err != nil {
+		logger.Warn("Failed to close session recording", zap.String("session_id", s.id), zap.Error(err))
+	}
+}
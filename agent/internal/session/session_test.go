@@ -0,0 +1,157 @@
+//go:build linux
+
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+)
+
+// recorder collects the messages a Manager sends
+type recorder struct {
+	messages chan protocol.Message
+}
+
+func newRecorder() *recorder {
+	return &recorder{messages: make(chan protocol.Message, 1024)}
+}
+
+func (r *recorder) send(msg protocol.Message) error {
+	r.messages <- msg
+	return nil
+}
+
+// waitExit returns everything the session wrote and how it ended
+func (r *recorder) waitExit(t *testing.T, id string) (string, protocol.SessionExit) {
+	t.Helper()
+
+	var output strings.Builder
+	var seq uint64
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-r.messages:
+			switch msg.Type {
+			case protocol.TypeSessionOutput:
+				out, err := protocol.DecodePayload[protocol.SessionOutput](msg)
+				require.NoError(t, err)
+				require.Equal(t, id, out.SessionID)
+				require.Equal(t, seq+1, out.Seq)
+				seq = out.Seq
+				output.Write(out.Data)
+			case protocol.TypeSessionExit:
+				exit, err := protocol.DecodePayload[protocol.SessionExit](msg)
+				require.NoError(t, err)
+				require.Equal(t, id, exit.SessionID)
+				return output.String(), exit
+			}
+		case <-timeout:
+			t.Fatalf("session %s did not exit; output so far: %q", id, output.String())
+		}
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	r := newRecorder()
+	dir := t.TempDir()
+	m := NewManager(r.send, zap.NewNop(), WithRecording(dir))
+	defer m.Shutdown(context.Background())
+
+	info, err := m.Open("session-1", protocol.SessionOpen{
+		Command: "/bin/sh",
+		Env:     map[string]string{"GREETING": "hello"},
+		Cols:    100,
+		Rows:    30,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "session-1", info.SessionID)
+	require.Positive(t, info.PID)
+	require.Equal(t, filepath.Join(dir, "session-1.cast"), info.Recording)
+
+	require.NoError(t, m.Resize(protocol.SessionResize{SessionID: "session-1", Cols: 120, Rows: 40}))
+	require.NoError(t, m.Input(protocol.SessionInput{
+		SessionID: "session-1",
+		Data:      []byte("echo \"$GREETING $TERM $(stty size)\"; exit 3\n"),
+	}))
+
+	output, exit := r.waitExit(t, "session-1")
+	require.Contains(t, output, "hello xterm-256color 40 120")
+	require.Equal(t, protocol.SessionExited, exit.Reason)
+	require.Equal(t, 3, exit.ExitCode)
+
+	// The session is gone, and what it displayed was recorded
+	require.ErrorIs(t, m.Input(protocol.SessionInput{SessionID: "session-1", Data: []byte("x")}), ErrSessionNotFound)
+
+	cast, err := os.ReadFile(info.Recording)
+	require.NoError(t, err)
+	require.Contains(t, string(cast), `"width":100`)
+	require.Contains(t, string(cast), `"r","120x40"`)
+	require.Contains(t, string(cast), "hello xterm-256color 40 120")
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	r := newRecorder()
+	m := NewManager(r.send, zap.NewNop(), WithIdleTimeout(200*time.Millisecond))
+	defer m.Shutdown(context.Background())
+
+	start := time.Now()
+	_, err := m.Open("idle", protocol.SessionOpen{Command: "sleep", Args: []string{"60"}})
+	require.NoError(t, err)
+
+	_, exit := r.waitExit(t, "idle")
+	require.Equal(t, protocol.SessionIdleTimeout, exit.Reason)
+	require.Equal(t, "hangup", exit.Signal)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSessionClose(t *testing.T) {
+	r := newRecorder()
+	m := NewManager(r.send, zap.NewNop())
+	defer m.Shutdown(context.Background())
+
+	_, err := m.Open("closed", protocol.SessionOpen{Command: "sleep", Args: []string{"60"}})
+	require.NoError(t, err)
+	require.NoError(t, m.Close("closed", "user left"))
+
+	_, exit := r.waitExit(t, "closed")
+	require.Equal(t, protocol.SessionClosed, exit.Reason)
+
+	require.ErrorIs(t, m.Close("closed", ""), ErrSessionNotFound)
+}
+
+func TestSessionLimitAndIDs(t *testing.T) {
+	r := newRecorder()
+	m := NewManager(r.send, zap.NewNop(), WithMaxSessions(1), WithRecording(t.TempDir()))
+	defer m.Shutdown(context.Background())
+
+	for _, id := range []string{"", ".", "..", "../x", "a/b", "a b", "a\x00"} {
+		_, err := m.Open(id, protocol.SessionOpen{Command: "true"})
+		require.ErrorIs(t, err, ErrInvalidSessionID, "%q", id)
+	}
+
+	_, err := m.Open("first", protocol.SessionOpen{Command: "sleep", Args: []string{"60"}})
+	require.NoError(t, err)
+
+	_, err = m.Open("first", protocol.SessionOpen{Command: "true"})
+	require.ErrorIs(t, err, process.ErrProcessAlreadyExists)
+
+	_, err = m.Open("second", protocol.SessionOpen{Command: "true"})
+	require.ErrorIs(t, err, process.ErrMaxProcessesReached)
+
+	require.NoError(t, m.Shutdown(context.Background()))
+	_, exit := r.waitExit(t, "first")
+	require.Equal(t, protocol.SessionShutdown, exit.Reason)
+
+	_, err = m.Open("third", protocol.SessionOpen{Command: "true"})
+	require.ErrorIs(t, err, ErrShuttingDown)
+}
@@ -0,0 +1,282 @@
+// Package signing authenticates messages sent from the server to the agent.
+// Each message carries a nonce and a signature over the agent and session it
+// is addressed to and its type, IDs, timestamp, nonce and payload, made with
+// either a shared HMAC-SHA256 key or an ed25519 key pair. The verifier rejects
+// messages that are unsigned, signed with an unknown key, addressed to
+// another agent or session, outside the allowed clock skew, or already seen.
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"shh/agent/internal/config"
+	"shh/agent/internal/protocol"
+)
+
+// Signature algorithms, used as the prefix of Message.Signature
+const (
+	AlgHMACSHA256 = "hmac-sha256"
+	AlgEd25519    = "ed25519"
+)
+
+// DefaultMaxSkew is how far a message timestamp may be from the local clock
+const DefaultMaxSkew = 5 * time.Minute
+
+var (
+	// ErrUnsigned indicates a message without a signature or nonce
+	ErrUnsigned = errors.New("message is not signed")
+
+	// ErrBadSignature indicates a signature that does not match the message
+	ErrBadSignature = errors.New("invalid message signature")
+
+	// ErrUnknownAlgorithm indicates a signature made with an algorithm the
+	// agent has no key for
+	ErrUnknownAlgorithm = errors.New("unsupported signature algorithm")
+
+	// ErrStale indicates a message timestamp outside the allowed clock skew
+	ErrStale = errors.New("message timestamp outside allowed window")
+
+	// ErrReplayed indicates a nonce that has already been used
+	ErrReplayed = errors.New("message nonce already used")
+)
+
+// Scope identifies the agent and session a message is addressed to. It is
+// signed along with the message but not sent, so a message captured on one
+// agent's connection is rejected by every other agent and by later sessions
+// of the same agent. Registration acks are signed with an empty session, as
+// the session is only assigned by the ack.
+type Scope struct {
+	AgentID   string
+	SessionID string
+}
+
+// Payload returns the bytes a signature covers
+func Payload(msg protocol.Message, scope Scope) []byte {
+	var b bytes.Buffer
+	b.WriteString(scope.AgentID)
+	b.WriteByte('\n')
+	b.WriteString(scope.SessionID)
+	b.WriteByte('\n')
+	b.WriteString(string(msg.Type))
+	b.WriteByte('\n')
+	b.WriteString(msg.ID)
+	b.WriteByte('\n')
+	b.WriteString(msg.CorrelationID)
+	b.WriteByte('\n')
+	b.WriteString(msg.Timestamp.UTC().Format(time.RFC3339Nano))
+	b.WriteByte('\n')
+	b.WriteString(msg.Nonce)
+	b.WriteByte('\n')
+	b.Write(msg.Payload)
+	return b.Bytes()
+}
+
+// Signer signs outgoing messages. The agent never signs; it is used by the
+// server side and by tests.
+type Signer struct {
+	hmacKey    []byte
+	privateKey ed25519.PrivateKey
+}
+
+// NewHMACSigner creates a signer using a shared secret
+func NewHMACSigner(key []byte) *Signer {
+	return &Signer{hmacKey: key}
+}
+
+// NewEd25519Signer creates a signer using an ed25519 private key
+func NewEd25519Signer(key ed25519.PrivateKey) *Signer {
+	return &Signer{privateKey: key}
+}
+
+// Sign sets a fresh nonce on msg and signs it for scope. A zero timestamp is
+// set to now.
+func (s *Signer) Sign(msg *protocol.Message, scope Scope) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	msg.Nonce = hex.EncodeToString(nonce)
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	data := Payload(*msg, scope)
+	if s.privateKey != nil {
+		msg.Signature = AlgEd25519 + ":" + base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, data))
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, s.hmacKey)
+	mac.Write(data)
+	msg.Signature = AlgHMACSHA256 + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return nil
+}
+
+// Verifier checks signatures on incoming messages and remembers nonces for
+// as long as their messages could still be accepted
+type Verifier struct {
+	hmacKey   []byte
+	publicKey ed25519.PublicKey
+	maxSkew   time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewVerifier creates a verifier that accepts messages signed with either of
+// the given keys. At least one key is required.
+func NewVerifier(hmacKey []byte, publicKey ed25519.PublicKey, maxSkew time.Duration) (*Verifier, error) {
+	if len(hmacKey) == 0 && len(publicKey) == 0 {
+		return nil, fmt.Errorf("no signing key configured")
+	}
+	if len(publicKey) != 0 && len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key length %d", len(publicKey))
+	}
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	return &Verifier{
+		hmacKey:   hmacKey,
+		publicKey: publicKey,
+		maxSkew:   maxSkew,
+		nonces:    make(map[string]time.Time),
+	}, nil
+}
+
+// LoadVerifier creates a verifier from the key files in the security settings
+func LoadVerifier(cfg config.SecurityConfig) (*Verifier, error) {
+	var hmacKey []byte
+	if cfg.SigningKeyFile != "" {
+		data, err := os.ReadFile(cfg.SigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %w", err)
+		}
+		hmacKey = bytes.TrimSpace(data)
+	}
+
+	var publicKey ed25519.PublicKey
+	if cfg.SigningPublicKeyFile != "" {
+		data, err := os.ReadFile(cfg.SigningPublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing public key: %w", err)
+		}
+		publicKey, err = parsePublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewVerifier(hmacKey, publicKey, cfg.MaxClockSkew)
+}
+
+// parsePublicKey accepts a PEM encoded PKIX key or a base64 encoded raw key
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing public key: %w", err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("signing public key is not an ed25519 key")
+		}
+		return edKey, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signing public key: %w", err)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Verify checks the signature, timestamp and nonce of msg, which must have
+// been signed for scope. A message that passes is recorded so the same nonce
+// is rejected afterwards.
+func (v *Verifier) Verify(msg protocol.Message, scope Scope) error {
+	if msg.Signature == "" || msg.Nonce == "" {
+		return ErrUnsigned
+	}
+
+	if err := v.checkSignature(msg, scope); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	skew := now.Sub(msg.Timestamp)
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return fmt.Errorf("%w: off by %s", ErrStale, skew.Round(time.Second))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.pruneLocked(now)
+	if _, seen := v.nonces[msg.Nonce]; seen {
+		return ErrReplayed
+	}
+	// Once the timestamp falls outside the window the message is rejected as
+	// stale anyway, so the nonce only needs to be kept until then
+	v.nonces[msg.Nonce] = msg.Timestamp.Add(v.maxSkew)
+
+	return nil
+}
+
+func (v *Verifier) checkSignature(msg protocol.Message, scope Scope) error {
+	alg, encoded, ok := strings.Cut(msg.Signature, ":")
+	if !ok {
+		return ErrBadSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	data := Payload(msg, scope)
+	switch {
+	case alg == AlgHMACSHA256 && len(v.hmacKey) > 0:
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write(data)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrBadSignature
+		}
+	case alg == AlgEd25519 && len(v.publicKey) > 0:
+		if !ed25519.Verify(v.publicKey, data, sig) {
+			return ErrBadSignature
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownAlgorithm, alg)
+	}
+
+	return nil
+}
+
+// pruneLocked drops expired nonces, at most once a second
+func (v *Verifier) pruneLocked(now time.Time) {
+	if now.Sub(v.lastPrune) < time.Second {
+		return
+	}
+	v.lastPrune = now
+
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+}
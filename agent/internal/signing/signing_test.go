@@ -0,0 +1,131 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"shh/agent/internal/protocol"
+)
+
+// testScope is the agent and session test messages are addressed to
+var testScope = Scope{AgentID: "agent-1", SessionID: "session-1"}
+
+func signed(t *testing.T, s *Signer, ts time.Time) protocol.Message {
+	t.Helper()
+
+	msg := protocol.Message{
+		Type:      protocol.TypeCommand,
+		ID:        "cmd-1",
+		Timestamp: ts,
+		Payload:   []byte(`{"command":"uptime"}`),
+	}
+	require.NoError(t, s.Sign(&msg, testScope))
+	return msg
+}
+
+func TestVerifySignatures(t *testing.T) {
+	hmacKey := []byte("shared-secret")
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	v, err := NewVerifier(hmacKey, public, time.Minute)
+	require.NoError(t, err)
+
+	require.NoError(t, v.Verify(signed(t, NewHMACSigner(hmacKey), time.Now()), testScope))
+	require.NoError(t, v.Verify(signed(t, NewEd25519Signer(private), time.Now()), testScope))
+
+	// Wrong keys
+	require.ErrorIs(t, v.Verify(signed(t, NewHMACSigner([]byte("other")), time.Now()), testScope), ErrBadSignature)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, v.Verify(signed(t, NewEd25519Signer(otherKey), time.Now()), testScope), ErrBadSignature)
+
+	// Tampering with any signed field breaks the signature
+	msg := signed(t, NewHMACSigner(hmacKey), time.Now())
+	msg.Payload = []byte(`{"command":"reboot"}`)
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrBadSignature)
+
+	msg = signed(t, NewHMACSigner(hmacKey), time.Now())
+	msg.CorrelationID = "register-1"
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrBadSignature)
+
+	msg = signed(t, NewHMACSigner(hmacKey), time.Now())
+	msg.Signature = AlgHMACSHA256 + ":not base64!"
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrBadSignature)
+
+	// An algorithm the agent has no key for
+	hmacOnly, err := NewVerifier(hmacKey, nil, time.Minute)
+	require.NoError(t, err)
+	require.ErrorIs(t, hmacOnly.Verify(signed(t, NewEd25519Signer(private), time.Now()), testScope), ErrUnknownAlgorithm)
+}
+
+func TestVerifyScope(t *testing.T) {
+	signer := NewHMACSigner([]byte("shared-secret"))
+	v, err := NewVerifier([]byte("shared-secret"), nil, time.Minute)
+	require.NoError(t, err)
+
+	// A message captured on one agent's connection is no good on another's,
+	// or on a later session of the same agent
+	require.ErrorIs(t, v.Verify(signed(t, signer, time.Now()), Scope{AgentID: "agent-2", SessionID: "session-1"}), ErrBadSignature)
+	require.ErrorIs(t, v.Verify(signed(t, signer, time.Now()), Scope{AgentID: "agent-1", SessionID: "session-2"}), ErrBadSignature)
+	require.ErrorIs(t, v.Verify(signed(t, signer, time.Now()), Scope{AgentID: "agent-1"}), ErrBadSignature)
+
+	require.NoError(t, v.Verify(signed(t, signer, time.Now()), testScope))
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	v, err := NewVerifier([]byte("shared-secret"), nil, time.Minute)
+	require.NoError(t, err)
+
+	msg := protocol.Message{Type: protocol.TypeCommand, ID: "cmd-1", Timestamp: time.Now()}
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrUnsigned)
+
+	msg = signed(t, NewHMACSigner([]byte("shared-secret")), time.Now())
+	msg.Nonce = ""
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrUnsigned)
+
+	_, err = NewVerifier(nil, nil, time.Minute)
+	require.Error(t, err)
+}
+
+func TestVerifyClockSkew(t *testing.T) {
+	signer := NewHMACSigner([]byte("shared-secret"))
+	v, err := NewVerifier([]byte("shared-secret"), nil, time.Minute)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, v.Verify(signed(t, signer, time.Now().Add(-2*time.Minute)), testScope), ErrStale)
+	require.ErrorIs(t, v.Verify(signed(t, signer, time.Now().Add(2*time.Minute)), testScope), ErrStale)
+
+	require.NoError(t, v.Verify(signed(t, signer, time.Now().Add(-30*time.Second)), testScope))
+	require.NoError(t, v.Verify(signed(t, signer, time.Now().Add(30*time.Second)), testScope))
+}
+
+func TestVerifyReplayAndPruning(t *testing.T) {
+	signer := NewHMACSigner([]byte("shared-secret"))
+	v, err := NewVerifier([]byte("shared-secret"), nil, 100*time.Millisecond)
+	require.NoError(t, err)
+
+	msg := signed(t, signer, time.Now())
+	require.NoError(t, v.Verify(msg, testScope))
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrReplayed)
+
+	// Once the message is too old to be accepted, its nonce is forgotten and
+	// the replay is refused as stale instead
+	time.Sleep(150 * time.Millisecond)
+	require.ErrorIs(t, v.Verify(msg, testScope), ErrStale)
+
+	v.mu.Lock()
+	v.lastPrune = time.Time{}
+	v.mu.Unlock()
+
+	require.NoError(t, v.Verify(signed(t, signer, time.Now()), testScope))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	require.Len(t, v.nonces, 1)
+	require.NotContains(t, v.nonces, msg.Nonce)
+}
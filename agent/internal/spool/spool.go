@@ -0,0 +1,279 @@
+// Package spool persists outbound protocol messages while the agent is
+// disconnected so they can be delivered once the connection comes back
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/atomicfile"
+	"shh/agent/internal/protocol"
+)
+
+// Priority orders spooled messages; higher priorities are flushed first and
+// evicted last
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// DefaultLimit is the number of messages kept when no limit is configured
+const DefaultLimit = 1000
+
+// ErrFull indicates the spool is at capacity and every queued message is
+// more important than the one being added
+var ErrFull = errors.New("spool is full")
+
+// PriorityFor returns the spool priority of a message type. Command results
+// outrank everything else, heartbeats are the first to go.
+func PriorityFor(t protocol.MessageType) Priority {
+	switch t {
+	case protocol.TypeResult, protocol.TypeResultChunk:
+		return PriorityHigh
+	case protocol.TypeHeartbeat:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+type entry struct {
+	priority Priority
+	seq      uint64
+	path     string
+}
+
+// Spool is a bounded on-disk message queue. Each message is stored in its own
+// file so a crash can lose at most the message being written.
+type Spool struct {
+	dir     string
+	limit   int
+	logger  *zap.Logger
+	mu      sync.Mutex
+	entries []*entry
+	seq     uint64
+}
+
+// New opens the spool in dir, loading any messages left by a previous run
+func New(dir string, limit int, logger *zap.Logger) (*Spool, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		dir:    dir,
+		limit:  limit,
+		logger: logger,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if len(s.entries) > 0 {
+		logger.Info("Loaded spooled messages",
+			zap.String("dir", dir),
+			zap.Int("count", len(s.entries)))
+	}
+
+	return s, nil
+}
+
+// load rebuilds the in-memory index from the files in the spool directory
+func (s *Spool) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(s.dir, name)
+
+		if strings.HasSuffix(name, ".tmp") {
+			// Interrupted write from a previous run
+			os.Remove(path)
+			continue
+		}
+
+		var e entry
+		if _, err := fmt.Sscanf(name, "%d-%d.json", &e.priority, &e.seq); err != nil {
+			s.logger.Warn("Ignoring unexpected file in spool",
+				zap.String("file", path))
+			continue
+		}
+		e.path = path
+
+		s.entries = append(s.entries, &e)
+		if e.seq > s.seq {
+			s.seq = e.seq
+		}
+	}
+
+	s.sort()
+	return nil
+}
+
+// sort orders entries by priority, then by the order they were added
+func (s *Spool) sort() {
+	sort.Slice(s.entries, func(i, j int) bool {
+		if s.entries[i].priority != s.entries[j].priority {
+			return s.entries[i].priority > s.entries[j].priority
+		}
+		return s.entries[i].seq < s.entries[j].seq
+	})
+}
+
+// Push writes msg to disk. When the spool is full the oldest message of the
+// lowest priority is evicted, as long as it is not more important than msg.
+func (s *Spool) Push(msg protocol.Message) error {
+	priority := PriorityFor(msg.Type)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) >= s.limit {
+		if err := s.evict(priority); err != nil {
+			return err
+		}
+	}
+
+	s.seq++
+	e := &entry{
+		priority: priority,
+		seq:      s.seq,
+	}
+	e.path = filepath.Join(s.dir, fmt.Sprintf("%d-%020d.json", e.priority, e.seq))
+
+	if err := atomicfile.Write(e.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+
+	s.entries = append(s.entries, e)
+	s.sort()
+
+	return nil
+}
+
+// evict drops the oldest entry of the lowest priority to make room for a
+// message of the given priority. Must be called with s.mu held.
+func (s *Spool) evict(priority Priority) error {
+	victim := -1
+	for i, e := range s.entries {
+		if e.priority > priority {
+			continue
+		}
+		if victim == -1 || e.priority < s.entries[victim].priority {
+			victim = i
+		}
+	}
+
+	if victim == -1 {
+		return ErrFull
+	}
+
+	e := s.entries[victim]
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to evict spooled message: %w", err)
+	}
+	s.entries = append(s.entries[:victim], s.entries[victim+1:]...)
+
+	s.logger.Warn("Spool full, dropped message",
+		zap.String("file", e.path),
+		zap.Int("priority", int(e.priority)))
+
+	return nil
+}
+
+// Len returns the number of spooled messages
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Flush hands spooled messages to send in order, removing each one once send
+// succeeds. It stops at the first error and returns the number delivered.
+func (s *Spool) Flush(send func(protocol.Message) error) (int, error) {
+	sent := 0
+	for {
+		s.mu.Lock()
+		if len(s.entries) == 0 {
+			s.mu.Unlock()
+			return sent, nil
+		}
+		e := s.entries[0]
+		s.mu.Unlock()
+
+		msg, err := readFile(e.path)
+		if err != nil {
+			s.logger.Error("Discarding unreadable spooled message",
+				zap.String("file", e.path),
+				zap.Error(err))
+			s.remove(e)
+			continue
+		}
+
+		if err := send(msg); err != nil {
+			return sent, err
+		}
+
+		s.remove(e)
+		sent++
+	}
+}
+
+// remove deletes e from disk and from the index
+func (s *Spool) remove(e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, cur := range s.entries {
+		if cur == e {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		s.logger.Error("Failed to remove spooled message",
+			zap.String("file", e.path),
+			zap.Error(err))
+	}
+}
+
+// readFile loads a spooled message
+func readFile(path string) (protocol.Message, error) {
+	var msg protocol.Message
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return msg, fmt.Errorf("failed to read spool file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, fmt.Errorf("failed to decode spool file: %w", err)
+	}
+
+	return msg, nil
+}
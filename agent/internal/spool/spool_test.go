@@ -0,0 +1,58 @@
+package spool
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+func TestSpoolOrderEvictionAndReload(t *testing.T) {
+	dir := t.TempDir()
+	logger := zap.NewNop()
+
+	s, err := New(dir, 3, logger)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Push(protocol.Message{Type: protocol.TypeHeartbeat, ID: "hb-1"}))
+	require.NoError(t, s.Push(protocol.Message{Type: protocol.TypeResult, ID: "res-1"}))
+	require.NoError(t, s.Push(protocol.Message{Type: protocol.TypeHeartbeat, ID: "hb-2"}))
+
+	// Full: the oldest heartbeat makes room for a result
+	require.NoError(t, s.Push(protocol.Message{Type: protocol.TypeResult, ID: "res-2"}))
+	require.Equal(t, 3, s.Len())
+
+	// A restart picks up where the previous process left off
+	s, err = New(dir, 3, logger)
+	require.NoError(t, err)
+	require.Equal(t, 3, s.Len())
+
+	// The last heartbeat goes, then heartbeats are refused outright
+	require.NoError(t, s.Push(protocol.Message{Type: protocol.TypeResult, ID: "res-3"}))
+	require.ErrorIs(t, s.Push(protocol.Message{Type: protocol.TypeHeartbeat, ID: "hb-3"}), ErrFull)
+
+	var ids []string
+	sendErr := errors.New("connection lost")
+	sent, err := s.Flush(func(msg protocol.Message) error {
+		if len(ids) == 2 {
+			return sendErr
+		}
+		ids = append(ids, msg.ID)
+		return nil
+	})
+	require.ErrorIs(t, err, sendErr)
+	require.Equal(t, 2, sent)
+	require.Equal(t, []string{"res-1", "res-2"}, ids)
+
+	sent, err = s.Flush(func(msg protocol.Message) error {
+		ids = append(ids, msg.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, sent)
+	require.Equal(t, []string{"res-1", "res-2", "res-3"}, ids)
+	require.Zero(t, s.Len())
+}
@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/policy"
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/websocket"
+)
+
+// execHandler runs commands through a process manager governed by engine
+func execHandler(engine *policy.Engine) func(*websocket.Client) {
+	manager := process.NewManager(zap.NewNop(), process.WithAuthorizer(engine))
+
+	return func(client *websocket.Client) {
+		client.RegisterCommandHandler(protocol.Handle(func(ctx context.Context, msg protocol.Message, cmd protocol.AgentCommand) error {
+			result, err := manager.Execute(ctx, cmd.Command, cmd.Args)
+			var exitErr *exec.ExitError
+			if err != nil && !errors.As(err, &exitErr) {
+				return err
+			}
+
+			payload, err := json.Marshal(protocol.ResultPayload{
+				CommandID: msg.ID,
+				ExitCode:  result.ExitCode,
+				Stdout:    result.Stdout,
+			})
+			if err != nil {
+				return err
+			}
+			return client.SendMessage(protocol.Message{
+				Type:      protocol.TypeResult,
+				ID:        msg.ID,
+				Timestamp: time.Now(),
+				Payload:   payload,
+			})
+		}))
+	}
+}
+
+func TestPolicyDeniesCommand(t *testing.T) {
+	echoPath, err := exec.LookPath("echo")
+	require.NoError(t, err)
+
+	engine, err := policy.New(policy.Policy{
+		Rules: []policy.Rule{
+			{Name: "no-recursive", Action: policy.Deny, Binaries: []string{"*"}, Args: []string{"(.* )?-r( .*)?"}},
+			{Name: "echo", Action: policy.Allow, Binaries: []string{echoPath}},
+		},
+	}, nil, zap.NewNop())
+	require.NoError(t, err)
+
+	server, _ := startAgent(t, execHandler(engine))
+
+	result := runCommand(t, server, protocol.AgentCommand{Command: "echo", Args: []string{"hello"}})
+	require.Nil(t, result.Rejection)
+	var payload protocol.ResultPayload
+	require.NoError(t, json.Unmarshal(result.Payload, &payload))
+	assert.Equal(t, "hello\n", payload.Stdout)
+
+	result = runCommand(t, server, protocol.AgentCommand{Command: "echo", Args: []string{"-r", "x"}})
+	require.NotNil(t, result.Rejection)
+	assert.Equal(t, "no-recursive", result.Rejection.Rule)
+
+	result = runCommand(t, server, protocol.AgentCommand{Command: "true"})
+	require.NotNil(t, result.Rejection)
+	assert.Empty(t, result.Rejection.Rule)
+	assert.Contains(t, result.Rejection.Reason, "not allowed by any rule")
+}
@@ -0,0 +1,205 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"shh/agent/internal/mockserver"
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/websocket"
+)
+
+const testAgentID = "test-agent"
+
+// startAgent runs a mock server and connects a websocket client to it. The
+// client is given its handlers by register before it connects.
+func startAgent(t *testing.T, register func(*websocket.Client), opts ...websocket.ClientOption) (*mockserver.Server, *websocket.Client) {
+	t.Helper()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	server := mockserver.New(logger)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws/agent"
+	opts = append([]websocket.ClientOption{
+		websocket.WithCodecs(protocol.CodecCBOR, protocol.CodecJSON),
+		websocket.WithReconnectDelay(50*time.Millisecond, 200*time.Millisecond),
+	}, opts...)
+	client := websocket.NewClient(url, protocol.AgentInfo{ID: testAgentID, Version: "test"}, logger, opts...)
+	if register != nil {
+		register(client)
+	}
+
+	require.NoError(t, client.Connect(context.Background()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Close(ctx)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := server.WaitForAgent(ctx, testAgentID)
+	require.NoError(t, err)
+
+	return server, client
+}
+
+// echoHandler answers every command with its arguments as stdout
+func echoHandler(client *websocket.Client) {
+	client.RegisterCommandHandler(protocol.Handle(func(ctx context.Context, msg protocol.Message, cmd protocol.AgentCommand) error {
+		switch cmd.Command {
+		case "echo":
+		case "fail":
+			return fmt.Errorf("command failed: %w", process.ErrProcessNotFound)
+		case "sleep":
+			<-ctx.Done()
+			return ctx.Err()
+		default:
+			return fmt.Errorf("unknown command %q", cmd.Command)
+		}
+
+		payload, err := json.Marshal(protocol.ResultPayload{
+			CommandID: msg.ID,
+			Stdout:    strings.Join(cmd.Args, " "),
+		})
+		if err != nil {
+			return err
+		}
+		return client.SendMessage(protocol.Message{
+			Type:      protocol.TypeResult,
+			ID:        msg.ID,
+			Timestamp: time.Now(),
+			Payload:   payload,
+		})
+	}))
+}
+
+func runCommand(t *testing.T, server *mockserver.Server, cmd protocol.AgentCommand) mockserver.Result {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := server.Run(ctx, testAgentID, cmd)
+	require.NoError(t, err)
+	return result
+}
+
+func TestAgentRegistersAndSendsHeartbeats(t *testing.T) {
+	server, client := startAgent(t, echoHandler)
+
+	status, ok := server.Agent(testAgentID)
+	require.True(t, ok)
+	require.Equal(t, protocol.CodecCBOR, status.Codec)
+	require.Equal(t, protocol.ProtocolVersion, status.Registration.ProtocolVersion)
+	require.Contains(t, status.Registration.MessageTypes, protocol.TypeCommand)
+
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+	h.AssertEventually(func() bool { return client.Session().SessionID == status.SessionID },
+		5*time.Second, "client did not record the session")
+
+	payload, err := json.Marshal(protocol.AgentHeartbeat{Status: "healthy", Processes: 3})
+	require.NoError(t, err)
+	require.NoError(t, client.SendMessage(protocol.Message{
+		Type:      protocol.TypeHeartbeat,
+		ID:        "heartbeat-1",
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}))
+
+	h.AssertEventually(func() bool {
+		status, _ := server.Agent(testAgentID)
+		return status.Heartbeats == 1
+	}, 5*time.Second, "heartbeat not received")
+
+	status, _ = server.Agent(testAgentID)
+	require.Equal(t, "healthy", status.LastHeartbeat.Status)
+	require.Equal(t, 3, status.LastHeartbeat.Processes)
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	server, _ := startAgent(t, echoHandler)
+
+	result := runCommand(t, server, protocol.AgentCommand{Command: "echo", Args: []string{"hello", "world"}})
+	require.Nil(t, result.Failure)
+
+	var payload protocol.ResultPayload
+	require.NoError(t, json.Unmarshal(result.Payload, &payload))
+	require.Equal(t, "hello world", payload.Stdout)
+
+	result = runCommand(t, server, protocol.AgentCommand{Command: "fail"})
+	require.NotNil(t, result.Failure)
+	require.Equal(t, protocol.CodeNotFound, result.Failure.Code)
+
+	// An invalid command never reaches the handler but still gets a result
+	result = runCommand(t, server, protocol.AgentCommand{})
+	require.NotNil(t, result.Failure)
+	require.Equal(t, protocol.CodeInvalidPayload, result.Failure.Code)
+}
+
+func TestStreamedResult(t *testing.T) {
+	const lines = 2000
+
+	server, _ := startAgent(t, func(client *websocket.Client) {
+		client.RegisterCommandHandler(protocol.Handle(func(ctx context.Context, msg protocol.Message, cmd protocol.AgentCommand) error {
+			stream := client.NewResultStream(ctx, msg.ID)
+			for i := 0; i < lines; i++ {
+				if err := stream.Write(process.CommandOutput{Stream: "stdout", Line: fmt.Sprintf("line %d", i)}); err != nil {
+					return err
+				}
+			}
+			return stream.Close(7, nil)
+		}))
+	})
+
+	result := runCommand(t, server, protocol.AgentCommand{Command: "seq", Stream: true})
+	require.Equal(t, 7, result.ExitCode)
+	require.Len(t, result.Output, lines)
+	require.Equal(t, "line 0", result.Output[0].Line)
+	require.Equal(t, fmt.Sprintf("line %d", lines-1), result.Output[lines-1].Line)
+}
+
+func TestCancelCommand(t *testing.T) {
+	server, _ := startAgent(t, echoHandler)
+
+	id, err := server.Send(testAgentID, protocol.AgentCommand{Command: "sleep"})
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, server.Cancel(id, "test"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := server.Wait(ctx, id)
+	require.NoError(t, err)
+	require.NotNil(t, result.Failure)
+	require.Equal(t, protocol.CodeCancelled, result.Failure.Code)
+}
+
+func TestReconnectAfterDisconnect(t *testing.T) {
+	server, _ := startAgent(t, echoHandler)
+
+	require.NoError(t, server.Disconnect(testAgentID))
+
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+	h.AssertEventually(func() bool {
+		status, _ := server.Agent(testAgentID)
+		return status.Connected && status.Connections == 2
+	}, 5*time.Second, "agent did not reconnect")
+
+	result := runCommand(t, server, protocol.AgentCommand{Command: "echo", Args: []string{"again"}})
+	require.Nil(t, result.Failure)
+}
@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially growing reconnect delays with jitter
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// Next returns the delay before the next attempt and advances the attempt counter
+func (b *backoff) Next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.base << uint(b.attempt); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempt++
+
+	// Keep half of the delay fixed and randomize the rest so a fleet of agents
+	// doesn't reconnect in lockstep after a server restart
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Attempts returns the number of delays handed out since the last reset
+func (b *backoff) Attempts() int {
+	return b.attempt
+}
+
+// Reset starts the backoff sequence over
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffGrowsToMax(t *testing.T) {
+	b := backoff{base: 100 * time.Millisecond, max: time.Second}
+
+	// Each delay is the doubled base with up to half of it taken off as jitter
+	for _, full := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		delay := b.Next()
+		require.GreaterOrEqual(t, delay, full/2)
+		require.LessOrEqual(t, delay, full)
+	}
+	require.Equal(t, 6, b.Attempts())
+
+	b.Reset()
+	require.Zero(t, b.Attempts())
+	require.LessOrEqual(t, b.Next(), 100*time.Millisecond)
+}
+
+func TestBackoffDoesNotOverflow(t *testing.T) {
+	b := backoff{base: time.Second, max: time.Hour, attempt: 62}
+
+	delay := b.Next()
+	require.GreaterOrEqual(t, delay, 30*time.Minute)
+	require.LessOrEqual(t, delay, time.Hour)
+}
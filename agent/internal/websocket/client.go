@@ -3,70 +3,465 @@ package websocket
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 
+	"shh/agent/internal/enroll"
+	"shh/agent/internal/health"
+	"shh/agent/internal/policy"
 	"shh/agent/internal/protocol"
+	"shh/agent/internal/recorder"
+	"shh/agent/internal/signing"
+	"shh/agent/internal/spool"
+)
+
+// connState describes where the client is in its connection lifecycle
+type connState int
+
+const (
+	stateDisconnected connState = iota
+	stateConnected
+	stateReconnecting
+	stateClosed
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateConnected:
+		return "connected"
+	case stateReconnecting:
+		return "reconnecting"
+	case stateClosed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+const (
+	defaultReconnectDelay    = 5 * time.Second
+	defaultMaxReconnectDelay = 2 * time.Minute
 )
 
 type Client struct {
-	url       string
+	urls      []string
+	current   int
 	agentInfo protocol.AgentInfo
-	conn      *websocket.Conn
+	conn      Conn
 	logger    *zap.Logger
 	handlers  map[protocol.MessageType]protocol.MessageHandler
+	ordered   map[protocol.MessageType]protocol.MessageHandler // Run on the read loop
 	done      chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
 	mu        sync.RWMutex
+
+	state     connState
+	running   bool
+	backoff   backoff
+	lastError error
+
+	spool   *spool.Spool
+	flushCh chan struct{}
+
+	requestTimeout time.Duration
+	pending        map[string]chan protocol.Message
+	pendingMu      sync.Mutex
+
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	latency      time.Duration
+	lastPong     time.Time
+
+	tls *TLSLoader
+
+	session      protocol.RegisterAck
+	onRegistered []func(protocol.RegisterAck)
+
+	dispatcher *dispatcher
+	verifier   *signing.Verifier
+	scope      signing.Scope // agent and session server messages are signed for
+	enroll     *enroll.Store
+
+	// credMu orders credentials issued in registration acks after rotations,
+	// which are counted so an ack cannot overwrite a newer credential
+	credMu    sync.Mutex
+	rotations uint64
+
+	failbackInterval time.Duration
+	failback         bool
+
+	proxy func(*http.Request) (*url.URL, error)
+
+	transports       []Transport
+	longPollFallback bool
+	transport        string
+	connSeq          uint64 // Numbers connections for the recorder
+
+	recorder *recorder.Recorder
+
+	registry *protocol.Registry
+
+	classifiers []protocol.ErrorClassifier // Map command failures to error codes
+
+	codecs           []string
+	compressionLevel int
+
+	streams   map[string]*ResultStream
+	streamsMu sync.Mutex
+
+	results   map[string]bool // Commands awaiting a terminal response, and whether it was sent
+	resultsMu sync.Mutex
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithReconnectDelay sets the initial and maximum delay between reconnect attempts
+func WithReconnectDelay(delay, maxDelay time.Duration) ClientOption {
+	return func(c *Client) {
+		if delay > 0 {
+			c.backoff.base = delay
+		}
+		if maxDelay > 0 {
+			c.backoff.max = maxDelay
+		}
+		if c.backoff.max < c.backoff.base {
+			c.backoff.max = c.backoff.base
+		}
+	}
+}
+
+// WithSpool queues outbound messages in s while the client is disconnected
+func WithSpool(s *spool.Spool) ClientOption {
+	return func(c *Client) {
+		c.spool = s
+	}
+}
+
+// WithTLS dials the server with the certificates managed by loader
+func WithTLS(loader *TLSLoader) ClientOption {
+	return func(c *Client) {
+		c.tls = loader
+	}
+}
+
+// WithErrorClassifier adds a mapping from command failures to error codes,
+// consulted after the built-in mapping of process and policy errors
+func WithErrorClassifier(classify protocol.ErrorClassifier) ClientOption {
+	return func(c *Client) {
+		c.classifiers = append(c.classifiers, classify)
+	}
+}
+
+// WithVerifier requires every server message to carry a valid signature.
+// Messages that fail verification are dropped and reported to the server.
+func WithVerifier(v *signing.Verifier) ClientOption {
+	return func(c *Client) {
+		c.verifier = v
+	}
+}
+
+// WithEnrollment registers with the identity kept in store, enrolling with
+// its bootstrap token first if needed, and persists credentials the server
+// issues or rotates
+func WithEnrollment(store *enroll.Store) ClientOption {
+	return func(c *Client) {
+		c.enroll = store
+	}
+}
+
+// WithProxy selects the HTTP proxy the connection is tunnelled through. The
+// default honours HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(c *Client) {
+		c.proxy = proxy
+	}
 }
 
-func NewClient(url string, agentInfo protocol.AgentInfo, logger *zap.Logger) *Client {
-	return &Client{
-		url:       url,
+// WithRegistry validates incoming payloads against r instead of
+// protocol.DefaultRegistry. Messages that fail are rejected before any
+// handler runs.
+func WithRegistry(r *protocol.Registry) ClientOption {
+	return func(c *Client) {
+		c.registry = r
+	}
+}
+
+// WithCodecs offers the named codecs to the server, most preferred first.
+// The server picks one per connection; JSON is always offered as a fallback.
+func WithCodecs(names ...string) ClientOption {
+	return func(c *Client) {
+		c.codecs = nil
+		for _, name := range names {
+			if _, err := protocol.LookupCodec(name); err != nil {
+				c.logger.Warn("Ignoring unsupported codec", zap.String("codec", name))
+				continue
+			}
+			if name != protocol.CodecJSON {
+				c.codecs = append(c.codecs, name)
+			}
+		}
+		c.codecs = append(c.codecs, protocol.CodecJSON)
+	}
+}
+
+// WithCompression negotiates permessage-deflate at the given flate level
+// (1 fastest to 9 smallest). Zero disables compression.
+func WithCompression(level int) ClientOption {
+	return func(c *Client) {
+		c.compressionLevel = level
+	}
+}
+
+// WithRecorder writes every message sent or received to rec
+func WithRecorder(rec *recorder.Recorder) ClientOption {
+	return func(c *Client) {
+		c.recorder = rec
+	}
+}
+
+func NewClient(url string, agentInfo protocol.AgentInfo, logger *zap.Logger, opts ...ClientOption) *Client {
+	c := &Client{
+		urls:      []string{url},
 		agentInfo: agentInfo,
 		logger:    logger,
 		handlers:  make(map[protocol.MessageType]protocol.MessageHandler),
+		ordered:   make(map[protocol.MessageType]protocol.MessageHandler),
 		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+		flushCh:   make(chan struct{}, 1),
+		pending:   make(map[string]chan protocol.Message),
+		streams:   make(map[string]*ResultStream),
+		results:   make(map[string]bool),
+		backoff: backoff{
+			base: defaultReconnectDelay,
+			max:  defaultMaxReconnectDelay,
+		},
+		requestTimeout: defaultRequestTimeout,
+		pingInterval:   defaultPingInterval,
+		pongTimeout:    defaultPongTimeout,
+
+		failbackInterval: defaultFailbackInterval,
+		proxy:            http.ProxyFromEnvironment,
+		registry:         protocol.DefaultRegistry,
+		classifiers:      []protocol.ErrorClassifier{processErrorCode},
+		codecs:           []string{protocol.CodecJSON},
+		longPollFallback: true,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.dispatcher == nil {
+		c.dispatcher = newDispatcher(logger, 0, 0, nil)
 	}
+	if c.transports == nil {
+		c.transports = c.defaultTransports()
+	}
+	c.dispatcher.dropped = c.commandDropped
+
+	return c
 }
 
+// Connect dials the server and starts the supervisor that keeps the
+// connection alive. Only the initial dial is reported to the caller; later
+// disconnects are retried with backoff until the client is closed.
 func (c *Client) Connect(ctx context.Context) error {
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
 	}
 
-	conn, _, err := dialer.DialContext(ctx, c.url, nil)
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+
+	go c.run(ctx, conn)
+	if len(c.urls) > 1 {
+		go c.failbackLoop(ctx)
+	}
+	if c.spool != nil {
+		go c.flushLoop(ctx)
+		c.triggerFlush()
+	}
+
+	return nil
+}
+
+// dial connects to the first server, in order of preference, that accepts
+// the registration
+func (c *Client) dial(ctx context.Context) (Conn, error) {
+	var errs []error
+
+	for i, url := range c.urls {
+		conn, err := c.dialServer(ctx, i)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(c.urls) {
+			c.logger.Warn("Server unreachable, trying next",
+				zap.String("server", url),
+				zap.Error(err))
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dialServer opens a new connection to c.urls[i] and registers the agent on it
+func (c *Client) dialServer(ctx context.Context, i int) (Conn, error) {
+	url := c.urls[i]
+
+	conn, transport, err := c.open(ctx, url)
 	if err != nil {
-		return fmt.Errorf("failed to connect to websocket: %w", err)
+		return nil, err
 	}
 
 	c.mu.Lock()
 	c.conn = conn
+	c.transport = transport
+	c.connSeq++
 	c.mu.Unlock()
 
-	// Send registration message with agent info
-	regMsg := protocol.Message{
-		Type:      protocol.TypeRegister,
-		ID:        fmt.Sprintf("register-%d", time.Now().UnixNano()),
-		Timestamp: time.Now(),
+	rotations := c.credentialRotations()
+	regID, reply, err := c.register(conn)
+	if err != nil {
+		c.dropConn(conn)
+		return nil, err
 	}
 
-	regPayload, err := json.Marshal(c.agentInfo)
-	if err != nil {
-		return fmt.Errorf("failed to marshal agent info: %w", err)
+	c.mu.Lock()
+	c.state = stateConnected
+	c.current = i
+	c.lastError = nil
+	c.session = protocol.RegisterAck{}
+	c.backoff.Reset()
+	c.mu.Unlock()
+
+	if i > 0 {
+		c.logger.Warn("Connected to fallback server",
+			zap.String("server", url),
+			zap.String("transport", transport))
+	} else {
+		c.logger.Info("Connected to server",
+			zap.String("server", url),
+			zap.String("transport", transport))
 	}
-	regMsg.Payload = regPayload
 
-	if err := c.SendMessage(regMsg); err != nil {
-		return fmt.Errorf("failed to send registration message: %w", err)
+	go c.awaitRegistration(conn, regID, reply, rotations)
+	c.triggerFlush()
+
+	return conn, nil
+}
+
+// run supervises the connection, reconnecting whenever the read loop exits
+func (c *Client) run(ctx context.Context, conn Conn) {
+	defer close(c.done)
+
+	for {
+		c.readPump(conn)
+
+		if c.stopping(ctx) {
+			return
+		}
+
+		c.mu.Lock()
+		c.state = stateReconnecting
+		c.mu.Unlock()
+
+		// A deliberate failback redials at once rather than after a backoff
+		if c.takeFailback() {
+			next, err := c.dial(ctx)
+			if err == nil {
+				conn = next
+				continue
+			}
+			c.logger.Warn("Failback dial failed", zap.Error(err))
+		}
+
+		var ok bool
+		if conn, ok = c.reconnect(ctx); !ok {
+			return
+		}
 	}
+}
 
-	go c.readPump()
+// reconnect dials until it succeeds or the client is stopped
+func (c *Client) reconnect(ctx context.Context) (Conn, bool) {
+	for {
+		c.mu.Lock()
+		delay := c.backoff.Next()
+		attempt := c.backoff.Attempts()
+		c.mu.Unlock()
 
-	return nil
+		c.logger.Info("Reconnecting to server",
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, false
+		case <-c.stop:
+			timer.Stop()
+			return nil, false
+		case <-timer.C:
+		}
+
+		conn, err := c.dial(ctx)
+		if err == nil {
+			c.logger.Info("Reconnected to server", zap.Int("attempts", attempt))
+			return conn, true
+		}
+
+		c.mu.Lock()
+		c.lastError = err
+		c.mu.Unlock()
+
+		c.logger.Warn("Reconnect attempt failed",
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+	}
+}
+
+// stopping reports whether the client has been closed or its context cancelled
+func (c *Client) stopping(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropConn closes conn and clears it if it is still the active connection
+func (c *Client) dropConn(conn Conn) {
+	conn.Close()
+
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		if c.state == stateConnected {
+			c.state = stateDisconnected
+		}
+	}
+	c.mu.Unlock()
 }
 
 func (c *Client) RegisterHandler(messageType protocol.MessageType, handler protocol.MessageHandler) {
@@ -75,55 +470,162 @@ func (c *Client) RegisterHandler(messageType protocol.MessageType, handler proto
 	c.handlers[messageType] = handler
 }
 
-func (c *Client) readPump() {
-	defer func() {
-		c.mu.Lock()
-		if c.conn != nil {
-			c.conn.Close()
-			c.conn = nil
-		}
-		c.mu.Unlock()
-		close(c.done)
-	}()
+// RegisterOrderedHandler registers a handler that runs on the read loop, so
+// messages of its type are handled one at a time in the order they arrived.
+// It holds up every other message while it runs and must not block.
+func (c *Client) RegisterOrderedHandler(messageType protocol.MessageType, handler protocol.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ordered[messageType] = handler
+}
+
+func (c *Client) readPump(conn Conn) {
+	defer c.dropConn(conn)
 
 	for {
-		messageType, data, err := c.conn.ReadMessage()
+		msg, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				c.logger.Error("Unexpected websocket close", zap.Error(err))
-			}
+			c.mu.Lock()
+			c.lastError = err
+			c.mu.Unlock()
 			return
 		}
 
-		if messageType != websocket.TextMessage {
+		c.record(recorder.Inbound, msg)
+
+		// Replies are verified like any other message before they reach the
+		// request waiting on them; one that fails is dropped and the request
+		// times out
+		if c.verifier != nil {
+			if err := c.verifier.Verify(msg, c.signingScope()); err != nil {
+				c.reject(msg, err)
+				continue
+			}
+		}
+
+		if msg.CorrelationID != "" && c.resolve(msg) {
+			if msg.Type == protocol.TypeRegistered {
+				c.enterSession(msg)
+			}
+			continue
+		}
+
+		if err := c.registry.Validate(msg); err != nil {
+			if msg.Type == protocol.TypeCommand {
+				// The server is waiting on a result for the command, so the
+				// failure is reported there rather than as a rejection
+				c.commandDropped(msg, err)
+			} else {
+				c.reject(msg, err)
+			}
 			continue
 		}
 
-		var msg protocol.Message
-		if err := json.Unmarshal(data, &msg); err != nil {
-			c.logger.Error("Failed to unmarshal message", zap.Error(err))
+		switch msg.Type {
+		case protocol.TypeCancel:
+			c.handleCancel(msg)
+			continue
+		case protocol.TypeResultAck:
+			c.handleResultAck(msg)
+			continue
+		case protocol.TypeCredentials:
+			c.handleCredentials(msg)
 			continue
 		}
 
 		c.mu.RLock()
+		ordered, isOrdered := c.ordered[msg.Type]
 		handler, exists := c.handlers[msg.Type]
 		c.mu.RUnlock()
 
+		if isOrdered {
+			if err := ordered(context.Background(), msg); err != nil {
+				c.logger.Error("Handler failed",
+					zap.String("type", string(msg.Type)),
+					zap.String("id", msg.ID),
+					zap.Error(err))
+			}
+			continue
+		}
+
 		if !exists {
 			c.logger.Warn("No handler registered for message type",
 				zap.String("type", string(msg.Type)))
 			continue
 		}
 
-		if err := handler(context.Background(), msg); err != nil {
-			c.logger.Error("Handler failed",
+		if err := c.dispatcher.dispatch(msg, handler); err != nil {
+			c.logger.Error("Failed to dispatch message",
 				zap.String("type", string(msg.Type)),
+				zap.String("id", msg.ID),
 				zap.Error(err))
+			c.commandDropped(msg, err)
 		}
 	}
 }
 
+// SendMessage sends msg to the server. With a spool configured, messages are
+// queued on disk instead of failing while the client is disconnected, and
+// they keep queueing behind older spooled messages until the backlog drains.
 func (c *Client) SendMessage(msg protocol.Message) error {
+	if msg.Type != protocol.TypeResult {
+		return c.deliver(msg)
+	}
+
+	if !c.claimResult(msg.ID) {
+		c.logger.Warn("Dropping duplicate result for command", zap.String("id", msg.ID))
+		return nil
+	}
+
+	if err := c.deliver(msg); err != nil {
+		c.releaseResult(msg.ID)
+		return err
+	}
+
+	return nil
+}
+
+// deliver sends msg, or spools it while disconnected or behind a backlog
+func (c *Client) deliver(msg protocol.Message) error {
+	if c.spool == nil {
+		return c.send(msg)
+	}
+
+	c.mu.RLock()
+	connected := c.conn != nil
+	c.mu.RUnlock()
+
+	if connected && c.spool.Len() == 0 {
+		err := c.send(msg)
+		if err == nil {
+			return nil
+		}
+		c.logger.Warn("Send failed, spooling message",
+			zap.String("type", string(msg.Type)),
+			zap.String("id", msg.ID),
+			zap.Error(err))
+	}
+
+	if err := c.spool.Push(msg); err != nil {
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+
+	if connected {
+		c.triggerFlush()
+	}
+
+	return nil
+}
+
+// SendNow sends msg over the active connection, bypassing the spool, and
+// fails while disconnected. It is for messages that are no use late or must
+// not be written to disk, such as terminal output.
+func (c *Client) SendNow(msg protocol.Message) error {
+	return c.send(msg)
+}
+
+// send writes msg to the active connection
+func (c *Client) send(msg protocol.Message) error {
 	c.mu.RLock()
 	conn := c.conn
 	c.mu.RUnlock()
@@ -132,59 +634,215 @@ func (c *Client) SendMessage(msg protocol.Message) error {
 		return fmt.Errorf("not connected")
 	}
 
-	data, err := json.Marshal(msg)
+	if err := conn.WriteMessage(msg); err != nil {
+		return err
+	}
+
+	c.record(recorder.Outbound, msg)
+	return nil
+}
+
+// record adds msg to the recording, if one is being made
+func (c *Client) record(dir recorder.Direction, msg protocol.Message) {
+	if c.recorder == nil {
+		return
+	}
+
+	c.mu.RLock()
+	entry := recorder.Entry{
+		Conn:      c.connSeq,
+		Direction: dir,
+		Server:    c.urls[c.current],
+		Transport: c.transport,
+		Message:   msg,
+	}
+	c.mu.RUnlock()
+
+	if err := c.recorder.Record(entry); err != nil {
+		c.logger.Warn("Failed to record message", zap.Error(err))
+	}
+}
+
+// triggerFlush wakes the flush loop without blocking
+func (c *Client) triggerFlush() {
+	select {
+	case c.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop drains the spool whenever a connection is (re)established or new
+// messages are queued behind a backlog
+func (c *Client) flushLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-c.flushCh:
+		}
+
+		sent, err := c.spool.Flush(c.send)
+		if sent > 0 {
+			c.logger.Info("Flushed spooled messages",
+				zap.Int("count", sent),
+				zap.Int("remaining", c.spool.Len()))
+		}
+		if err != nil {
+			c.logger.Warn("Spool flush interrupted", zap.Error(err))
+		}
+	}
+}
+
+// signingScope returns the agent and session server messages must be signed for
+func (c *Client) signingScope() signing.Scope {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.scope
+}
+
+// enterSession scopes signatures to the session assigned by a verified
+// registration ack, and to the agent ID it issued if the agent just enrolled.
+// It runs on the read loop so the very next message is already checked
+// against the new scope.
+func (c *Client) enterSession(msg protocol.Message) {
+	ack, err := protocol.DecodePayload[protocol.RegisterAck](msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		// awaitRegistration reports the invalid ack and drops the connection
+		return
 	}
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.scope.SessionID = ack.SessionID
+	if ack.Credentials != nil && ack.Credentials.AgentID != "" {
+		c.scope.AgentID = ack.Credentials.AgentID
+	}
+	c.mu.Unlock()
+}
 
-	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		return fmt.Errorf("failed to write message: %w", err)
+// reject drops a message that failed verification or was refused by the
+// local policy, and tells the server why
+func (c *Client) reject(msg protocol.Message, reason error) {
+	c.logger.Warn("Rejected server message",
+		zap.String("type", string(msg.Type)),
+		zap.String("id", msg.ID),
+		zap.Error(reason))
+
+	rejection := protocol.Rejection{
+		ID:     msg.ID,
+		Type:   msg.Type,
+		Reason: reason.Error(),
+	}
+	var payloadErr *protocol.PayloadError
+	if errors.As(reason, &payloadErr) {
+		rejection.Field = payloadErr.Field()
+	}
+	var denial *policy.Denial
+	if errors.As(reason, &denial) {
+		rejection.Rule = denial.Rule
 	}
 
-	return nil
+	payload, err := json.Marshal(rejection)
+	if err != nil {
+		c.logger.Error("Failed to marshal rejection", zap.Error(err))
+		return
+	}
+
+	// Rejections are only meaningful on the connection that carried the
+	// message, so they bypass the spool
+	if err := c.send(protocol.Message{
+		Type:          protocol.TypeRejected,
+		ID:            fmt.Sprintf("reject-%d", time.Now().UnixNano()),
+		CorrelationID: msg.ID,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+	}); err != nil {
+		c.logger.Error("Failed to send rejection", zap.Error(err))
+	}
 }
 
 func (c *Client) Close(ctx context.Context) error {
+	c.stopOnce.Do(func() { close(c.stop) })
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	conn := c.conn
+	running := c.running
+	c.conn = nil
+	c.state = stateClosed
+	c.mu.Unlock()
 
-	if c.conn != nil {
+	if conn != nil {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			if err := c.conn.WriteMessage(websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
-				c.logger.Warn("Error sending close message", zap.Error(err))
-			}
-			if err := c.conn.Close(); err != nil {
+			if err := conn.Close(); err != nil {
 				return fmt.Errorf("error closing connection: %w", err)
 			}
-			c.conn = nil
 		}
 	}
 
-	select {
-	case <-c.done:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+	if running {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+
+	return c.dispatcher.Shutdown(ctx)
 }
 
-func (c *Client) HealthCheck(ctx context.Context) error {
+// HealthCheck reports the connection state. The check is degraded rather
+// than unhealthy while the supervisor is trying to reconnect.
+func (c *Client) HealthCheck(ctx context.Context) *health.CheckResult {
 	c.mu.RLock()
-	conn := c.conn
+	state := c.state
+	attempts := c.backoff.Attempts()
+	lastErr := c.lastError
+	latency := c.latency
+	lastPong := c.lastPong
+	transport := c.transport
 	c.mu.RUnlock()
 
-	if conn == nil {
-		return fmt.Errorf("not connected")
+	session := c.Session()
+
+	result := &health.CheckResult{
+		Status:    health.StatusHealthy,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"state":              state.String(),
+			"reconnect_attempts": attempts,
+			"inflight":           c.dispatcher.InFlight(),
+			"server":             c.Server(),
+			"transport":          transport,
+		},
 	}
 
-	return nil
+	if session.ProtocolVersion > 0 {
+		result.Metadata["protocol_version"] = session.ProtocolVersion
+		result.Metadata["session_id"] = session.SessionID
+	}
+
+	if !lastPong.IsZero() {
+		result.Metadata["latency_ms"] = float64(latency) / float64(time.Millisecond)
+		result.Metadata["last_pong"] = lastPong
+	}
+
+	switch state {
+	case stateConnected:
+	case stateReconnecting:
+		result.Status = health.StatusDegraded
+		result.Message = "reconnecting to server"
+		result.Error = lastErr
+	default:
+		result.Status = health.StatusUnhealthy
+		result.Message = "not connected"
+		result.Error = fmt.Errorf("not connected")
+	}
+
+	return result
 }
 
 func (c *Client) Shutdown(ctx context.Context) error {
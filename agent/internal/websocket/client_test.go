@@ -0,0 +1,354 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/health"
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/signing"
+	"shh/agent/internal/spool"
+)
+
+// testServer accepts agent connections and hands them to the test
+type testServer struct {
+	*httptest.Server
+	conns chan *websocket.Conn
+
+	// refuse makes the server answer upgrades with 503
+	refuse atomic.Bool
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	s := &testServer{conns: make(chan *websocket.Conn, 8)}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.refuse.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.conns <- conn
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// wsURL is the address agents connect to
+func (s *testServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// accept waits for the next agent connection
+func (s *testServer) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	select {
+	case conn := <-s.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not connect")
+		return nil
+	}
+}
+
+// expectNoConn fails if an agent connects within d
+func (s *testServer) expectNoConn(t *testing.T, d time.Duration) {
+	t.Helper()
+
+	select {
+	case conn := <-s.conns:
+		conn.Close()
+		t.Fatal("agent connected unexpectedly")
+	case <-time.After(d):
+	}
+}
+
+// readMessage reads the next message the agent sent on conn
+func readMessage(t *testing.T, conn *websocket.Conn) protocol.Message {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	var msg protocol.Message
+	require.NoError(t, json.Unmarshal(data, &msg))
+	return msg
+}
+
+// newClient creates a client for s that retries quickly
+func newClient(t *testing.T, s *testServer, opts ...ClientOption) *Client {
+	t.Helper()
+
+	opts = append([]ClientOption{WithReconnectDelay(10*time.Millisecond, 50*time.Millisecond)}, opts...)
+	c := NewClient(s.wsURL(), protocol.AgentInfo{ID: "agent-1", Version: "test"}, zap.NewNop(), opts...)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Close(ctx)
+	})
+
+	return c
+}
+
+// newTestClient connects a new client to s
+func newTestClient(t *testing.T, s *testServer, opts ...ClientOption) *Client {
+	t.Helper()
+
+	c := newClient(t, s, opts...)
+	require.NoError(t, c.Connect(context.Background()))
+	return c
+}
+
+// requireRegistration reads the registration for agentID sent on conn
+func requireRegistration(t *testing.T, conn *websocket.Conn, agentID string) protocol.Message {
+	t.Helper()
+
+	msg := readMessage(t, conn)
+	require.Equal(t, protocol.TypeRegister, msg.Type)
+
+	var info protocol.AgentInfo
+	require.NoError(t, json.Unmarshal(msg.Payload, &info))
+	require.Equal(t, agentID, info.ID)
+
+	return msg
+}
+
+func TestConnectReportsDialFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.Close()
+
+	c := NewClient(s.wsURL(), protocol.AgentInfo{ID: "agent-1"}, zap.NewNop())
+	require.Error(t, c.Connect(context.Background()))
+	require.Equal(t, health.StatusUnhealthy, c.HealthCheck(context.Background()).Status)
+}
+
+func TestReconnectReregisters(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+	require.Equal(t, health.StatusHealthy, c.HealthCheck(context.Background()).Status)
+
+	// Every new connection registers again, however it was lost
+	for i := 0; i < 2; i++ {
+		conn.Close()
+		conn = s.accept(t)
+		requireRegistration(t, conn, "agent-1")
+	}
+
+	require.Eventually(t, func() bool {
+		return c.HealthCheck(context.Background()).Status == health.StatusHealthy
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReconnectBacksOffWhileServerIsDown(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	// Refuse connections until the client has failed a few times
+	s.refuse.Store(true)
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		check := c.HealthCheck(context.Background())
+		return check.Status == health.StatusDegraded && check.Metadata["reconnect_attempts"].(int) >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Once the server is back the client registers and the counter resets
+	s.refuse.Store(false)
+	requireRegistration(t, s.accept(t), "agent-1")
+	require.Eventually(t, func() bool {
+		check := c.HealthCheck(context.Background())
+		return check.Status == health.StatusHealthy && check.Metadata["reconnect_attempts"].(int) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCloseStopsReconnecting(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, c.Close(ctx))
+
+	s.expectNoConn(t, 200*time.Millisecond)
+	require.Error(t, c.SendMessage(protocol.Message{Type: protocol.TypeHeartbeat}))
+}
+
+func TestSpoolFlushesInPriorityOrderAfterReconnect(t *testing.T) {
+	sp, err := spool.New(t.TempDir(), 10, zap.NewNop())
+	require.NoError(t, err)
+
+	s := newTestServer(t)
+	c := newTestClient(t, s, WithSpool(sp))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	s.refuse.Store(true)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return c.HealthCheck(context.Background()).Status == health.StatusDegraded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Sending while disconnected queues instead of failing
+	for _, msg := range []protocol.Message{
+		{Type: protocol.TypeHeartbeat, ID: "hb-1"},
+		{Type: protocol.TypeResult, ID: "res-1"},
+		{Type: protocol.TypeLogs, ID: "logs-1"},
+		{Type: protocol.TypeResult, ID: "res-2"},
+	} {
+		require.NoError(t, c.SendMessage(msg))
+	}
+	require.Equal(t, 4, sp.Len())
+
+	// Registration goes first, then results, then everything else, oldest first
+	s.refuse.Store(false)
+	conn = s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+	for _, id := range []string{"res-1", "res-2", "logs-1", "hb-1"} {
+		require.Equal(t, id, readMessage(t, conn).ID)
+	}
+	require.Eventually(t, func() bool { return sp.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// With the backlog drained messages go straight out again
+	require.NoError(t, c.SendMessage(protocol.Message{Type: protocol.TypeResult, ID: "res-3"}))
+	require.Equal(t, "res-3", readMessage(t, conn).ID)
+	require.Zero(t, sp.Len())
+}
+
+func TestSendNowSkipsSpool(t *testing.T) {
+	sp, err := spool.New(t.TempDir(), 10, zap.NewNop())
+	require.NoError(t, err)
+
+	s := newTestServer(t)
+	c := newTestClient(t, s, WithSpool(sp))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	require.NoError(t, c.SendNow(protocol.Message{Type: protocol.TypeSessionOutput, ID: "out-1"}))
+	require.Equal(t, "out-1", readMessage(t, conn).ID)
+
+	s.refuse.Store(true)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return c.HealthCheck(context.Background()).Status == health.StatusDegraded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Nothing is queued on disk while disconnected
+	require.Error(t, c.SendNow(protocol.Message{Type: protocol.TypeSessionOutput, ID: "out-2"}))
+	require.Zero(t, sp.Len())
+}
+
+// writeSigned signs msg for scope and sends it to the agent on conn
+func writeSigned(t *testing.T, conn *websocket.Conn, signer *signing.Signer, scope signing.Scope, msg protocol.Message) {
+	t.Helper()
+
+	require.NoError(t, signer.Sign(&msg, scope))
+	writeMessage(t, conn, msg)
+}
+
+func TestSignedMessagesAreScopedToSession(t *testing.T) {
+	key := []byte("shared-secret")
+	verifier, err := signing.NewVerifier(key, nil, time.Minute)
+	require.NoError(t, err)
+	signer := signing.NewHMACSigner(key)
+
+	s := newTestServer(t)
+	c := newClient(t, s, WithVerifier(verifier))
+	acks := registeredAcks(c)
+	handled := make(chan string, 4)
+	c.RegisterHandler(protocol.TypeCommand, func(ctx context.Context, msg protocol.Message) error {
+		handled <- msg.ID
+		return nil
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	reg := requireRegistration(t, conn, "agent-1")
+
+	// The ack is signed before there is a session
+	payload, err := json.Marshal(protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, SessionID: "session-1"})
+	require.NoError(t, err)
+	writeSigned(t, conn, signer, signing.Scope{AgentID: "agent-1"}, protocol.Message{
+		Type:          protocol.TypeRegistered,
+		ID:            "registered-1",
+		CorrelationID: reg.ID,
+		Payload:       payload,
+	})
+	require.Equal(t, "session-1", waitAck(t, acks).SessionID)
+
+	// Messages for another agent or session are rejected
+	for _, scope := range []signing.Scope{
+		{AgentID: "agent-2", SessionID: "session-1"},
+		{AgentID: "agent-1", SessionID: "session-0"},
+		{AgentID: "agent-1"},
+	} {
+		writeSigned(t, conn, signer, scope, protocol.Message{Type: protocol.TypeCommand, ID: "cmd-" + scope.AgentID + scope.SessionID, Payload: json.RawMessage(`{"command":"uptime"}`)})
+		msg := readMessage(t, conn)
+		require.Equal(t, protocol.TypeRejected, msg.Type)
+		require.Equal(t, "cmd-"+scope.AgentID+scope.SessionID, msg.CorrelationID)
+	}
+
+	writeSigned(t, conn, signer, signing.Scope{AgentID: "agent-1", SessionID: "session-1"}, protocol.Message{Type: protocol.TypeCommand, ID: "cmd-1", Payload: json.RawMessage(`{"command":"uptime"}`)})
+	select {
+	case id := <-handled:
+		require.Equal(t, "cmd-1", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("signed command was not handled")
+	}
+	require.Empty(t, handled)
+}
+
+func TestInvalidPayloadIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+	handled := make(chan string, 1)
+	c.RegisterHandler(protocol.TypeUpdate, func(ctx context.Context, msg protocol.Message) error {
+		handled <- msg.ID
+		return nil
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeUpdate, ID: "update-1", Payload: json.RawMessage(`{"version":"1.2.0"}`)})
+
+	msg := readMessage(t, conn)
+	require.Equal(t, protocol.TypeRejected, msg.Type)
+	require.Equal(t, "update-1", msg.CorrelationID)
+
+	var rejection protocol.Rejection
+	require.NoError(t, json.Unmarshal(msg.Payload, &rejection))
+	require.Equal(t, protocol.TypeUpdate, rejection.Type)
+	require.Equal(t, "download_url", rejection.Field)
+	require.Empty(t, handled)
+}
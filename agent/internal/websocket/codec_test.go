@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+// readFrame reads the next message sent on conn, decoding binary frames as CBOR
+func readFrame(t *testing.T, conn *websocket.Conn) (int, protocol.Message) {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	frameType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	codec := protocol.JSON
+	if frameType == websocket.BinaryMessage {
+		codec = protocol.CBOR
+	}
+
+	var msg protocol.Message
+	require.NoError(t, codec.Unmarshal(data, &msg))
+	return frameType, msg
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s, WithCodecs(protocol.CodecCBOR, "msgpack"))
+	acks := registeredAcks(c)
+	c.RegisterRequestHandler(protocol.TypeConfig, func(ctx context.Context, msg protocol.Message) (interface{}, error) {
+		return map[string]string{"received": msg.ID}, nil
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	// The registration is JSON, offering the supported codecs in order
+	conn := s.accept(t)
+	frameType, reg := readFrame(t, conn)
+	require.Equal(t, websocket.TextMessage, frameType)
+
+	var payload protocol.RegisterPayload
+	require.NoError(t, json.Unmarshal(reg.Payload, &payload))
+	require.Equal(t, []string{protocol.CodecCBOR, protocol.CodecJSON}, payload.Codecs)
+
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, Codec: protocol.CodecCBOR})
+	require.Equal(t, protocol.CodecCBOR, waitAck(t, acks).Codec)
+
+	// From then on both sides use binary CBOR frames
+	data, err := protocol.CBOR.Marshal(protocol.Message{
+		Type:      protocol.TypeConfig,
+		ID:        "config-1",
+		Timestamp: time.Now(),
+		Payload:   json.RawMessage(`{"settings":{}}`),
+	})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, data))
+
+	frameType, msg := readFrame(t, conn)
+	require.Equal(t, websocket.BinaryMessage, frameType)
+	require.Equal(t, protocol.TypeResponse, msg.Type)
+	require.Equal(t, "config-1", msg.CorrelationID)
+
+	var resp protocol.AgentResponse
+	require.NoError(t, json.Unmarshal(msg.Payload, &resp))
+	require.True(t, resp.Success)
+	require.JSONEq(t, `{"received":"config-1"}`, string(resp.Data))
+}
+
+func TestCodecNotOfferedIsRefused(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+	acks := registeredAcks(c)
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	reg := requireRegistration(t, conn, "agent-1")
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, Codec: protocol.CodecCBOR})
+
+	// The agent only offered JSON, so it hangs up and registers again
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err := conn.ReadMessage()
+	require.Error(t, err)
+
+	conn = s.accept(t)
+	reg = requireRegistration(t, conn, "agent-1")
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion})
+	require.Equal(t, protocol.CodecJSON, waitAck(t, acks).Codec)
+}
+
+func TestCompressionIsNegotiated(t *testing.T) {
+	extensions := make(chan string, 2)
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extensions <- r.Header.Get("Sec-WebSocket-Extensions")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for level, offered := range map[int]bool{0: false, 6: true} {
+		c := NewClient(url, protocol.AgentInfo{ID: "agent-1"}, zap.NewNop(), WithCompression(level))
+		require.NoError(t, c.Connect(context.Background()))
+		require.Equal(t, offered, strings.Contains(<-extensions, "permessage-deflate"), "level %d", level)
+		require.NoError(t, c.Close(context.Background()))
+	}
+}
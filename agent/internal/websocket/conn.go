@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+// wsTransport connects over a websocket, the preferred transport
+type wsTransport struct {
+	client *Client
+}
+
+func (t *wsTransport) Name() string { return "websocket" }
+
+// dialer returns the websocket dialer used for every server
+func (t *wsTransport) dialer() *websocket.Dialer {
+	c := t.client
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout:  10 * time.Second,
+		Proxy:             c.proxy,
+		EnableCompression: c.compressionLevel != 0,
+	}
+	if c.tls != nil {
+		dialer.TLSClientConfig = c.tls.Config()
+	}
+	return dialer
+}
+
+func (t *wsTransport) Dial(ctx context.Context, url string) (Conn, error) {
+	conn, _, err := t.dialer().DialContext(ctx, url, nil)
+	if errors.Is(err, websocket.ErrBadHandshake) {
+		return nil, fmt.Errorf("%w: %v", ErrUpgradeRefused, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to websocket: %w", err)
+	}
+
+	if t.client.compressionLevel != 0 {
+		// Only takes effect if the server agreed to permessage-deflate
+		conn.SetCompressionLevel(t.client.compressionLevel)
+	}
+
+	w := &wsConn{
+		conn:   conn,
+		client: t.client,
+		codec:  protocol.JSON,
+		stop:   make(chan struct{}),
+	}
+	w.startKeepalive()
+
+	return w, nil
+}
+
+// wsConn carries messages as websocket frames: text frames for JSON and
+// binary frames for binary codecs
+type wsConn struct {
+	conn   *websocket.Conn
+	client *Client
+
+	writeMu sync.Mutex
+	codec   protocol.Codec
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *wsConn) ReadMessage() (protocol.Message, error) {
+	for {
+		messageType, data, err := w.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				w.client.logger.Error("Unexpected websocket close", zap.Error(err))
+			}
+			return protocol.Message{}, err
+		}
+
+		w.extendDeadline()
+
+		// The frame type says how a message is encoded, so messages sent
+		// before and after the codec switch are both read correctly
+		codec := protocol.JSON
+		if messageType == websocket.BinaryMessage {
+			w.writeMu.Lock()
+			if codec = w.codec; !codec.Binary() {
+				codec = protocol.CBOR
+			}
+			w.writeMu.Unlock()
+		}
+
+		var msg protocol.Message
+		if err := codec.Unmarshal(data, &msg); err != nil {
+			w.client.logger.Error("Failed to unmarshal message",
+				zap.String("codec", codec.Name()),
+				zap.Error(err))
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+func (w *wsConn) WriteMessage(msg protocol.Message) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	data, err := w.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	frameType := websocket.TextMessage
+	if w.codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
+	if err := w.conn.WriteMessage(frameType, data); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+func (w *wsConn) Binary() bool { return true }
+
+func (w *wsConn) SetCodec(codec protocol.Codec) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.codec = codec
+}
+
+func (w *wsConn) Close() error {
+	return w.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith sends a close frame, best effort, and closes the connection
+func (w *wsConn) CloseWith(code int, reason string) error {
+	w.stopOnce.Do(func() { close(w.stop) })
+
+	w.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+
+	return w.conn.Close()
+}
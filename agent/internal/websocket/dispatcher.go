@@ -0,0 +1,217 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+var (
+	// ErrDispatchQueueFull indicates too many messages are already waiting for a worker
+	ErrDispatchQueueFull = errors.New("dispatch queue full")
+
+	// ErrDuplicateMessage indicates a message with the same ID is already in flight
+	ErrDuplicateMessage = errors.New("message already in flight")
+)
+
+// dispatcher runs message handlers concurrently on a bounded number of
+// workers, with optional per-type limits. Every in-flight message gets its
+// own context, keyed by message ID, that a cancel message can abort.
+type dispatcher struct {
+	logger    *zap.Logger
+	workers   chan struct{}
+	limits    map[protocol.MessageType]chan struct{}
+	queueSize int
+
+	// dropped is called for messages cancelled before a worker picked them up
+	dropped func(protocol.Message, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc
+}
+
+func newDispatcher(logger *zap.Logger, workers, queueSize int, limits map[protocol.MessageType]int) *dispatcher {
+	if workers <= 0 {
+		workers = runtime.NumCPU() * 2
+	}
+	if queueSize <= 0 {
+		queueSize = workers * 8
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &dispatcher{
+		logger:    logger,
+		workers:   make(chan struct{}, workers),
+		limits:    make(map[protocol.MessageType]chan struct{}),
+		queueSize: queueSize,
+		ctx:       ctx,
+		cancel:    cancel,
+		inflight:  make(map[string]context.CancelFunc),
+	}
+
+	for t, limit := range limits {
+		if limit > 0 {
+			d.limits[t] = make(chan struct{}, limit)
+		}
+	}
+
+	return d
+}
+
+// WithDispatch sets the number of concurrent handler workers, how many
+// messages may wait for one, and per-type concurrency limits
+func WithDispatch(workers, queueSize int, limits map[protocol.MessageType]int) ClientOption {
+	return func(c *Client) {
+		c.dispatcher = newDispatcher(c.logger, workers, queueSize, limits)
+	}
+}
+
+// dispatch schedules handler for msg and returns without waiting for it
+func (d *dispatcher) dispatch(msg protocol.Message, handler protocol.MessageHandler) error {
+	d.mu.Lock()
+	if _, exists := d.inflight[msg.ID]; exists {
+		d.mu.Unlock()
+		return ErrDuplicateMessage
+	}
+	if len(d.inflight) >= cap(d.workers)+d.queueSize {
+		d.mu.Unlock()
+		return ErrDispatchQueueFull
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.inflight[msg.ID] = cancel
+	d.wg.Add(1)
+	d.mu.Unlock()
+
+	go func() {
+		defer d.wg.Done()
+		defer d.finish(msg.ID)
+
+		release, err := d.acquire(ctx, msg.Type)
+		if err != nil {
+			d.logger.Info("Message cancelled before it started",
+				zap.String("type", string(msg.Type)),
+				zap.String("id", msg.ID))
+			if d.dropped != nil {
+				d.dropped(msg, err)
+			}
+			return
+		}
+		defer release()
+
+		if err := handler(ctx, msg); err != nil {
+			d.logger.Error("Handler failed",
+				zap.String("type", string(msg.Type)),
+				zap.String("id", msg.ID),
+				zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// acquire waits for a worker slot and, if the type is limited, a type slot
+func (d *dispatcher) acquire(ctx context.Context, t protocol.MessageType) (func(), error) {
+	typeSlot := d.limits[t]
+	if typeSlot != nil {
+		select {
+		case typeSlot <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	select {
+	case d.workers <- struct{}{}:
+	case <-ctx.Done():
+		if typeSlot != nil {
+			<-typeSlot
+		}
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-d.workers
+		if typeSlot != nil {
+			<-typeSlot
+		}
+	}, nil
+}
+
+// finish releases the context of a completed message
+func (d *dispatcher) finish(id string) {
+	d.mu.Lock()
+	cancel, ok := d.inflight[id]
+	delete(d.inflight, id)
+	d.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// Cancel aborts the in-flight message with the given ID. It returns false if
+// no such message is running or queued.
+func (d *dispatcher) Cancel(id string) bool {
+	d.mu.Lock()
+	cancel, ok := d.inflight[id]
+	d.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// InFlight returns the number of running and queued messages
+func (d *dispatcher) InFlight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.inflight)
+}
+
+// Shutdown cancels every in-flight message and waits for the handlers to return
+func (d *dispatcher) Shutdown(ctx context.Context) error {
+	d.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("handlers still running: %w", ctx.Err())
+	}
+}
+
+// handleCancel processes a server request to abort a running message
+func (c *Client) handleCancel(msg protocol.Message) {
+	payload, err := protocol.DecodePayload[protocol.CancelPayload](msg)
+	if err != nil {
+		c.logger.Error("Invalid cancel payload", zap.Error(err))
+		return
+	}
+
+	if c.dispatcher.Cancel(payload.ID) {
+		c.logger.Info("Cancelled message",
+			zap.String("id", payload.ID),
+			zap.String("reason", payload.Reason))
+		return
+	}
+
+	c.logger.Warn("Cancel for unknown or finished message", zap.String("id", payload.ID))
+}
@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+// blockingHandler reports each message it starts on started and returns once
+// its context is cancelled or release is closed
+func blockingHandler(started chan<- string, release <-chan struct{}) protocol.MessageHandler {
+	return func(ctx context.Context, msg protocol.Message) error {
+		started <- msg.ID
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-release:
+			return nil
+		}
+	}
+}
+
+func waitStarted(t *testing.T, started <-chan string) string {
+	t.Helper()
+
+	select {
+	case id := <-started:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not start")
+		return ""
+	}
+}
+
+func TestDispatcherCancelsRunningMessage(t *testing.T) {
+	d := newDispatcher(zap.NewNop(), 2, 2, nil)
+
+	started := make(chan string, 2)
+	errs := make(chan error, 1)
+	require.NoError(t, d.dispatch(protocol.Message{ID: "msg-1"}, func(ctx context.Context, msg protocol.Message) error {
+		started <- msg.ID
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return ctx.Err()
+	}))
+	require.Equal(t, "msg-1", waitStarted(t, started))
+	require.Equal(t, 1, d.InFlight())
+
+	// IDs stay reserved while the message is in flight
+	require.ErrorIs(t, d.dispatch(protocol.Message{ID: "msg-1"}, blockingHandler(started, nil)), ErrDuplicateMessage)
+
+	require.True(t, d.Cancel("msg-1"))
+	require.ErrorIs(t, <-errs, context.Canceled)
+	require.Eventually(t, func() bool { return d.InFlight() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, d.Cancel("msg-1"))
+}
+
+func TestDispatcherCancelsQueuedMessage(t *testing.T) {
+	d := newDispatcher(zap.NewNop(), 1, 1, nil)
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	require.NoError(t, d.dispatch(protocol.Message{ID: "msg-1"}, blockingHandler(started, release)))
+	require.Equal(t, "msg-1", waitStarted(t, started))
+
+	// One worker and one queue slot: the third message is turned away
+	require.NoError(t, d.dispatch(protocol.Message{ID: "msg-2"}, blockingHandler(started, release)))
+	require.ErrorIs(t, d.dispatch(protocol.Message{ID: "msg-3"}, blockingHandler(started, release)), ErrDispatchQueueFull)
+
+	// A queued message cancelled before it gets a worker never runs
+	require.True(t, d.Cancel("msg-2"))
+	require.Eventually(t, func() bool { return d.InFlight() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	require.NoError(t, d.Shutdown(context.Background()))
+	require.Empty(t, started)
+}
+
+func TestDispatcherLimitsPerType(t *testing.T) {
+	d := newDispatcher(zap.NewNop(), 4, 4, map[protocol.MessageType]int{protocol.TypeCommand: 1})
+
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	require.NoError(t, d.dispatch(protocol.Message{Type: protocol.TypeCommand, ID: "cmd-1"}, blockingHandler(started, release)))
+	require.NoError(t, d.dispatch(protocol.Message{Type: protocol.TypeCommand, ID: "cmd-2"}, blockingHandler(started, release)))
+	require.NoError(t, d.dispatch(protocol.Message{Type: protocol.TypeConfig, ID: "cfg-1"}, blockingHandler(started, release)))
+
+	// Other types are not held up by the limited one
+	first := []string{waitStarted(t, started), waitStarted(t, started)}
+	require.Contains(t, first, "cfg-1")
+	select {
+	case id := <-started:
+		t.Fatalf("%s started while another command was running", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	waitStarted(t, started)
+	require.NoError(t, d.Shutdown(context.Background()))
+}
+
+func TestDispatcherShutdownCancelsHandlers(t *testing.T) {
+	d := newDispatcher(zap.NewNop(), 2, 2, nil)
+
+	started := make(chan string, 2)
+	require.NoError(t, d.dispatch(protocol.Message{ID: "msg-1"}, blockingHandler(started, nil)))
+	require.NoError(t, d.dispatch(protocol.Message{ID: "msg-2"}, blockingHandler(started, nil)))
+	waitStarted(t, started)
+	waitStarted(t, started)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Shutdown(ctx))
+	require.Zero(t, d.InFlight())
+}
+
+func TestCancelMessageAbortsHandler(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+
+	started := make(chan string, 1)
+	cancelled := make(chan error, 1)
+	c.RegisterHandler(protocol.TypeCommand, func(ctx context.Context, msg protocol.Message) error {
+		started <- msg.ID
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeCommand, ID: "cmd-1", Timestamp: time.Now(), Payload: json.RawMessage(`{"command":"sleep"}`)})
+	require.Equal(t, "cmd-1", waitStarted(t, started))
+
+	payload, err := json.Marshal(protocol.CancelPayload{ID: "cmd-1", Reason: "operator abort"})
+	require.NoError(t, err)
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeCancel, ID: "cancel-1", Timestamp: time.Now(), Payload: payload})
+
+	select {
+	case err := <-cancelled:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultFailbackInterval = time.Minute
+
+	// probeTimeout bounds a single attempt to reach the primary server
+	probeTimeout = 10 * time.Second
+)
+
+// WithFailover adds fallback servers, in order of preference, after the URL
+// given to NewClient. Every dial tries the servers in order and uses the
+// first one that accepts the registration. While connected to a fallback,
+// the primary is probed every interval and the client moves back to it as
+// soon as it is reachable again.
+func WithFailover(urls []string, interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.urls = append(c.urls, urls...)
+		if interval > 0 {
+			c.failbackInterval = interval
+		}
+	}
+}
+
+// Server returns the URL of the server the client is connected to, or the
+// last one it was connected to while reconnecting
+func (c *Client) Server() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.urls[c.current]
+}
+
+// failbackLoop probes the primary server while a fallback is in use and
+// drops the fallback connection once the primary answers. The supervisor
+// then redials, preferring the primary.
+func (c *Client) failbackLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.failbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.RLock()
+		conn := c.conn
+		onFallback := c.current > 0 && c.state == stateConnected
+		c.mu.RUnlock()
+
+		if !onFallback || conn == nil || !c.probe(ctx, c.urls[0]) {
+			continue
+		}
+
+		c.logger.Info("Primary server is reachable again, failing back",
+			zap.String("server", c.urls[0]))
+
+		c.mu.Lock()
+		c.failback = true
+		c.mu.Unlock()
+
+		conn.CloseWith(websocket.CloseGoingAway, "failing back to primary server")
+	}
+}
+
+// probe reports whether url accepts a connection. The probe connection is
+// closed straight away without registering.
+func (c *Client) probe(ctx context.Context, url string) bool {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	conn, _, err := c.open(ctx, url)
+	if err != nil {
+		c.logger.Debug("Primary server still unreachable",
+			zap.String("server", url),
+			zap.Error(err))
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// takeFailback reports and clears a pending failback
+func (c *Client) takeFailback() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	failback := c.failback
+	c.failback = false
+	return failback
+}
@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"shh/agent/internal/protocol"
+)
+
+// acceptRegistration waits for a connection that registers, skipping the
+// failback probes that hang up without sending anything
+func (s *testServer) acceptRegistration(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn := s.accept(t)
+		require.NoError(t, conn.SetReadDeadline(deadline))
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			continue
+		}
+
+		var msg protocol.Message
+		require.NoError(t, json.Unmarshal(data, &msg))
+		require.Equal(t, protocol.TypeRegister, msg.Type)
+		return conn
+	}
+
+	t.Fatal("agent did not register")
+	return nil
+}
+
+func TestFailoverToNextServer(t *testing.T) {
+	primary := newTestServer(t)
+	fallback := newTestServer(t)
+	c := newTestClient(t, primary, WithFailover([]string{fallback.wsURL()}, time.Hour))
+
+	conn := primary.acceptRegistration(t)
+	require.Eventually(t, func() bool { return c.Server() == primary.wsURL() }, 5*time.Second, 10*time.Millisecond)
+
+	// With the primary gone the client moves on to the fallback
+	primary.refuse.Store(true)
+	conn.Close()
+
+	fallback.acceptRegistration(t)
+	require.Eventually(t, func() bool {
+		check := c.HealthCheck(context.Background())
+		return check.Metadata["state"] == stateConnected.String() && check.Metadata["server"] == fallback.wsURL()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConnectSkipsUnreachablePrimary(t *testing.T) {
+	primary := newTestServer(t)
+	fallback := newTestServer(t)
+	primary.refuse.Store(true)
+
+	c := newTestClient(t, primary, WithFailover([]string{fallback.wsURL()}, time.Hour))
+	fallback.acceptRegistration(t)
+	require.Eventually(t, func() bool { return c.Server() == fallback.wsURL() }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConnectFailsWhenNoServerIsReachable(t *testing.T) {
+	primary := newTestServer(t)
+	fallback := newTestServer(t)
+	primary.refuse.Store(true)
+	fallback.refuse.Store(true)
+
+	c := newClient(t, primary, WithFailover([]string{fallback.wsURL()}, time.Hour))
+	err := c.Connect(context.Background())
+	require.ErrorContains(t, err, primary.wsURL())
+	require.ErrorContains(t, err, fallback.wsURL())
+}
+
+func TestFailbackToPrimary(t *testing.T) {
+	primary := newTestServer(t)
+	fallback := newTestServer(t)
+	primary.refuse.Store(true)
+
+	c := newTestClient(t, primary, WithFailover([]string{fallback.wsURL()}, 20*time.Millisecond))
+	fallbackConn := fallback.acceptRegistration(t)
+	require.Eventually(t, func() bool { return c.Server() == fallback.wsURL() }, 5*time.Second, 10*time.Millisecond)
+
+	// Once the primary answers a probe the fallback connection is dropped
+	primary.refuse.Store(false)
+	primary.acceptRegistration(t)
+	require.Eventually(t, func() bool { return c.Server() == primary.wsURL() }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, fallbackConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err := fallbackConn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+
+	// The failback is immediate, not a backoff-delayed reconnect
+	require.Zero(t, c.HealthCheck(context.Background()).Metadata["reconnect_attempts"])
+}
@@ -0,0 +1,246 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+	"shh/agent/internal/signing"
+)
+
+// OnRegistered registers a callback run each time the server accepts a
+// registration, including after every reconnect. Servers that predate the
+// handshake never reply; callbacks then receive a protocol version 1 ack
+// with no session or settings once the request timeout passes.
+func (c *Client) OnRegistered(fn func(protocol.RegisterAck)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRegistered = append(c.onRegistered, fn)
+}
+
+// Session returns the parameters negotiated for the current connection. The
+// protocol version is zero until the handshake completes.
+func (c *Client) Session() protocol.RegisterAck {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
+// offeredCodecs returns the codecs offered on conn. Binary codecs are left
+// out on transports that can only carry text.
+func (c *Client) offeredCodecs(conn Conn) []string {
+	if conn.Binary() {
+		return c.codecs
+	}
+
+	var offered []string
+	for _, name := range c.codecs {
+		if codec, err := protocol.LookupCodec(name); err == nil && !codec.Binary() {
+			offered = append(offered, name)
+		}
+	}
+	return offered
+}
+
+// offersCodec reports whether name was offered in the registration on conn
+func (c *Client) offersCodec(conn Conn, name string) bool {
+	for _, offered := range c.offeredCodecs(conn) {
+		if offered == name {
+			return true
+		}
+	}
+	return false
+}
+
+// register sends the registration message and returns its ID along with the
+// channel the server's acknowledgement will be delivered on
+func (c *Client) register(conn Conn) (string, <-chan protocol.Message, error) {
+	c.mu.RLock()
+	messageTypes := []protocol.MessageType{protocol.TypeCancel, protocol.TypeResultAck}
+	for t := range c.handlers {
+		messageTypes = append(messageTypes, t)
+	}
+	for t := range c.ordered {
+		messageTypes = append(messageTypes, t)
+	}
+	c.mu.RUnlock()
+
+	if c.enroll != nil {
+		messageTypes = append(messageTypes, protocol.TypeCredentials)
+	}
+
+	sort.Slice(messageTypes, func(i, j int) bool {
+		return messageTypes[i] < messageTypes[j]
+	})
+
+	registration := protocol.RegisterPayload{
+		AgentInfo:          c.agentInfo,
+		ProtocolVersion:    protocol.ProtocolVersion,
+		MinProtocolVersion: protocol.MinProtocolVersion,
+		MessageTypes:       messageTypes,
+		Codecs:             c.offeredCodecs(conn),
+	}
+
+	if c.enroll != nil {
+		if err := c.enroll.Apply(&registration); err != nil {
+			return "", nil, err
+		}
+	}
+
+	regPayload, err := json.Marshal(registration)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal agent info: %w", err)
+	}
+
+	regMsg := protocol.Message{
+		Type:      protocol.TypeRegister,
+		ID:        fmt.Sprintf("register-%d", time.Now().UnixNano()),
+		Timestamp: time.Now(),
+		Payload:   regPayload,
+	}
+
+	// The ack is signed for the ID the agent registers with, before any
+	// session exists
+	c.mu.Lock()
+	c.scope = signing.Scope{AgentID: registration.ID}
+	c.mu.Unlock()
+
+	reply, err := c.expectReply(regMsg.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := c.send(regMsg); err != nil {
+		c.forgetReply(regMsg.ID)
+		return "", nil, fmt.Errorf("failed to send registration message: %w", err)
+	}
+
+	return regMsg.ID, reply, nil
+}
+
+// awaitRegistration waits for the server to acknowledge the registration sent
+// on conn and records the negotiated session. rotations is the number of
+// credential rotations stored before the registration was sent.
+func (c *Client) awaitRegistration(conn Conn, regID string, reply <-chan protocol.Message, rotations uint64) {
+	defer c.forgetReply(regID)
+
+	timer := time.NewTimer(c.requestTimeout)
+	defer timer.Stop()
+
+	var ack protocol.RegisterAck
+
+	select {
+	case <-c.stop:
+		return
+	case <-timer.C:
+		c.logger.Info("Server did not acknowledge registration, assuming legacy protocol",
+			zap.Int("protocol_version", protocol.MinProtocolVersion))
+		ack = protocol.RegisterAck{
+			ProtocolVersion: protocol.MinProtocolVersion,
+			Codec:           protocol.CodecJSON,
+		}
+	case msg := <-reply:
+		var err error
+		if ack, err = protocol.DecodePayload[protocol.RegisterAck](msg); err != nil {
+			c.logger.Error("Invalid registration acknowledgement", zap.Error(err))
+			conn.CloseWith(websocket.CloseProtocolError, "invalid registration acknowledgement")
+			return
+		}
+		c.storeIssuedCredentials(ack, rotations)
+		if ack.ProtocolVersion < protocol.MinProtocolVersion || ack.ProtocolVersion > protocol.ProtocolVersion {
+			c.logger.Error("Server selected an unsupported protocol version",
+				zap.Int("version", ack.ProtocolVersion),
+				zap.Int("min", protocol.MinProtocolVersion),
+				zap.Int("max", protocol.ProtocolVersion))
+			conn.CloseWith(websocket.CloseProtocolError, "unsupported protocol version")
+			return
+		}
+		if ack.Codec == "" {
+			ack.Codec = protocol.CodecJSON
+		}
+		if !c.offersCodec(conn, ack.Codec) {
+			c.logger.Error("Server selected a codec that was not offered", zap.String("codec", ack.Codec))
+			conn.CloseWith(websocket.CloseProtocolError, "codec not offered")
+			return
+		}
+	}
+
+	c.mu.Lock()
+	if c.conn != conn {
+		// The connection dropped while we were waiting
+		c.mu.Unlock()
+		return
+	}
+	c.session = ack
+	if codec, err := protocol.LookupCodec(ack.Codec); err == nil {
+		conn.SetCodec(codec)
+	}
+	callbacks := append([]func(protocol.RegisterAck){}, c.onRegistered...)
+	c.mu.Unlock()
+
+	c.logger.Info("Registered with server",
+		zap.String("session_id", ack.SessionID),
+		zap.Int("protocol_version", ack.ProtocolVersion),
+		zap.String("codec", ack.Codec))
+
+	for _, fn := range callbacks {
+		fn(ack)
+	}
+}
+
+// storeIssuedCredentials persists credentials carried by a registration ack,
+// which has been verified like every other reply. They are dropped if the
+// server rotated the credential since the registration was sent, as the
+// rotation is newer.
+func (c *Client) storeIssuedCredentials(ack protocol.RegisterAck, rotations uint64) {
+	if c.enroll == nil || ack.Credentials == nil {
+		return
+	}
+
+	c.credMu.Lock()
+	defer c.credMu.Unlock()
+
+	if c.rotations != rotations {
+		c.logger.Info("Ignoring credentials in registration ack; credential was rotated since")
+		return
+	}
+
+	if err := c.enroll.Update(*ack.Credentials); err != nil {
+		c.logger.Error("Failed to store issued credentials", zap.Error(err))
+	}
+}
+
+// credentialRotations returns how many credential rotations have been stored
+func (c *Client) credentialRotations() uint64 {
+	c.credMu.Lock()
+	defer c.credMu.Unlock()
+	return c.rotations
+}
+
+// handleCredentials stores a credential rotated by the server. The reply is
+// only sent once the new credential is on disk, so the server can keep
+// accepting the old one until then.
+func (c *Client) handleCredentials(msg protocol.Message) {
+	if c.enroll == nil {
+		c.logger.Warn("Received credentials but enrollment is not configured")
+		return
+	}
+
+	creds, err := protocol.DecodePayload[protocol.AgentCredentials](msg)
+	if err == nil {
+		c.credMu.Lock()
+		if err = c.enroll.Update(creds); err == nil {
+			c.rotations++
+		}
+		c.credMu.Unlock()
+	}
+
+	if err := c.reply(msg, nil, err); err != nil {
+		c.logger.Error("Failed to acknowledge credential rotation", zap.Error(err))
+	}
+}
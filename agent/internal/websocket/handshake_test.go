@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"shh/agent/internal/protocol"
+)
+
+// ackRegistration answers the registration reg on conn with ack
+func ackRegistration(t *testing.T, conn *websocket.Conn, reg protocol.Message, ack protocol.RegisterAck) {
+	t.Helper()
+
+	payload, err := json.Marshal(ack)
+	require.NoError(t, err)
+
+	writeMessage(t, conn, protocol.Message{
+		Type:          protocol.TypeRegistered,
+		ID:            "registered-" + reg.ID,
+		CorrelationID: reg.ID,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+	})
+}
+
+// registeredAcks collects the acks passed to OnRegistered callbacks
+func registeredAcks(c *Client) <-chan protocol.RegisterAck {
+	acks := make(chan protocol.RegisterAck, 8)
+	c.OnRegistered(func(ack protocol.RegisterAck) {
+		acks <- ack
+	})
+	return acks
+}
+
+func waitAck(t *testing.T, acks <-chan protocol.RegisterAck) protocol.RegisterAck {
+	t.Helper()
+
+	select {
+	case ack := <-acks:
+		return ack
+	case <-time.After(5 * time.Second):
+		t.Fatal("registration was not acknowledged")
+		return protocol.RegisterAck{}
+	}
+}
+
+func TestHandshakeAdvertisesCapabilities(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+	c.RegisterHandler(protocol.TypeConfig, func(ctx context.Context, msg protocol.Message) error { return nil })
+	c.RegisterHandler(protocol.TypeCommand, func(ctx context.Context, msg protocol.Message) error { return nil })
+	require.NoError(t, c.Connect(context.Background()))
+
+	reg := requireRegistration(t, s.accept(t), "agent-1")
+
+	var payload protocol.RegisterPayload
+	require.NoError(t, json.Unmarshal(reg.Payload, &payload))
+	require.Equal(t, protocol.ProtocolVersion, payload.ProtocolVersion)
+	require.Equal(t, protocol.MinProtocolVersion, payload.MinProtocolVersion)
+	require.Subset(t, payload.MessageTypes, []protocol.MessageType{protocol.TypeCommand, protocol.TypeConfig})
+	require.IsIncreasing(t, payload.MessageTypes)
+	require.Contains(t, payload.Codecs, protocol.CodecJSON)
+}
+
+func TestHandshakeRecordsSession(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+	acks := registeredAcks(c)
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	reg := requireRegistration(t, conn, "agent-1")
+	require.Zero(t, c.Session().ProtocolVersion)
+
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, SessionID: "session-1"})
+
+	ack := waitAck(t, acks)
+	require.Equal(t, "session-1", ack.SessionID)
+	require.Equal(t, protocol.CodecJSON, ack.Codec)
+	require.Equal(t, ack, c.Session())
+
+	check := c.HealthCheck(context.Background())
+	require.Equal(t, "session-1", check.Metadata["session_id"])
+
+	// Each reconnect negotiates a fresh session
+	conn.Close()
+	conn = s.accept(t)
+	reg = requireRegistration(t, conn, "agent-1")
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, SessionID: "session-2"})
+	require.Equal(t, "session-2", waitAck(t, acks).SessionID)
+}
+
+func TestHandshakeRejectsUnsupportedVersion(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+	acks := registeredAcks(c)
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	reg := requireRegistration(t, conn, "agent-1")
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion + 1, SessionID: "session-1"})
+
+	// The agent hangs up rather than speak a protocol it doesn't know
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err := conn.ReadMessage()
+	require.Error(t, err)
+	require.False(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+
+	// and tries again on a new connection
+	conn = s.accept(t)
+	reg = requireRegistration(t, conn, "agent-1")
+	ackRegistration(t, conn, reg, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, SessionID: "session-2"})
+	require.Equal(t, "session-2", waitAck(t, acks).SessionID)
+	require.Empty(t, acks)
+}
+
+func TestHandshakeFallsBackToLegacyServer(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s, WithRequestTimeout(50*time.Millisecond))
+	acks := registeredAcks(c)
+	require.NoError(t, c.Connect(context.Background()))
+
+	requireRegistration(t, s.accept(t), "agent-1")
+
+	ack := waitAck(t, acks)
+	require.Equal(t, protocol.MinProtocolVersion, ack.ProtocolVersion)
+	require.Empty(t, ack.SessionID)
+	require.Equal(t, ack, c.Session())
+}
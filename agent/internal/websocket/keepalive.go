@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 10 * time.Second
+)
+
+// WithKeepalive sets how often the client pings the server and how long it
+// waits for the matching pong before treating the connection as dead. A zero
+// interval disables keepalive.
+func WithKeepalive(interval, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pingInterval = interval
+		if timeout > 0 {
+			c.pongTimeout = timeout
+		}
+	}
+}
+
+// Latency returns the most recent ping round-trip time and when the last pong
+// was received. Both are zero until the first pong arrives.
+func (c *Client) Latency() (time.Duration, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.latency, c.lastPong
+}
+
+// recordPong stores the round-trip time of a ping sent at sent
+func (c *Client) recordPong(sent time.Time) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPong = now
+	if !sent.IsZero() {
+		c.latency = now.Sub(sent)
+	}
+}
+
+// extendDeadline pushes the read deadline out by one ping period
+func (w *wsConn) extendDeadline() {
+	if w.client.pingInterval <= 0 {
+		return
+	}
+	w.conn.SetReadDeadline(time.Now().Add(w.client.pingInterval + w.client.pongTimeout))
+}
+
+// startKeepalive installs the pong handler and starts the ping loop. A
+// missed pong lets the read deadline expire, which ends the read loop and
+// hands the connection back to the reconnect supervisor.
+func (w *wsConn) startKeepalive() {
+	if w.client.pingInterval <= 0 {
+		return
+	}
+
+	w.conn.SetPongHandler(func(appData string) error {
+		var sent time.Time
+		if nanos, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			sent = time.Unix(0, nanos)
+		}
+		w.client.recordPong(sent)
+
+		w.extendDeadline()
+		return nil
+	})
+
+	w.extendDeadline()
+	go w.pingLoop()
+}
+
+// pingLoop sends a timestamped ping every interval until the connection closes
+func (w *wsConn) pingLoop() {
+	ticker := time.NewTicker(w.client.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+			deadline := time.Now().Add(w.client.pongTimeout)
+			if err := w.conn.WriteControl(websocket.PingMessage, payload, deadline); err != nil {
+				w.client.logger.Warn("Failed to send ping, dropping connection", zap.Error(err))
+				w.conn.Close()
+				return
+			}
+		}
+	}
+}
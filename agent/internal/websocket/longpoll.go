@@ -0,0 +1,270 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"shh/agent/internal/protocol"
+)
+
+const (
+	// pollHeader carries the long-poll session on every request after open
+	pollHeader = "X-Poll-Session"
+
+	// pollTimeout bounds how long the server may hold a poll before answering
+	pollTimeout = 90 * time.Second
+
+	// pollRequestTimeout bounds opening, sending and closing
+	pollRequestTimeout = 10 * time.Second
+)
+
+// ErrPollSessionClosed indicates the server ended the long-poll session
+var ErrPollSessionClosed = errors.New("long-poll session closed by server")
+
+// longPollTransport carries messages over plain HTTP for networks that
+// refuse websocket upgrades. It speaks the same envelopes as the websocket:
+//
+//	POST {path}/poll/open   opens a session, returning {"session_id": "..."}
+//	GET  {path}/poll        waits for messages, returned as newline-delimited
+//	                        JSON, either all at once or chunked as they arrive;
+//	                        204 when the poll times out with nothing to send
+//	POST {path}/poll/send   sends one message
+//	POST {path}/poll/close  ends the session
+type longPollTransport struct {
+	client *Client
+}
+
+func (t *longPollTransport) Name() string { return "long-poll" }
+
+func (t *longPollTransport) Dial(ctx context.Context, rawURL string) (Conn, error) {
+	base, err := pollURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:                 t.client.proxy,
+		ResponseHeaderTimeout: pollTimeout,
+		IdleConnTimeout:       pollTimeout,
+	}
+	if t.client.tls != nil {
+		transport.TLSClientConfig = t.client.tls.Config()
+	}
+
+	connCtx, cancel := context.WithCancel(context.Background())
+	p := &pollConn{
+		http:   &http.Client{Transport: transport},
+		base:   base,
+		ctx:    connCtx,
+		cancel: cancel,
+	}
+
+	var opened struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := p.post(ctx, "/open", nil, &opened); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open long-poll session: %w", err)
+	}
+	if opened.SessionID == "" {
+		cancel()
+		return nil, fmt.Errorf("failed to open long-poll session: no session ID in response")
+	}
+	p.session = opened.SessionID
+
+	return p, nil
+}
+
+// pollURL maps a websocket URL to the base of the long-poll endpoints
+func pollURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q for long-poll", u.Scheme)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/poll"
+	return u.String(), nil
+}
+
+// pollConn is a long-poll session. Only JSON is carried, so the negotiated
+// codec is always JSON.
+type pollConn struct {
+	http    *http.Client
+	base    string
+	session string
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	// Only touched by the single reader
+	body io.ReadCloser
+	dec  *json.Decoder
+
+	writeMu sync.Mutex
+}
+
+func (p *pollConn) ReadMessage() (protocol.Message, error) {
+	for {
+		if p.dec == nil {
+			if err := p.poll(); err != nil {
+				return protocol.Message{}, err
+			}
+			continue
+		}
+
+		var msg protocol.Message
+		err := p.dec.Decode(&msg)
+		if err == nil {
+			return msg, nil
+		}
+
+		p.body.Close()
+		p.body, p.dec = nil, nil
+
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if p.ctx.Err() != nil {
+			return protocol.Message{}, net.ErrClosed
+		}
+		return protocol.Message{}, fmt.Errorf("failed to read long-poll response: %w", err)
+	}
+}
+
+// poll waits for the next batch of messages and leaves the response body
+// ready for decoding. A poll that times out with nothing to deliver leaves
+// no body, and the caller polls again.
+func (p *pollConn) poll() error {
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, p.base, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create poll request: %w", err)
+	}
+	req.Header.Set(pollHeader, p.session)
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		if p.ctx.Err() != nil {
+			return net.ErrClosed
+		}
+		return fmt.Errorf("failed to poll server: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		p.body = resp.Body
+		p.dec = json.NewDecoder(resp.Body)
+		return nil
+	case http.StatusNoContent:
+		resp.Body.Close()
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return ErrPollSessionClosed
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("poll failed with status %s", resp.Status)
+	}
+}
+
+// WriteMessage posts msg to the server. Writes are serialized so the server
+// receives messages in the order they were sent.
+func (p *pollConn) WriteMessage(msg protocol.Message) error {
+	data, err := protocol.JSON.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(p.ctx, pollRequestTimeout)
+	defer cancel()
+
+	if err := p.post(ctx, "/send", data, nil); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+func (p *pollConn) Binary() bool { return false }
+
+func (p *pollConn) SetCodec(protocol.Codec) {}
+
+// Close ends the session, best effort, and aborts any pending poll
+func (p *pollConn) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.cancel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = p.post(ctx, "/close", nil, nil)
+		p.http.CloseIdleConnections()
+	})
+	return err
+}
+
+// CloseWith closes the session; long-poll has no close codes to send
+func (p *pollConn) CloseWith(code int, reason string) error {
+	return p.Close()
+}
+
+// post sends body to the endpoint below the poll URL and decodes a JSON
+// response into out, if given
+func (p *pollConn) post(ctx context.Context, endpoint string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.base+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.session != "" {
+		req.Header.Set(pollHeader, p.session)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		if p.session != "" {
+			return ErrPollSessionClosed
+		}
+		return fmt.Errorf("long-poll not supported by server: %s", resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("request failed with status %s", resp.Status)
+	}
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
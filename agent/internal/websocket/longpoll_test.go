@@ -0,0 +1,231 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+// pollServer refuses websocket upgrades and serves the long-poll endpoints
+type pollServer struct {
+	*httptest.Server
+
+	// opened receives each new session ID, sent the messages the agent posts
+	opened chan string
+	sent   chan protocol.Message
+
+	// outbox holds messages for the agent's next poll
+	outbox chan protocol.Message
+
+	// expire makes the next poll report the session as gone
+	expire atomic.Bool
+
+	mu       sync.Mutex
+	session  string
+	sessions int
+}
+
+func newPollServer(t *testing.T) *pollServer {
+	t.Helper()
+
+	s := &pollServer{
+		opened: make(chan string, 8),
+		sent:   make(chan protocol.Message, 16),
+		outbox: make(chan protocol.Message, 16),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "websocket not allowed", http.StatusForbidden)
+	})
+	mux.HandleFunc("/poll/open", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.sessions++
+		s.session = fmt.Sprintf("poll-%d", s.sessions)
+		session := s.session
+		s.mu.Unlock()
+
+		s.opened <- session
+		json.NewEncoder(w).Encode(map[string]string{"session_id": session})
+	})
+	mux.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+		if !s.current(r) || s.expire.CompareAndSwap(true, false) {
+			http.Error(w, "session gone", http.StatusGone)
+			return
+		}
+
+		select {
+		case msg := <-s.outbox:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			json.NewEncoder(w).Encode(msg)
+		case <-time.After(50 * time.Millisecond):
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/poll/send", func(w http.ResponseWriter, r *http.Request) {
+		if !s.current(r) {
+			http.Error(w, "session gone", http.StatusGone)
+			return
+		}
+
+		var msg protocol.Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.sent <- msg
+	})
+	mux.HandleFunc("/poll/close", func(w http.ResponseWriter, r *http.Request) {})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// current reports whether r belongs to the open session
+func (s *pollServer) current(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return r.Header.Get(pollHeader) == s.session
+}
+
+func (s *pollServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// next waits for the next message the agent posts
+func (s *pollServer) next(t *testing.T) protocol.Message {
+	t.Helper()
+
+	select {
+	case msg := <-s.sent:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not send a message")
+		return protocol.Message{}
+	}
+}
+
+// waitSession waits for the agent to open a long-poll session
+func (s *pollServer) waitSession(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case session := <-s.opened:
+		return session
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not open a long-poll session")
+		return ""
+	}
+}
+
+func newPollClient(t *testing.T, s *pollServer, opts ...ClientOption) *Client {
+	t.Helper()
+
+	opts = append([]ClientOption{WithReconnectDelay(10*time.Millisecond, 50*time.Millisecond)}, opts...)
+	c := NewClient(s.wsURL(), protocol.AgentInfo{ID: "agent-1", Version: "test"}, zap.NewNop(), opts...)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Close(ctx)
+	})
+
+	return c
+}
+
+// registerPoll reads the agent's registration and acknowledges it
+func registerPoll(t *testing.T, s *pollServer) protocol.RegisterPayload {
+	t.Helper()
+
+	reg := s.next(t)
+	require.Equal(t, protocol.TypeRegister, reg.Type)
+
+	var payload protocol.RegisterPayload
+	require.NoError(t, json.Unmarshal(reg.Payload, &payload))
+
+	ack, err := json.Marshal(protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion})
+	require.NoError(t, err)
+	s.outbox <- protocol.Message{
+		Type:          protocol.TypeRegistered,
+		ID:            "registered-" + reg.ID,
+		CorrelationID: reg.ID,
+		Timestamp:     time.Now(),
+		Payload:       ack,
+	}
+
+	return payload
+}
+
+func TestLongPollFallback(t *testing.T) {
+	s := newPollServer(t)
+	c := newPollClient(t, s, WithCodecs(protocol.CodecCBOR, protocol.CodecJSON))
+	acks := registeredAcks(c)
+	c.RegisterRequestHandler(protocol.TypeConfig, func(ctx context.Context, msg protocol.Message) (interface{}, error) {
+		return map[string]string{"received": msg.ID}, nil
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	// Binary codecs are not offered over long-poll
+	require.Equal(t, "poll-1", s.waitSession(t))
+	payload := registerPoll(t, s)
+	require.Equal(t, []string{protocol.CodecJSON}, payload.Codecs)
+	require.Equal(t, protocol.CodecJSON, waitAck(t, acks).Codec)
+	require.Equal(t, "long-poll", c.HealthCheck(context.Background()).Metadata["transport"])
+
+	// Messages flow both ways over the session
+	s.outbox <- protocol.Message{
+		Type:      protocol.TypeConfig,
+		ID:        "config-1",
+		Timestamp: time.Now(),
+		Payload:   json.RawMessage(`{"settings":{}}`),
+	}
+
+	msg := s.next(t)
+	require.Equal(t, protocol.TypeResponse, msg.Type)
+	require.Equal(t, "config-1", msg.CorrelationID)
+
+	var resp protocol.AgentResponse
+	require.NoError(t, json.Unmarshal(msg.Payload, &resp))
+	require.True(t, resp.Success)
+	require.JSONEq(t, `{"received":"config-1"}`, string(resp.Data))
+}
+
+func TestLongPollFallbackDisabled(t *testing.T) {
+	s := newPollServer(t)
+	c := newPollClient(t, s, WithLongPollFallback(false))
+
+	require.ErrorIs(t, c.Connect(context.Background()), ErrUpgradeRefused)
+	require.Empty(t, s.opened)
+}
+
+func TestLongPollSessionClosedReconnects(t *testing.T) {
+	s := newPollServer(t)
+	c := newPollClient(t, s)
+	acks := registeredAcks(c)
+	require.NoError(t, c.Connect(context.Background()))
+
+	require.Equal(t, "poll-1", s.waitSession(t))
+	registerPoll(t, s)
+	waitAck(t, acks)
+
+	// The server dropping the session is a lost connection: the agent opens
+	// a new session and registers again
+	s.expire.Store(true)
+	require.Equal(t, "poll-2", s.waitSession(t))
+	registerPoll(t, s)
+	waitAck(t, acks)
+}
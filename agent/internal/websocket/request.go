@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+const defaultRequestTimeout = 30 * time.Second
+
+var (
+	// ErrRequestTimeout indicates no reply arrived before the request deadline
+	ErrRequestTimeout = errors.New("request timed out")
+
+	// ErrRequestCancelled indicates the request was cancelled by the caller
+	ErrRequestCancelled = errors.New("request cancelled")
+
+	// ErrClientClosed indicates the client was closed while a request was pending
+	ErrClientClosed = errors.New("client closed")
+)
+
+// RequestError represents a failed request/response exchange
+type RequestError struct {
+	ID   string
+	Type protocol.MessageType
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request %s (%s): %v", e.ID, e.Type, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// IsRequestTimeout returns true if the error indicates a request timed out
+func IsRequestTimeout(err error) bool {
+	return errors.Is(err, ErrRequestTimeout)
+}
+
+// WithRequestTimeout sets the deadline applied to requests whose context has
+// none, and to server-initiated requests handled by the agent
+func WithRequestTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		if timeout > 0 {
+			c.requestTimeout = timeout
+		}
+	}
+}
+
+// Request sends msg and blocks until the server replies with a message whose
+// correlation ID matches msg.ID, or until ctx is done
+func (c *Client) Request(ctx context.Context, msg protocol.Message) (protocol.Message, error) {
+	if msg.ID == "" {
+		msg.ID = fmt.Sprintf("%s-%d", msg.Type, time.Now().UnixNano())
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	reply, err := c.expectReply(msg.ID)
+	if err != nil {
+		return protocol.Message{}, &RequestError{ID: msg.ID, Type: msg.Type, Err: err}
+	}
+	defer c.forgetReply(msg.ID)
+
+	if err := c.send(msg); err != nil {
+		return protocol.Message{}, &RequestError{ID: msg.ID, Type: msg.Type, Err: err}
+	}
+
+	select {
+	case resp := <-reply:
+		return resp, nil
+	case <-c.stop:
+		return protocol.Message{}, &RequestError{ID: msg.ID, Type: msg.Type, Err: ErrClientClosed}
+	case <-ctx.Done():
+		return protocol.Message{}, &RequestError{ID: msg.ID, Type: msg.Type, Err: contextError(ctx.Err())}
+	}
+}
+
+// expectReply registers interest in the reply to the message with the given ID
+func (c *Client) expectReply(id string) (<-chan protocol.Message, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	if _, exists := c.pending[id]; exists {
+		return nil, fmt.Errorf("duplicate request ID")
+	}
+
+	reply := make(chan protocol.Message, 1)
+	c.pending[id] = reply
+	return reply, nil
+}
+
+// forgetReply stops waiting for the reply to the message with the given ID
+func (c *Client) forgetReply(id string) {
+	c.pendingMu.Lock()
+	delete(c.pending, id)
+	c.pendingMu.Unlock()
+}
+
+// resolve delivers msg to the pending request it answers. It returns false
+// if no request is waiting for it.
+func (c *Client) resolve(msg protocol.Message) bool {
+	c.pendingMu.Lock()
+	reply, ok := c.pending[msg.CorrelationID]
+	if ok {
+		delete(c.pending, msg.CorrelationID)
+	}
+	c.pendingMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	reply <- msg
+	return true
+}
+
+// RegisterRequestHandler registers a handler for server-initiated requests.
+// The handler's result or error is sent back as a TypeResponse message
+// correlated to the request. Handlers that overrun the request timeout are
+// answered with ErrRequestTimeout.
+func (c *Client) RegisterRequestHandler(messageType protocol.MessageType, handler protocol.RequestHandler) {
+	c.RegisterHandler(messageType, func(ctx context.Context, msg protocol.Message) error {
+		ctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+
+		data, err := handler(ctx, msg)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			data, err = nil, &RequestError{ID: msg.ID, Type: msg.Type, Err: contextError(ctxErr)}
+		}
+
+		return c.reply(msg, data, err)
+	})
+}
+
+// RegisterOrderedRequestHandler registers a request handler that runs on the
+// read loop, like RegisterOrderedHandler, so messages that arrive after the
+// request are handled after it. The response is sent as for
+// RegisterRequestHandler. The handler must not block.
+func (c *Client) RegisterOrderedRequestHandler(messageType protocol.MessageType, handler protocol.RequestHandler) {
+	c.RegisterOrderedHandler(messageType, func(ctx context.Context, msg protocol.Message) error {
+		data, err := handler(ctx, msg)
+		return c.reply(msg, data, err)
+	})
+}
+
+// reply sends the response to a server-initiated request
+func (c *Client) reply(req protocol.Message, data interface{}, handlerErr error) error {
+	response := protocol.AgentResponse{Success: handlerErr == nil}
+
+	if handlerErr != nil {
+		response.Error = handlerErr.Error()
+	} else if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to marshal response data: %w", err)
+		}
+		response.Data = encoded
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	if err := c.SendMessage(protocol.Message{
+		Type:          protocol.TypeResponse,
+		ID:            fmt.Sprintf("response-%d", time.Now().UnixNano()),
+		CorrelationID: req.ID,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+	}); err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+
+	if handlerErr != nil {
+		c.logger.Warn("Request handler failed",
+			zap.String("type", string(req.Type)),
+			zap.String("id", req.ID),
+			zap.Error(handlerErr))
+	}
+
+	return nil
+}
+
+// contextError maps a context error to the matching request error
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrRequestTimeout
+	}
+	return ErrRequestCancelled
+}
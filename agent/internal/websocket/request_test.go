@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"shh/agent/internal/protocol"
+)
+
+// writeMessage sends msg to the agent on conn
+func writeMessage(t *testing.T, conn *websocket.Conn, msg protocol.Message) {
+	t.Helper()
+
+	data, err := json.Marshal(msg)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+}
+
+// replyTo answers req on conn with an empty payload
+func replyTo(t *testing.T, conn *websocket.Conn, req protocol.Message) {
+	t.Helper()
+
+	writeMessage(t, conn, protocol.Message{
+		Type:          protocol.TypeResponse,
+		ID:            "reply-" + req.ID,
+		CorrelationID: req.ID,
+		Timestamp:     time.Now(),
+		Payload:       json.RawMessage(`{}`),
+	})
+}
+
+type requestResult struct {
+	reply protocol.Message
+	err   error
+}
+
+func startRequest(ctx context.Context, c *Client, msg protocol.Message) <-chan requestResult {
+	done := make(chan requestResult, 1)
+	go func() {
+		reply, err := c.Request(ctx, msg)
+		done <- requestResult{reply, err}
+	}()
+	return done
+}
+
+func waitRequest(t *testing.T, done <-chan requestResult) requestResult {
+	t.Helper()
+
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not return")
+		return requestResult{}
+	}
+}
+
+func TestRequestMatchesRepliesByCorrelationID(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	first := startRequest(context.Background(), c, protocol.Message{Type: protocol.TypeConfig, ID: "req-1"})
+	require.Equal(t, "req-1", readMessage(t, conn).ID)
+	second := startRequest(context.Background(), c, protocol.Message{Type: protocol.TypeConfig, ID: "req-2"})
+	require.Equal(t, "req-2", readMessage(t, conn).ID)
+
+	// Replies arriving out of order still reach the right caller
+	replyTo(t, conn, protocol.Message{ID: "req-2"})
+	replyTo(t, conn, protocol.Message{ID: "req-1"})
+
+	res := waitRequest(t, first)
+	require.NoError(t, res.err)
+	require.Equal(t, "reply-req-1", res.reply.ID)
+
+	res = waitRequest(t, second)
+	require.NoError(t, res.err)
+	require.Equal(t, "reply-req-2", res.reply.ID)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s, WithRequestTimeout(50*time.Millisecond))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	late := make(chan protocol.Message, 1)
+	c.RegisterHandler(protocol.TypeResponse, func(ctx context.Context, msg protocol.Message) error {
+		late <- msg
+		return nil
+	})
+
+	res := waitRequest(t, startRequest(context.Background(), c, protocol.Message{Type: protocol.TypeConfig, ID: "req-1"}))
+	require.True(t, IsRequestTimeout(res.err))
+
+	var reqErr *RequestError
+	require.True(t, errors.As(res.err, &reqErr))
+	require.Equal(t, "req-1", reqErr.ID)
+
+	// A reply after the deadline is not matched to the abandoned request
+	require.Equal(t, "req-1", readMessage(t, conn).ID)
+	replyTo(t, conn, protocol.Message{ID: "req-1"})
+	select {
+	case msg := <-late:
+		require.Equal(t, "req-1", msg.CorrelationID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("late reply was not dispatched")
+	}
+}
+
+func TestRequestCancelled(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startRequest(ctx, c, protocol.Message{Type: protocol.TypeConfig, ID: "req-1"})
+	require.Equal(t, "req-1", readMessage(t, conn).ID)
+	cancel()
+
+	res := waitRequest(t, done)
+	require.ErrorIs(t, res.err, ErrRequestCancelled)
+
+	// The ID is free again once the request is gone
+	done = startRequest(context.Background(), c, protocol.Message{Type: protocol.TypeConfig, ID: "req-1"})
+	require.Equal(t, "req-1", readMessage(t, conn).ID)
+	replyTo(t, conn, protocol.Message{ID: "req-1"})
+	require.NoError(t, waitRequest(t, done).err)
+}
+
+func TestRequestHandlerReplies(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	c.RegisterRequestHandler(protocol.TypeConfig, func(ctx context.Context, msg protocol.Message) (interface{}, error) {
+		if msg.ID == "bad" {
+			return nil, errors.New("unsupported setting")
+		}
+		return map[string]string{"applied": msg.ID}, nil
+	})
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeConfig, ID: "good", Timestamp: time.Now()})
+	msg := readMessage(t, conn)
+	require.Equal(t, protocol.TypeResponse, msg.Type)
+	require.Equal(t, "good", msg.CorrelationID)
+
+	var resp protocol.AgentResponse
+	require.NoError(t, json.Unmarshal(msg.Payload, &resp))
+	require.True(t, resp.Success)
+	require.JSONEq(t, `{"applied":"good"}`, string(resp.Data))
+
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeConfig, ID: "bad", Timestamp: time.Now()})
+	msg = readMessage(t, conn)
+	require.Equal(t, "bad", msg.CorrelationID)
+
+	require.NoError(t, json.Unmarshal(msg.Payload, &resp))
+	require.False(t, resp.Success)
+	require.Equal(t, "unsupported setting", resp.Error)
+}
+
+func TestOrderedRequestHandlerRunsBeforeLaterMessages(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+
+	handled := make(chan string, 2)
+	c.RegisterOrderedRequestHandler(protocol.TypeSessionOpen, func(ctx context.Context, msg protocol.Message) (interface{}, error) {
+		// Slow enough that a concurrently handled input would overtake it
+		time.Sleep(50 * time.Millisecond)
+		handled <- msg.ID
+		return protocol.SessionInfo{SessionID: msg.ID}, nil
+	})
+	c.RegisterOrderedHandler(protocol.TypeSessionInput, func(ctx context.Context, msg protocol.Message) error {
+		handled <- msg.ID
+		return nil
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeSessionOpen, ID: "session-1", Timestamp: time.Now(), Payload: json.RawMessage(`{}`)})
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeSessionInput, ID: "input-1", Timestamp: time.Now(), Payload: json.RawMessage(`{"session_id":"session-1","data":"bHMK"}`)})
+
+	msg := readMessage(t, conn)
+	require.Equal(t, protocol.TypeResponse, msg.Type)
+	require.Equal(t, "session-1", msg.CorrelationID)
+
+	var resp protocol.AgentResponse
+	require.NoError(t, json.Unmarshal(msg.Payload, &resp))
+	require.True(t, resp.Success)
+
+	require.Equal(t, "session-1", <-handled)
+	require.Equal(t, "input-1", <-handled)
+}
@@ -0,0 +1,179 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/policy"
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+)
+
+// ErrNoResult indicates a command handler returned without sending a result
+var ErrNoResult = errors.New("command handler finished without sending a result")
+
+// RegisterCommandHandler registers handler for TypeCommand messages and
+// guarantees the server gets exactly one terminal response per command. If
+// the handler fails, panics or returns without sending a TypeResult or a
+// final stream frame, an error result is sent in its place, or a rejection if
+// the local policy refused the command; a second terminal response for the
+// same command is dropped.
+func (c *Client) RegisterCommandHandler(handler protocol.MessageHandler) {
+	c.RegisterHandler(protocol.TypeCommand, func(ctx context.Context, msg protocol.Message) (err error) {
+		c.trackResult(msg.ID)
+		defer c.untrackResult(msg.ID)
+
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("command handler panicked: %v", r)
+			}
+			if c.resultSent(msg.ID) {
+				return
+			}
+			failure := err
+			if failure == nil {
+				failure = ErrNoResult
+			}
+			if errors.Is(failure, policy.ErrDenied) {
+				// Refused by the local policy before anything ran
+				c.reject(msg, failure)
+				return
+			}
+			if sendErr := c.failCommand(msg.ID, c.errorResult(failure)); sendErr != nil {
+				c.logger.Error("Failed to send command failure",
+					zap.String("id", msg.ID),
+					zap.Error(sendErr))
+			}
+		}()
+
+		return handler(ctx, msg)
+	})
+}
+
+// failCommand sends the terminal error result for a command
+func (c *Client) failCommand(commandID string, failure *protocol.ErrorResult) error {
+	payload, err := json.Marshal(protocol.ResultPayload{
+		CommandID: commandID,
+		ExitCode:  -1,
+		Error:     failure.Message,
+		Failure:   failure,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal command failure: %w", err)
+	}
+
+	return c.SendMessage(protocol.Message{
+		Type:      protocol.TypeResult,
+		ID:        commandID,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// commandDropped answers a command that never reached its handler
+func (c *Client) commandDropped(msg protocol.Message, reason error) {
+	if msg.Type != protocol.TypeCommand || errors.Is(reason, ErrDuplicateMessage) {
+		return
+	}
+
+	failure := c.errorResult(reason)
+	if errors.Is(reason, ErrDispatchQueueFull) {
+		failure.Code = protocol.CodeLimitReached
+	}
+
+	if err := c.failCommand(msg.ID, failure); err != nil {
+		c.logger.Error("Failed to send command failure",
+			zap.String("id", msg.ID),
+			zap.Error(err))
+	}
+}
+
+// trackResult starts watching for the terminal response of a command
+func (c *Client) trackResult(commandID string) {
+	c.resultsMu.Lock()
+	defer c.resultsMu.Unlock()
+	c.results[commandID] = false
+}
+
+// untrackResult stops watching a command once its handler has returned
+func (c *Client) untrackResult(commandID string) {
+	c.resultsMu.Lock()
+	defer c.resultsMu.Unlock()
+	delete(c.results, commandID)
+}
+
+// resultSent reports whether a tracked command has had its terminal response
+func (c *Client) resultSent(commandID string) bool {
+	c.resultsMu.Lock()
+	defer c.resultsMu.Unlock()
+	return c.results[commandID]
+}
+
+// claimResult reserves the terminal response of a command for the caller,
+// who must send it and call releaseResult if that fails, so the response only
+// stays marked as sent once it is on the wire or in the spool. It returns
+// false if another response holds the reservation. Untracked commands are
+// always allowed through.
+func (c *Client) claimResult(commandID string) bool {
+	c.resultsMu.Lock()
+	defer c.resultsMu.Unlock()
+
+	sent, tracked := c.results[commandID]
+	if !tracked {
+		return true
+	}
+	if sent {
+		return false
+	}
+	c.results[commandID] = true
+	return true
+}
+
+// releaseResult hands back a reservation whose response could not be sent,
+// leaving the command to the handler's error result or a retry
+func (c *Client) releaseResult(commandID string) {
+	c.resultsMu.Lock()
+	defer c.resultsMu.Unlock()
+
+	if _, tracked := c.results[commandID]; tracked {
+		c.results[commandID] = false
+	}
+}
+
+// errorResult describes a command failure with the client's classifiers
+func (c *Client) errorResult(err error) *protocol.ErrorResult {
+	return protocol.NewErrorResult(err, c.classifiers...)
+}
+
+// processErrorCode maps the process manager's sentinels and policy denials,
+// which every client recognises
+func processErrorCode(err error) protocol.ErrorCode {
+	switch {
+	case errors.Is(err, process.ErrProcessTimeout):
+		return protocol.CodeTimeout
+	case errors.Is(err, process.ErrProcessNotFound), errors.Is(err, process.ErrOutputNotFound),
+		errors.Is(err, process.ErrUnknownUser):
+		return protocol.CodeNotFound
+	case errors.Is(err, process.ErrProcessAlreadyExists):
+		return protocol.CodeAlreadyExists
+	case errors.Is(err, process.ErrMaxProcessesReached):
+		return protocol.CodeLimitReached
+	case errors.Is(err, process.ErrProcessNotRunning):
+		return protocol.CodeNotRunning
+	case errors.Is(err, process.ErrInvalidState):
+		return protocol.CodeInvalidState
+	case errors.Is(err, process.ErrShuttingDown):
+		return protocol.CodeUnavailable
+	case errors.Is(err, process.ErrInvalidLimits):
+		return protocol.CodeInvalidArgument
+	case errors.Is(err, policy.ErrDenied):
+		return protocol.CodePermissionDenied
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"shh/agent/internal/health"
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+)
+
+// decodeResult checks msg is a TypeResult and returns its payload
+func decodeResult(t *testing.T, msg protocol.Message) protocol.ResultPayload {
+	t.Helper()
+
+	require.Equal(t, protocol.TypeResult, msg.Type)
+
+	var result protocol.ResultPayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &result))
+	return result
+}
+
+func resultMessage(t *testing.T, commandID string, exitCode int) protocol.Message {
+	t.Helper()
+
+	payload, err := json.Marshal(protocol.ResultPayload{CommandID: commandID, ExitCode: exitCode})
+	require.NoError(t, err)
+	return protocol.Message{Type: protocol.TypeResult, ID: commandID, Timestamp: time.Now(), Payload: payload}
+}
+
+// sendCommand sends a command with the given ID to the agent on conn
+func sendCommand(t *testing.T, conn *websocket.Conn, id string) {
+	t.Helper()
+
+	writeMessage(t, conn, protocol.Message{
+		Type:      protocol.TypeCommand,
+		ID:        id,
+		Timestamp: time.Now(),
+		Payload:   json.RawMessage(`{"command":"uptime"}`),
+	})
+}
+
+func TestCommandFailureIsClassified(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+
+	s := newTestServer(t)
+	c := newClient(t, s, WithErrorClassifier(func(err error) protocol.ErrorCode {
+		if errors.Is(err, errQuota) {
+			return protocol.CodeLimitReached
+		}
+		return ""
+	}))
+	c.RegisterCommandHandler(func(ctx context.Context, msg protocol.Message) error {
+		switch msg.ID {
+		case "quota":
+			return errQuota
+		case "missing":
+			return process.ErrProcessNotFound
+		default:
+			return nil
+		}
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	for id, code := range map[string]protocol.ErrorCode{
+		"quota":   protocol.CodeLimitReached,
+		"missing": protocol.CodeNotFound,
+		"silent":  protocol.CodeInternal,
+	} {
+		sendCommand(t, conn, id)
+		result := decodeResult(t, readMessage(t, conn))
+		require.Equal(t, id, result.CommandID)
+		require.Equal(t, -1, result.ExitCode)
+		require.NotNil(t, result.Failure)
+		require.Equal(t, code, result.Failure.Code, id)
+	}
+}
+
+func TestDuplicateResultIsDropped(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+	c.RegisterCommandHandler(func(ctx context.Context, msg protocol.Message) error {
+		if err := c.SendMessage(resultMessage(t, msg.ID, 0)); err != nil {
+			return err
+		}
+		return c.SendMessage(resultMessage(t, msg.ID, 1))
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+
+	sendCommand(t, conn, "cmd-1")
+	sendCommand(t, conn, "cmd-2")
+
+	// Exactly one result per command, the first one sent
+	exitCodes := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		result := decodeResult(t, readMessage(t, conn))
+		require.Nil(t, result.Failure)
+		exitCodes[result.CommandID] = result.ExitCode
+	}
+	require.Equal(t, map[string]int{"cmd-1": 0, "cmd-2": 0}, exitCodes)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err := conn.ReadMessage()
+	require.Error(t, err, "unexpected message after the results")
+}
+
+func TestFailedResultSendCanBeRetried(t *testing.T) {
+	s := newTestServer(t)
+	c := newClient(t, s)
+
+	sendErrs := make(chan error, 2)
+	retry := make(chan struct{})
+	c.RegisterCommandHandler(func(ctx context.Context, msg protocol.Message) error {
+		<-retry
+		err := c.SendMessage(resultMessage(t, msg.ID, 0))
+		sendErrs <- err
+		if err == nil {
+			return nil
+		}
+
+		// A failed send doesn't count as the command's result
+		<-retry
+		err = c.SendMessage(resultMessage(t, msg.ID, 0))
+		sendErrs <- err
+		return err
+	})
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+	sendCommand(t, conn, "cmd-1")
+
+	// Lose the connection before the handler sends its result
+	s.refuse.Store(true)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return c.HealthCheck(context.Background()).Status == health.StatusDegraded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	retry <- struct{}{}
+	require.Error(t, <-sendErrs)
+
+	s.refuse.Store(false)
+	conn = s.accept(t)
+	requireRegistration(t, conn, "agent-1")
+	require.Eventually(t, func() bool {
+		return c.HealthCheck(context.Background()).Status == health.StatusHealthy
+	}, 5*time.Second, 10*time.Millisecond)
+
+	retry <- struct{}{}
+	require.NoError(t, <-sendErrs)
+
+	result := decodeResult(t, readMessage(t, conn))
+	require.Equal(t, "cmd-1", result.CommandID)
+	require.Nil(t, result.Failure)
+}
@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+)
+
+const (
+	// streamWindow is how many frames may be sent before the server acks them
+	streamWindow = 8
+
+	// streamMaxBytes and streamMaxLines bound a single frame
+	streamMaxBytes = 32 * 1024
+	streamMaxLines = 256
+
+	// streamFlushInterval bounds how long a line waits before it is sent
+	streamFlushInterval = 250 * time.Millisecond
+)
+
+// ResultStream sends command output to the server while the command runs, as
+// sequence-numbered TypeResultChunk frames. When the server negotiated result
+// acks, at most streamWindow frames are unacknowledged at any time and
+// writers block until the server catches up.
+type ResultStream struct {
+	client    *Client
+	commandID string
+	ctx       context.Context
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	mu      sync.Mutex
+	lines   []protocol.OutputLine
+	bytes   int
+	seq     uint64
+	closed  bool
+	ackMu   sync.Mutex
+	acked   uint64
+	ackWake chan struct{}
+}
+
+// NewResultStream opens a stream for the command with the given ID. Waiting
+// for acknowledgements is abandoned when ctx is done.
+func (c *Client) NewResultStream(ctx context.Context, commandID string) *ResultStream {
+	s := &ResultStream{
+		client:    c,
+		commandID: commandID,
+		ctx:       ctx,
+		stop:      make(chan struct{}),
+		ackWake:   make(chan struct{}, 1),
+	}
+
+	c.streamsMu.Lock()
+	c.streams[commandID] = s
+	c.streamsMu.Unlock()
+
+	go s.flushLoop()
+
+	return s
+}
+
+// Write queues a line of output, sending a frame once enough has accumulated
+func (s *ResultStream) Write(line process.CommandOutput) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("result stream %s is closed", s.commandID)
+	}
+
+	s.lines = append(s.lines, protocol.OutputLine(line))
+	s.bytes += len(line.Line)
+
+	if s.bytes >= streamMaxBytes || len(s.lines) >= streamMaxLines {
+		return s.flushLocked()
+	}
+	return nil
+}
+
+// Close flushes pending output and sends the final frame with the exit code
+func (s *ResultStream) Close(exitCode int, execErr error) error {
+	return s.finish(protocol.ResultChunk{ExitCode: exitCode}, execErr)
+}
+
+// CloseResult is Close for a command run by the process manager, adding the
+// terminating signal, wall time and resource usage to the final frame
+func (s *ResultStream) CloseResult(result *process.ExecuteResult, execErr error) error {
+	final := protocol.ResultChunk{
+		ExitCode: result.ExitCode,
+		Signal:   result.Signal,
+		WallTime: result.WallTime,
+	}
+	if result.Usage != nil {
+		usage := protocol.ResourceUsage(*result.Usage)
+		final.Usage = &usage
+	}
+	return s.finish(final, execErr)
+}
+
+// finish sends final as the last frame of the stream
+func (s *ResultStream) finish(final protocol.ResultChunk, execErr error) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+
+	defer func() {
+		s.client.streamsMu.Lock()
+		delete(s.client.streams, s.commandID)
+		s.client.streamsMu.Unlock()
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if err := s.flushLocked(); err != nil {
+		s.client.logger.Warn("Dropping unsent command output",
+			zap.String("command_id", s.commandID),
+			zap.Int("lines", len(s.lines)),
+			zap.Error(err))
+		s.lines = nil
+	}
+
+	if !s.client.claimResult(s.commandID) {
+		s.client.logger.Warn("Command already has a result, not sending final frame",
+			zap.String("command_id", s.commandID))
+		return nil
+	}
+
+	// The final frame skips flow control so a cancelled or stalled stream
+	// still terminates on the server
+	final.CommandID = s.commandID
+	final.Final = true
+	if execErr != nil {
+		final.Error = execErr.Error()
+		final.Failure = s.client.errorResult(execErr)
+	}
+
+	if err := s.sendLocked(final); err != nil {
+		s.client.releaseResult(s.commandID)
+		return err
+	}
+
+	return nil
+}
+
+// flushLoop sends buffered lines periodically so slow output isn't held back
+func (s *ResultStream) flushLoop() {
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.flushLocked()
+			s.mu.Unlock()
+			if err != nil {
+				s.client.logger.Warn("Failed to flush result stream",
+					zap.String("command_id", s.commandID),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// flushLocked sends buffered lines as one frame. Must be called with s.mu held.
+func (s *ResultStream) flushLocked() error {
+	if len(s.lines) == 0 {
+		return nil
+	}
+
+	if err := s.waitForWindow(); err != nil {
+		return err
+	}
+
+	chunk := protocol.ResultChunk{
+		CommandID: s.commandID,
+		Lines:     s.lines,
+	}
+	s.lines = nil
+	s.bytes = 0
+
+	return s.sendLocked(chunk)
+}
+
+// sendLocked numbers and sends a frame. Must be called with s.mu held.
+func (s *ResultStream) sendLocked(chunk protocol.ResultChunk) error {
+	s.seq++
+	chunk.Seq = s.seq
+
+	payload, err := json.Marshal(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result chunk: %w", err)
+	}
+
+	return s.client.SendMessage(protocol.Message{
+		Type:      protocol.TypeResultChunk,
+		ID:        fmt.Sprintf("%s-%d", s.commandID, chunk.Seq),
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// waitForWindow blocks until fewer than streamWindow frames are unacknowledged.
+// Servers that don't ack frames are never waited for.
+func (s *ResultStream) waitForWindow() error {
+	if !s.client.Session().ResultAcks {
+		return nil
+	}
+
+	for {
+		s.ackMu.Lock()
+		outstanding := s.seq - s.acked
+		s.ackMu.Unlock()
+
+		if outstanding < streamWindow {
+			return nil
+		}
+
+		select {
+		case <-s.ackWake:
+		case <-s.ctx.Done():
+			return fmt.Errorf("result stream %s: %w", s.commandID, s.ctx.Err())
+		case <-s.client.stop:
+			return fmt.Errorf("result stream %s: %w", s.commandID, ErrClientClosed)
+		}
+	}
+}
+
+// ack records the server's acknowledgement of frames up to seq
+func (s *ResultStream) ack(seq uint64) {
+	s.ackMu.Lock()
+	if seq > s.acked {
+		s.acked = seq
+	}
+	s.ackMu.Unlock()
+
+	select {
+	case s.ackWake <- struct{}{}:
+	default:
+	}
+}
+
+// handleResultAck routes a flow-control acknowledgement to its stream
+func (c *Client) handleResultAck(msg protocol.Message) {
+	ack, err := protocol.DecodePayload[protocol.ResultAck](msg)
+	if err != nil {
+		c.logger.Error("Invalid result ack payload", zap.Error(err))
+		return
+	}
+
+	c.streamsMu.Lock()
+	s, ok := c.streams[ack.CommandID]
+	c.streamsMu.Unlock()
+
+	if ok {
+		s.ack(ack.Seq)
+	}
+}
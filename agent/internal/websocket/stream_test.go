@@ -0,0 +1,137 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"shh/agent/internal/process"
+	"shh/agent/internal/protocol"
+)
+
+// frameLine is large enough that every Write sends a frame of its own
+var frameLine = process.CommandOutput{Stream: "stdout", Line: strings.Repeat("x", streamMaxBytes)}
+
+// connectRegistered connects a client to s and completes the handshake with ack
+func connectRegistered(t *testing.T, s *testServer, ack protocol.RegisterAck, opts ...ClientOption) (*Client, *websocket.Conn) {
+	t.Helper()
+
+	c := newClient(t, s, opts...)
+	acks := registeredAcks(c)
+	require.NoError(t, c.Connect(context.Background()))
+
+	conn := s.accept(t)
+	reg := requireRegistration(t, conn, "agent-1")
+	ackRegistration(t, conn, reg, ack)
+	waitAck(t, acks)
+
+	return c, conn
+}
+
+// readChunk reads the next streamed frame sent on conn
+func readChunk(t *testing.T, conn *websocket.Conn) protocol.ResultChunk {
+	t.Helper()
+
+	msg := readMessage(t, conn)
+	require.Equal(t, protocol.TypeResultChunk, msg.Type)
+
+	var chunk protocol.ResultChunk
+	require.NoError(t, json.Unmarshal(msg.Payload, &chunk))
+	return chunk
+}
+
+// writeAsync writes line to rs in the background
+func writeAsync(rs *ResultStream, line process.CommandOutput) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- rs.Write(line)
+	}()
+	return done
+}
+
+func TestResultStreamWaitsForAcks(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := connectRegistered(t, s, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, ResultAcks: true})
+
+	rs := c.NewResultStream(context.Background(), "cmd-1")
+	for i := 1; i <= streamWindow; i++ {
+		require.NoError(t, rs.Write(frameLine))
+		require.Equal(t, uint64(i), readChunk(t, conn).Seq)
+	}
+
+	// The window is full until the server acks
+	blocked := writeAsync(rs, frameLine)
+	select {
+	case err := <-blocked:
+		t.Fatalf("write returned with a full window: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	payload, err := json.Marshal(protocol.ResultAck{CommandID: "cmd-1", Seq: 2})
+	require.NoError(t, err)
+	writeMessage(t, conn, protocol.Message{Type: protocol.TypeResultAck, ID: "ack-1", Timestamp: time.Now(), Payload: payload})
+
+	select {
+	case err := <-blocked:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write did not resume after ack")
+	}
+	require.Equal(t, uint64(streamWindow+1), readChunk(t, conn).Seq)
+
+	// The final frame is sent even though the window is full again
+	require.NoError(t, rs.Close(3, nil))
+	final := readChunk(t, conn)
+	require.True(t, final.Final)
+	require.Equal(t, 3, final.ExitCode)
+	require.Equal(t, uint64(streamWindow+2), final.Seq)
+}
+
+func TestResultStreamWithoutAcks(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := connectRegistered(t, s, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion})
+
+	// A server that never acks doesn't stall the stream
+	rs := c.NewResultStream(context.Background(), "cmd-1")
+	for i := 1; i <= 2*streamWindow; i++ {
+		require.NoError(t, rs.Write(frameLine))
+		require.Equal(t, uint64(i), readChunk(t, conn).Seq)
+	}
+
+	require.NoError(t, rs.Close(0, nil))
+	require.True(t, readChunk(t, conn).Final)
+}
+
+func TestResultStreamCancelledWhileWaiting(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := connectRegistered(t, s, protocol.RegisterAck{ProtocolVersion: protocol.ProtocolVersion, ResultAcks: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs := c.NewResultStream(ctx, "cmd-1")
+	for i := 0; i < streamWindow; i++ {
+		require.NoError(t, rs.Write(frameLine))
+		readChunk(t, conn)
+	}
+
+	blocked := writeAsync(rs, frameLine)
+	cancel()
+
+	select {
+	case err := <-blocked:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write did not return after cancel")
+	}
+
+	// Unsent output is dropped but the stream still ends
+	require.NoError(t, rs.Close(-1, context.Canceled))
+	final := readChunk(t, conn)
+	require.True(t, final.Final)
+	require.Empty(t, final.Lines)
+	require.Equal(t, context.Canceled.Error(), final.Error)
+}
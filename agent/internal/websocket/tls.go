@@ -0,0 +1,222 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"shh/agent/internal/config"
+)
+
+// TLSLoader builds TLS client configurations from the security settings and
+// reloads the certificate, key and CA files whenever they change on disk, so
+// rotated certificates are picked up by the next dial without a restart
+type TLSLoader struct {
+	cfg        config.SecurityConfig
+	minVersion uint16
+	logger     *zap.Logger
+	watcher    *fsnotify.Watcher
+	done       chan struct{}
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// NewTLSLoader loads the configured certificates and starts watching them
+func NewTLSLoader(cfg config.SecurityConfig, logger *zap.Logger) (*TLSLoader, error) {
+	minVersion, err := parseTLSVersion(cfg.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+
+	l := &TLSLoader{
+		cfg:        cfg,
+		minVersion: minVersion,
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+
+	if cfg.SkipVerify {
+		logger.Warn("TLS certificate verification is disabled")
+	}
+
+	if err := l.watch(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Config returns a TLS configuration using the current certificates
+func (l *TLSLoader) Config() *tls.Config {
+	l.mu.RLock()
+	pool := l.pool
+	l.mu.RUnlock()
+
+	tlsConfig := &tls.Config{
+		MinVersion:         l.minVersion,
+		RootCAs:            pool,
+		InsecureSkipVerify: l.cfg.SkipVerify,
+	}
+
+	if l.cfg.CertFile != "" {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			return l.cert, nil
+		}
+	}
+
+	return tlsConfig
+}
+
+// Close stops watching the certificate files
+func (l *TLSLoader) Close() error {
+	if l.watcher == nil {
+		return nil
+	}
+	err := l.watcher.Close()
+	<-l.done
+	return err
+}
+
+// reload reads the certificate files. On failure the previously loaded
+// certificates stay in use.
+func (l *TLSLoader) reload() error {
+	var cert *tls.Certificate
+	if l.cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(l.cfg.CertFile, l.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if l.cfg.CAFile != "" {
+		pem, err := os.ReadFile(l.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA file %s", l.cfg.CAFile)
+		}
+	}
+
+	l.mu.Lock()
+	l.cert = cert
+	l.pool = pool
+	l.mu.Unlock()
+
+	return nil
+}
+
+// watch starts an fsnotify watcher on the directories holding the
+// certificate files. Directories are watched rather than the files so
+// replacements by rename (as done by cert-manager and most deploy tools) are
+// seen too.
+func (l *TLSLoader) watch() error {
+	files := make(map[string]bool)
+	for _, f := range []string{l.cfg.CertFile, l.cfg.KeyFile, l.cfg.CAFile} {
+		if f != "" {
+			files[filepath.Clean(f)] = true
+		}
+	}
+
+	if len(files) == 0 {
+		close(l.done)
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create certificate watcher: %w", err)
+	}
+
+	dirs := make(map[string]bool)
+	for f := range files {
+		dir := filepath.Dir(f)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	l.watcher = watcher
+	go l.watchLoop(files)
+
+	return nil
+}
+
+func (l *TLSLoader) watchLoop(files map[string]bool) {
+	defer close(l.done)
+
+	for {
+		select {
+		case event, ok := <-l.watcher.Events:
+			if !ok {
+				return
+			}
+			if !files[filepath.Clean(event.Name)] && !isSymlinkSwap(event.Name) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := l.reload(); err != nil {
+				// Files are often replaced one at a time; the next event
+				// will retry once the set is consistent again
+				l.logger.Warn("Failed to reload TLS certificates", zap.Error(err))
+				continue
+			}
+			l.logger.Info("Reloaded TLS certificates", zap.String("trigger", event.Name))
+		case err, ok := <-l.watcher.Errors:
+			if !ok {
+				return
+			}
+			l.logger.Error("Certificate watcher error", zap.Error(err))
+		}
+	}
+}
+
+// isSymlinkSwap reports whether name is the data link Kubernetes swaps when
+// it updates a mounted secret
+func isSymlinkSwap(name string) bool {
+	return filepath.Base(name) == "..data"
+}
+
+// parseTLSVersion converts a version string such as "1.2" to its tls constant
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	default:
+		return 0, fmt.Errorf("unsupported min_tls_version %q", version)
+	}
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"shh/agent/internal/protocol"
+)
+
+// ErrUpgradeRefused indicates the server, or something between it and the
+// agent, answered the connection attempt but refused the transport. The
+// client then tries the next transport for the same server.
+var ErrUpgradeRefused = errors.New("transport refused by server")
+
+// Conn is an established connection to the server. Whatever the transport,
+// it carries whole protocol.Message envelopes in both directions.
+type Conn interface {
+	// ReadMessage blocks until the next message from the server arrives
+	ReadMessage() (protocol.Message, error)
+
+	// WriteMessage sends msg to the server. It is safe for concurrent use.
+	WriteMessage(msg protocol.Message) error
+
+	// Binary reports whether the connection can carry binary codecs
+	Binary() bool
+
+	// SetCodec switches the encoding of outgoing messages once negotiated
+	SetCodec(codec protocol.Codec)
+
+	// Close ends the connection normally and unblocks ReadMessage
+	Close() error
+
+	// CloseWith ends the connection telling the server why, using the
+	// websocket close codes. Transports without close codes ignore them.
+	CloseWith(code int, reason string) error
+}
+
+// Transport opens connections to the server
+type Transport interface {
+	Name() string
+	Dial(ctx context.Context, url string) (Conn, error)
+}
+
+// WithTransports sets the transports tried for each server, in order. The
+// default is a websocket with an HTTP long-poll fallback.
+func WithTransports(transports ...Transport) ClientOption {
+	return func(c *Client) {
+		c.transports = transports
+	}
+}
+
+// WithLongPollFallback controls whether the default transports fall back to
+// HTTP long-polling when the websocket upgrade is refused
+func WithLongPollFallback(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.longPollFallback = enabled
+	}
+}
+
+// defaultTransports returns the transports used when none are configured
+func (c *Client) defaultTransports() []Transport {
+	transports := []Transport{&wsTransport{client: c}}
+	if c.longPollFallback {
+		transports = append(transports, &longPollTransport{client: c})
+	}
+	return transports
+}
+
+// open connects to url with the first transport that works. A transport is
+// only skipped when it refuses the connection; other failures mean the
+// server is unreachable and are returned straight away.
+func (c *Client) open(ctx context.Context, url string) (Conn, string, error) {
+	var lastErr error
+
+	for i, transport := range c.transports {
+		conn, err := transport.Dial(ctx, url)
+		if err == nil {
+			return conn, transport.Name(), nil
+		}
+		lastErr = err
+
+		if !errors.Is(err, ErrUpgradeRefused) {
+			break
+		}
+		if i+1 < len(c.transports) {
+			c.logger.Warn("Transport refused, falling back",
+				zap.String("transport", transport.Name()),
+				zap.String("next", c.transports[i+1].Name()),
+				zap.String("server", url),
+				zap.Error(err))
+		}
+	}
+
+	return nil, "", fmt.Errorf("failed to connect to %s: %w", url, lastErr)
+}